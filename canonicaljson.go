@@ -0,0 +1,434 @@
+/* Copyright 2016-2017 Vector Creations Ltd
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package gomatrixserverlib
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// The largest and smallest integers that canonical JSON can represent.
+// https://matrix.org/docs/spec/appendices#canonical-json
+const (
+	maxCanonicalJSONInt = 9007199254740991
+	minCanonicalJSONInt = -9007199254740991
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// MarshalCanonicalJSON encodes a Go value directly as canonical JSON.
+// It follows the same rules as encoding/json for struct tags, embedded
+// structs, json.Marshaler and encoding.TextMarshaler, but produces object
+// keys sorted by codepoint and the minimal string escaping of CompactJSON.
+// The output is identical to passing the output of json.Marshal through
+// CanonicalJSON, but avoids re-parsing the JSON. The output of any
+// json.Marshaler is still re-encoded using CanonicalJSON.
+// Returns an error wrapping ErrCanonicalJSON if an integer is outside of the
+// range that canonical JSON permits.
+func MarshalCanonicalJSON(v interface{}) ([]byte, error) {
+	return appendCanonicalJSON(make([]byte, 0, 512), reflect.ValueOf(v))
+}
+
+// appendCanonicalJSON appends the canonical encoding of v to output.
+func appendCanonicalJSON(output []byte, v reflect.Value) ([]byte, error) { // nolint: gocyclo
+	if !v.IsValid() {
+		return append(output, "null"...), nil
+	}
+
+	// Check for marshallers before anything else. Like encoding/json we use
+	// pointer receivers only if the value is addressable.
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		if ptrType := reflect.PtrTo(v.Type()); ptrType.Implements(jsonMarshalerType) || ptrType.Implements(textMarshalerType) {
+			v = v.Addr()
+		}
+	}
+	if v.Type().Implements(jsonMarshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return append(output, "null"...), nil
+		}
+		raw, err := v.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		canonical, err := CanonicalJSON(raw)
+		if err != nil {
+			return nil, err
+		}
+		return append(output, canonical...), nil
+	}
+	if v.Type().Implements(textMarshalerType) {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			return append(output, "null"...), nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return nil, err
+		}
+		return appendCanonicalJSONString(output, string(text)), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.AppendBool(output, v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		if n < minCanonicalJSONInt || n > maxCanonicalJSONInt {
+			return nil, fmt.Errorf("gomatrixserverlib: integer %d: %w", n, ErrCanonicalJSON)
+		}
+		return strconv.AppendInt(output, n, 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := v.Uint()
+		if n > maxCanonicalJSONInt {
+			return nil, fmt.Errorf("gomatrixserverlib: integer %d: %w", n, ErrCanonicalJSON)
+		}
+		return strconv.AppendUint(output, n, 10), nil
+	case reflect.Float32, reflect.Float64:
+		// Floats aren't canonical JSON, but older room versions allow them
+		// so encode them the same way that encoding/json does.
+		raw, err := json.Marshal(v.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return append(output, raw...), nil
+	case reflect.String:
+		return appendCanonicalJSONString(output, v.String()), nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return append(output, "null"...), nil
+		}
+		return appendCanonicalJSON(output, v.Elem())
+	case reflect.Struct:
+		return appendCanonicalJSONStruct(output, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(output, "null"...), nil
+		}
+		return appendCanonicalJSONMap(output, v)
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(output, "null"...), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && !v.Type().Elem().Implements(jsonMarshalerType) {
+			// Byte slices are encoded as standard base64, as in encoding/json.
+			output = append(output, '"')
+			output = append(output, base64.StdEncoding.EncodeToString(v.Bytes())...)
+			return append(output, '"'), nil
+		}
+		return appendCanonicalJSONArray(output, v)
+	case reflect.Array:
+		return appendCanonicalJSONArray(output, v)
+	default:
+		return nil, fmt.Errorf("gomatrixserverlib: unsupported type for canonical JSON: %s", v.Type())
+	}
+}
+
+// appendCanonicalJSONString appends s as a JSON string, only escaping the
+// characters that must be escaped.
+func appendCanonicalJSONString(output []byte, s string) []byte {
+	const (
+		ESCAPES = "uuuuuuuubtnufruuuuuuuuuuuuuuuuuu"
+		HEX     = "0123456789ABCDEF"
+	)
+	output = append(output, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c < ' ':
+				escape := ESCAPES[c]
+				output = append(output, '\\', escape)
+				if escape == 'u' {
+					output = append(output, '0', '0', byte('0'+(c>>4)), HEX[c&0xF])
+				}
+			case c == '"' || c == '\\':
+				output = append(output, '\\', c)
+			default:
+				output = append(output, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			// Invalid UTF-8 is replaced with U+FFFD, as in encoding/json.
+			output = append(output, "\ufffd"...)
+		} else {
+			output = append(output, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(output, '"')
+}
+
+func appendCanonicalJSONArray(output []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	output = append(output, '[')
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			output = append(output, ',')
+		}
+		if output, err = appendCanonicalJSON(output, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return append(output, ']'), nil
+}
+
+func appendCanonicalJSONMap(output []byte, v reflect.Value) ([]byte, error) {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := canonicalJSONMapKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].key < entries[b].key
+	})
+
+	var err error
+	output = append(output, '{')
+	for i, e := range entries {
+		if i > 0 {
+			output = append(output, ',')
+		}
+		output = appendCanonicalJSONString(output, e.key)
+		output = append(output, ':')
+		if output, err = appendCanonicalJSON(output, e.value); err != nil {
+			return nil, err
+		}
+	}
+	return append(output, '}'), nil
+}
+
+// canonicalJSONMapKey converts a map key to a string in the same way that
+// encoding/json does.
+func canonicalJSONMapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("gomatrixserverlib: unsupported map key type for canonical JSON: %s", k.Type())
+}
+
+func appendCanonicalJSONStruct(output []byte, v reflect.Value) ([]byte, error) {
+	var err error
+	sep := byte('{')
+FieldLoop:
+	for _, f := range canonicalJSONFields(v.Type()) {
+		fv := v
+		for _, i := range f.index {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					// The field is in a nil embedded struct so skip it.
+					continue FieldLoop
+				}
+				fv = fv.Elem()
+			}
+			fv = fv.Field(i)
+		}
+		if f.omitEmpty && isEmptyJSONValue(fv) {
+			continue
+		}
+		output = append(output, sep)
+		sep = ','
+		output = appendCanonicalJSONString(output, f.name)
+		output = append(output, ':')
+		if f.quoted {
+			// The ",string" option is rare enough that it isn't worth
+			// reimplementing, so let encoding/json handle it.
+			var raw []byte
+			if raw, err = json.Marshal(fv.Interface()); err == nil {
+				output = appendCanonicalJSONString(output, string(raw))
+			}
+		} else {
+			output, err = appendCanonicalJSON(output, fv)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sep == '{' {
+		return append(output, '{', '}'), nil
+	}
+	return append(output, '}'), nil
+}
+
+// isEmptyJSONValue implements the same check as encoding/json uses for
+// the "omitempty" option.
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// A canonicalJSONField is a struct field that will be encoded as JSON.
+type canonicalJSONField struct {
+	name      string
+	index     []int // The path of field indices through embedded structs.
+	tagged    bool
+	omitEmpty bool
+	quoted    bool
+}
+
+// canonicalJSONFieldCache maps reflect.Type to []canonicalJSONField.
+var canonicalJSONFieldCache sync.Map
+
+// canonicalJSONFields returns the fields of a struct type that will be
+// encoded, sorted by name.
+func canonicalJSONFields(t reflect.Type) []canonicalJSONField {
+	if cached, ok := canonicalJSONFieldCache.Load(t); ok {
+		return cached.([]canonicalJSONField)
+	}
+
+	var all []canonicalJSONField
+	collectCanonicalJSONFields(t, nil, map[reflect.Type]bool{}, &all)
+
+	// Go's embedding rules pick the shallowest field with a given name,
+	// preferring tagged fields, and drop the name if that is ambiguous.
+	// Sorting by name, depth and tagged-ness groups the candidates together.
+	sort.SliceStable(all, func(a, b int) bool {
+		if all[a].name != all[b].name {
+			return all[a].name < all[b].name
+		}
+		if len(all[a].index) != len(all[b].index) {
+			return len(all[a].index) < len(all[b].index)
+		}
+		return all[a].tagged && !all[b].tagged
+	})
+	var fields []canonicalJSONField
+	for i := 0; i < len(all); {
+		j := i + 1
+		for j < len(all) && all[j].name == all[i].name {
+			j++
+		}
+		candidates := all[i:j]
+		if len(candidates) == 1 ||
+			len(candidates[0].index) < len(candidates[1].index) ||
+			candidates[0].tagged && !candidates[1].tagged {
+			fields = append(fields, candidates[0])
+		}
+		i = j
+	}
+
+	canonicalJSONFieldCache.Store(t, fields)
+	return fields
+}
+
+func collectCanonicalJSONFields(
+	t reflect.Type, index []int, visited map[reflect.Type]bool, fields *[]canonicalJSONField,
+) {
+	if visited[t] {
+		return
+	}
+	visited[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if comma := strings.IndexByte(tag, ','); comma >= 0 {
+			name, opts = tag[:comma], tag[comma:]
+		}
+
+		fieldIndex := make([]int, len(index)+1)
+		copy(fieldIndex, index)
+		fieldIndex[len(index)] = i
+
+		ft := sf.Type
+		if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if sf.Anonymous {
+			if sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+				// Ignore embedded fields of unexported non-struct types.
+				continue
+			}
+			if name == "" && ft.Kind() == reflect.Struct {
+				// Promote the fields of untagged embedded structs.
+				collectCanonicalJSONFields(ft, fieldIndex, visited, fields)
+				continue
+			}
+		} else if sf.PkgPath != "" {
+			// Ignore unexported fields.
+			continue
+		}
+
+		field := canonicalJSONField{
+			name:      name,
+			index:     fieldIndex,
+			tagged:    name != "",
+			omitEmpty: strings.Contains(opts, ",omitempty"),
+		}
+		if field.name == "" {
+			field.name = sf.Name
+		}
+		if strings.Contains(opts, ",string") {
+			switch ft.Kind() {
+			case reflect.Bool, reflect.String,
+				reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+				reflect.Float32, reflect.Float64:
+				field.quoted = true
+			}
+		}
+		*fields = append(*fields, field)
+	}
+	visited[t] = false
+}
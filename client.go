@@ -39,8 +39,11 @@ const requestTimeout time.Duration = time.Duration(30) * time.Second
 // A Client makes request to the federation listeners of matrix
 // homeservers
 type Client struct {
-	client    http.Client
-	userAgent string
+	client                   http.Client
+	userAgent                string
+	defaultRetryPolicy       *RetryPolicy
+	destinationRetryPolicies map[ServerName]RetryPolicy
+	health                   *DestinationHealthTracker
 }
 
 // UserInfo represents information about a user.
@@ -49,11 +52,15 @@ type UserInfo struct {
 }
 
 type clientOptions struct {
-	transport  http.RoundTripper
-	dnsCache   *DNSCache
-	timeout    time.Duration
-	skipVerify bool
-	keepAlives bool
+	transport                http.RoundTripper
+	dnsCache                 *DNSCache
+	timeout                  time.Duration
+	skipVerify               bool
+	keepAlives               bool
+	retryPolicy              *RetryPolicy
+	destinationRetryPolicies map[ServerName]RetryPolicy
+	health                   *DestinationHealthTracker
+	resolver                 *Resolver
 }
 
 // ClientOption are supplied to NewClient or NewFederationClient.
@@ -61,7 +68,7 @@ type ClientOption func(*clientOptions)
 
 // NewClient makes a new Client. You can supply zero or more ClientOptions
 // which control the transport, timeout, TLS validation etc - see
-// WithTransport, WithTimeout, WithSkipVerify, WithDNSCache etc.
+// WithTransport, WithTimeout, WithSkipVerify, WithDNSCache, WithRetryPolicy etc.
 func NewClient(options ...ClientOption) *Client {
 	clientOpts := &clientOptions{
 		timeout: requestTimeout,
@@ -74,6 +81,7 @@ func NewClient(options ...ClientOption) *Client {
 			clientOpts.skipVerify,
 			clientOpts.dnsCache,
 			clientOpts.keepAlives,
+			clientOpts.resolver,
 		)
 	}
 	client := &Client{
@@ -81,6 +89,9 @@ func NewClient(options ...ClientOption) *Client {
 			Transport: clientOpts.transport,
 			Timeout:   clientOpts.timeout,
 		},
+		defaultRetryPolicy:       clientOpts.retryPolicy,
+		destinationRetryPolicies: clientOpts.destinationRetryPolicies,
+		health:                   clientOpts.health,
 	}
 	return client
 }
@@ -129,23 +140,38 @@ func WithKeepAlives(keepAlives bool) ClientOption {
 	}
 }
 
+// WithResolver is an option that can be supplied to either NewClient or
+// NewFederationClient to resolve server names with the given Resolver rather
+// than the default one. This option will be ineffective if WithTransport
+// has already been supplied.
+func WithResolver(resolver *Resolver) ClientOption {
+	return func(options *clientOptions) {
+		options.resolver = resolver
+	}
+}
+
 // nolint:maligned
 type federationTripper struct {
 	// transports maps an TLS server name with an HTTP transport.
 	transports      map[string]http.RoundTripper
 	transportsMutex sync.Mutex
 	skipVerify      bool
-	resolutionCache sync.Map // serverName -> []ResolutionResult
+	resolutionCache sync.Map // serverName -> []ResolutionResult, in any order
 	dnsCache        *DNSCache
 	keepAlives      bool
+	resolver        *Resolver
 }
 
-func newFederationTripper(skipVerify bool, dnsCache *DNSCache, keepAlives bool) *federationTripper {
+func newFederationTripper(skipVerify bool, dnsCache *DNSCache, keepAlives bool, resolver *Resolver) *federationTripper {
+	if resolver == nil {
+		resolver = &Resolver{}
+	}
 	return &federationTripper{
 		transports: make(map[string]http.RoundTripper),
 		skipVerify: skipVerify,
 		dnsCache:   dnsCache,
 		keepAlives: keepAlives,
+		resolver:   resolver,
 	}
 }
 
@@ -196,14 +222,17 @@ func (f *federationTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 retryResolution:
 	if cached, ok := f.resolutionCache.Load(serverName); ok {
 		if results, ok := cached.([]ResolutionResult); ok {
-			resolutionResults = results
+			// Choose a new order for each request so that requests are
+			// spread over the SRV targets by weight, rather than all going
+			// to the targets that were chosen when the results were cached.
+			resolutionResults = orderResolutionResults(results)
 		}
 	}
 
 	// If the cache returned nothing then we'll have no results here,
 	// so go and hit the network.
 	if len(resolutionResults) == 0 {
-		resolutionResults, err = ResolveServer(serverName)
+		resolutionResults, err = f.resolver.ResolveServer(r.Context(), serverName)
 		if err != nil {
 			return nil, err
 		}
@@ -217,12 +246,21 @@ retryResolution:
 	}
 
 	var resp *http.Response
-	// TODO: respect the priority and weight fields from the SRV record
-	for _, result := range resolutionResults {
+	// The results are already in the order that they should be tried in.
+	for i, result := range resolutionResults {
+		// RoundTrippers mustn't modify the request, so send a copy of it
+		// with the resolved address.
 		u := makeHTTPSURL(r.URL, result.Destination)
-		r.URL = &u
-		r.Host = string(result.Host)
-		resp, err = f.getTransport(result.TLSServerName).RoundTrip(r)
+		req := r.Clone(r.Context())
+		req.URL = &u
+		req.Host = string(result.Host)
+		if (i > 0 || resolutionRetried) && r.GetBody != nil {
+			// The previous attempt may have consumed the body.
+			if req.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = f.getTransport(result.TLSServerName).RoundTrip(req)
 		if err == nil {
 			return resp, nil
 		}
@@ -361,20 +399,17 @@ func (fc *Client) LookupServerKeys(
 
 	// The request format is:
 	// { "server_keys": { "<server_name>": { "<key_id>": { "minimum_valid_until_ts": <ts> }}}
-	type keyreq struct {
-		MinimumValidUntilTS Timestamp `json:"minimum_valid_until_ts"`
+	request := PublicKeyNotaryLookupRequest{
+		ServerKeys: map[ServerName]map[KeyID]PublicKeyNotaryQueryCriteria{},
 	}
-	request := struct {
-		ServerKeyMap map[ServerName]map[KeyID]keyreq `json:"server_keys"`
-	}{map[ServerName]map[KeyID]keyreq{}}
 	for k, ts := range keyRequests {
-		server := request.ServerKeyMap[k.ServerName]
+		server := request.ServerKeys[k.ServerName]
 		if server == nil {
-			server = map[KeyID]keyreq{}
-			request.ServerKeyMap[k.ServerName] = server
+			server = map[KeyID]PublicKeyNotaryQueryCriteria{}
+			request.ServerKeys[k.ServerName] = server
 		}
 		if k.KeyID != "" {
-			server[k.KeyID] = keyreq{ts}
+			server[k.KeyID] = PublicKeyNotaryQueryCriteria{MinimumValidUntilTS: ts}
 		}
 	}
 
@@ -435,17 +470,43 @@ func (fc *Client) CreateMediaDownloadRequest(
 // body into a gomatrix.RespError. In any case, a non-200 response will result
 // in a gomatrix.HTTPError.
 //
+// If the Client has a RetryPolicy then the request is sent again if it fails
+// in a way that the policy allows to be retried. If the Client has a
+// DestinationHealthTracker which says that the destination is down then a
+// DestinationUnavailableError is returned without sending the request.
+//
 func (fc *Client) DoRequestAndParseResponse(
 	ctx context.Context,
 	req *http.Request,
 	result interface{},
 ) error {
-	response, err := fc.DoHTTPRequest(ctx, req)
+	destination := ServerName(req.URL.Host)
+	if err := fc.health.check(destination); err != nil {
+		return err
+	}
+	var statusCode int
+	err := fc.doWithRetries(ctx, req, func(attemptReq *http.Request) (int, error) {
+		var err error
+		statusCode, err = fc.doRequestAndParseResponse(ctx, attemptReq, result)
+		return statusCode, err
+	})
+	fc.health.record(ctx, destination, statusCode, err)
+	return err
+}
+
+// doRequestAndParseResponse makes a single attempt at DoRequestAndParseResponse
+// and returns the HTTP status code of the response, or 0 if there wasn't one.
+func (fc *Client) doRequestAndParseResponse(
+	ctx context.Context,
+	req *http.Request,
+	result interface{},
+) (int, error) {
+	response, err := fc.doHTTPRequest(ctx, req)
 	if response != nil {
 		defer response.Body.Close() // nolint: errcheck
 	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if response.StatusCode/100 != 2 { // not 2xx
@@ -453,7 +514,7 @@ func (fc *Client) DoRequestAndParseResponse(
 		var contents []byte
 		contents, err = ioutil.ReadAll(response.Body)
 		if err != nil {
-			return err
+			return response.StatusCode, err
 		}
 
 		var wrap error
@@ -469,7 +530,7 @@ func (fc *Client) DoRequestAndParseResponse(
 			msg += ": " + string(contents)
 		}
 
-		return gomatrix.HTTPError{
+		return response.StatusCode, gomatrix.HTTPError{
 			Code:         response.StatusCode,
 			Message:      msg,
 			WrappedError: wrap,
@@ -478,10 +539,10 @@ func (fc *Client) DoRequestAndParseResponse(
 	}
 
 	if err = json.NewDecoder(response.Body).Decode(result); err != nil {
-		return err
+		return response.StatusCode, err
 	}
 
-	return nil
+	return response.StatusCode, nil
 }
 
 // DoHTTPRequest creates an outgoing request ID and adds it to the context
@@ -490,7 +551,25 @@ func (fc *Client) DoRequestAndParseResponse(
 // If the returned error is nil, the Response will contain a non-nil
 // Body which the caller is expected to close.
 //
+// If the Client has a DestinationHealthTracker which says that the destination
+// is down then a DestinationUnavailableError is returned without sending the
+// request.
+//
 func (fc *Client) DoHTTPRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	destination := ServerName(req.URL.Host)
+	if err := fc.health.check(destination); err != nil {
+		return nil, err
+	}
+	resp, err := fc.doHTTPRequest(ctx, req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	fc.health.record(ctx, destination, statusCode, err)
+	return resp, err
+}
+
+func (fc *Client) doHTTPRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
 	reqID := util.RandomString(12)
 	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
 		"out.req.ID":     reqID,
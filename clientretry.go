@@ -0,0 +1,299 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// A RetryPolicy controls how a Client retries requests that failed in a way
+// that might succeed if they were sent again: the destination couldn't be
+// reached, returned a 5xx error or rate limited us.
+//
+// Only requests with idempotent methods (GET, HEAD, OPTIONS, PUT and DELETE)
+// are retried, unless the context was made with ContextWithRetryAllowed.
+type RetryPolicy struct {
+	// The maximum number of times to send a request, including the first.
+	// Values less than 2 disable retries.
+	MaxAttempts int
+	// How long to wait before the first retry. The wait doubles for each
+	// retry after that, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// The fraction of each wait, between 0 and 1, which is random so that
+	// requests that failed together don't all retry together.
+	Jitter float64
+	// The longest wait that a destination can ask for with an
+	// M_LIMIT_EXCEEDED error's retry_after_ms before the error is returned
+	// instead of retrying. Zero means there is no limit.
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy returns a RetryPolicy which sends a request up to three
+// times, waiting around half a second and then a second between attempts.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Jitter:         0.5,
+		MaxRetryAfter:  30 * time.Second,
+	}
+}
+
+// WithRetryPolicy is an option that can be supplied to either NewClient or
+// NewFederationClient to retry failed requests. Requests aren't retried by
+// default.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(options *clientOptions) {
+		options.retryPolicy = &policy
+	}
+}
+
+// WithDestinationRetryPolicy is an option that can be supplied to either
+// NewClient or NewFederationClient to use a different RetryPolicy for
+// requests to the given destination than for other requests.
+func WithDestinationRetryPolicy(destination ServerName, policy RetryPolicy) ClientOption {
+	return func(options *clientOptions) {
+		if options.destinationRetryPolicies == nil {
+			options.destinationRetryPolicies = map[ServerName]RetryPolicy{}
+		}
+		options.destinationRetryPolicies[destination] = policy
+	}
+}
+
+// backoff returns how long to wait before the given retry, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		backoff -= time.Duration(float64(backoff) * jitter * rand.Float64())
+	}
+	return backoff
+}
+
+type retryAllowedContextKey struct{}
+
+// ContextWithRetryAllowed returns a context which overrides whether requests
+// made with it may be retried by a Client's RetryPolicy. This allows retrying
+// requests which are safe to repeat despite not using an idempotent method,
+// e.g. POST /_matrix/key/v2/query, or prevents retrying ones which aren't.
+func ContextWithRetryAllowed(ctx context.Context, allowed bool) context.Context {
+	return context.WithValue(ctx, retryAllowedContextKey{}, allowed)
+}
+
+// A RequestAttempt describes a single attempt at sending a request.
+type RequestAttempt struct {
+	Destination ServerName
+	Method      string
+	Path        string
+	Start       time.Time
+	Duration    time.Duration
+	// The HTTP status code of the response, or 0 if there wasn't a response.
+	StatusCode int
+	// Why the attempt failed, or nil if it succeeded.
+	Error error
+	// How long was waited before the next attempt, or 0 if there wasn't one.
+	Backoff time.Duration
+}
+
+// A RequestAttemptHistory records the attempts that a Client made at sending
+// requests. It is safe for concurrent use.
+type RequestAttemptHistory struct {
+	mutex    sync.Mutex
+	attempts []RequestAttempt
+}
+
+type requestAttemptHistoryContextKey struct{}
+
+// ContextWithRequestAttemptHistory returns a context which records every
+// attempt that a Client makes at sending requests made with it into the
+// returned RequestAttemptHistory, including the attempts that were retried.
+func ContextWithRequestAttemptHistory(ctx context.Context) (context.Context, *RequestAttemptHistory) {
+	history := &RequestAttemptHistory{}
+	return context.WithValue(ctx, requestAttemptHistoryContextKey{}, history), history
+}
+
+// Attempts returns the attempts recorded so far, oldest first.
+func (h *RequestAttemptHistory) Attempts() []RequestAttempt {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]RequestAttempt(nil), h.attempts...)
+}
+
+func (h *RequestAttemptHistory) add(attempt RequestAttempt) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.attempts = append(h.attempts, attempt)
+}
+
+// retryPolicy returns the RetryPolicy to use for the request.
+func (fc *Client) retryPolicy(ctx context.Context, req *http.Request) RetryPolicy {
+	var policy RetryPolicy
+	if p, ok := fc.destinationRetryPolicies[ServerName(req.URL.Host)]; ok {
+		policy = p
+	} else if fc.defaultRetryPolicy != nil {
+		policy = *fc.defaultRetryPolicy
+	}
+	allowed := false
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		allowed = true
+	}
+	if a, ok := ctx.Value(retryAllowedContextKey{}).(bool); ok {
+		allowed = a
+	}
+	// We can't send the body again if we can't get another copy of it.
+	if !allowed || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		policy.MaxAttempts = 1
+	}
+	return policy
+}
+
+// doWithRetries calls send with the request, and then with copies of it for
+// as long as the RetryPolicy allows. send returns the HTTP status code of
+// the response, or 0 if there wasn't one.
+func (fc *Client) doWithRetries(
+	ctx context.Context, req *http.Request, send func(*http.Request) (int, error),
+) error {
+	policy := fc.retryPolicy(ctx, req)
+	history, _ := ctx.Value(requestAttemptHistoryContextKey{}).(*RequestAttemptHistory)
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 {
+			attemptReq = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return err
+				}
+				attemptReq.Body = body
+			}
+		}
+
+		start := time.Now()
+		statusCode, err := send(attemptReq)
+		record := RequestAttempt{
+			Destination: ServerName(req.URL.Host),
+			Method:      req.Method,
+			Path:        req.URL.Path,
+			Start:       start,
+			Duration:    time.Since(start),
+			StatusCode:  statusCode,
+			Error:       err,
+		}
+
+		retry, retryAfter := isRetryableError(err)
+		if !retry || attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			history.add(record)
+			return err
+		}
+		wait := policy.backoff(attempt)
+		if retryAfter > 0 {
+			if policy.MaxRetryAfter > 0 && retryAfter > policy.MaxRetryAfter {
+				history.add(record)
+				return err
+			}
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+		}
+		// Don't wait if the context would expire before we could try again.
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			history.add(record)
+			return err
+		}
+		record.Backoff = wait
+		history.add(record)
+
+		util.GetLogger(ctx).WithFields(logrus.Fields{
+			"out.req.method":  req.Method,
+			"out.req.uri":     req.URL,
+			"out.req.attempt": attempt,
+			"backoff_ms":      int(wait / time.Millisecond),
+		}).WithError(err).Warn("Retrying outgoing request")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// isRetryableError returns whether a request which failed with the error
+// might succeed if it was sent again, and how long the destination asked us
+// to wait before sending it again, if it did.
+func isRetryableError(err error) (bool, time.Duration) {
+	switch e := err.(type) {
+	case nil:
+		return false, 0
+	case *url.Error:
+		// The request couldn't be sent or the response couldn't be read.
+		return isNetworkError(e.Err), 0
+	case gomatrix.HTTPError:
+		if respErr, ok := e.WrappedError.(gomatrix.RespError); ok && respErr.ErrCode == "M_LIMIT_EXCEEDED" {
+			var limit struct {
+				RetryAfterMS int64 `json:"retry_after_ms"`
+			}
+			_ = json.Unmarshal(e.Contents, &limit)
+			return true, time.Duration(limit.RetryAfterMS) * time.Millisecond
+		}
+		switch e.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, 0
+		}
+	}
+	return false, 0
+}
+
+// isNetworkError returns whether the error means that the destination
+// couldn't be reached or dropped the connection, rather than that the
+// request was invalid, the destination's certificate was rejected or the
+// context was cancelled.
+func isNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	// context.DeadlineExceeded is itself a net.Error that has timed out, so
+	// make sure that the timeout came from somewhere else. Client.Timeout
+	// errors wrap it but are reported as timeouts by net/http.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr != context.DeadlineExceeded && netErr.Timeout() {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
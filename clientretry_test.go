@@ -0,0 +1,250 @@
+package gomatrixserverlib_test
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var testRetryPolicy = gomatrixserverlib.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     10 * time.Millisecond,
+}
+
+var errConnectionRefused = &net.OpError{
+	Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+}
+
+func jsonResponse(code int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// retryTestClient returns a client whose requests are answered by responses
+// in order, and a pointer to the bodies of the requests that it received.
+func retryTestClient(
+	responses []*http.Response, options ...gomatrixserverlib.ClientOption,
+) (*gomatrixserverlib.Client, *[]string) {
+	var bodies []string
+	options = append(options, gomatrixserverlib.WithTransport(&roundTripper{
+		fn: func(req *http.Request) (*http.Response, error) {
+			body := ""
+			if req.Body != nil {
+				b, _ := ioutil.ReadAll(req.Body)
+				body = string(b)
+			}
+			bodies = append(bodies, body)
+			if len(bodies) > len(responses) {
+				return nil, fmt.Errorf("unexpected request %d", len(bodies))
+			}
+			if responses[len(bodies)-1] == nil {
+				return nil, errConnectionRefused
+			}
+			return responses[len(bodies)-1], nil
+		},
+	}))
+	return gomatrixserverlib.NewClient(options...), &bodies
+}
+
+func TestRetryPolicyRetriesIdempotentRequests(t *testing.T) {
+	client, bodies := retryTestClient([]*http.Response{
+		nil,
+		jsonResponse(503, `{"errcode":"M_UNKNOWN","error":"overloaded"}`),
+		jsonResponse(200, `{"server":{"name":"test","version":"1"}}`),
+	}, gomatrixserverlib.WithRetryPolicy(testRetryPolicy))
+
+	ctx, history := gomatrixserverlib.ContextWithRequestAttemptHistory(context.Background())
+	version, err := client.GetVersion(ctx, "remote")
+	if err != nil {
+		t.Fatalf("GetVersion failed: %v", err)
+	}
+	if version.Server.Name != "test" {
+		t.Errorf("wrong version returned: %+v", version)
+	}
+	if len(*bodies) != 3 {
+		t.Errorf("want 3 requests, got %d", len(*bodies))
+	}
+
+	attempts := history.Attempts()
+	if len(attempts) != 3 {
+		t.Fatalf("want 3 attempts recorded, got %+v", attempts)
+	}
+	wantCodes := []int{0, 503, 200}
+	for i, attempt := range attempts {
+		if attempt.StatusCode != wantCodes[i] {
+			t.Errorf("attempt %d: want status %d, got %d", i, wantCodes[i], attempt.StatusCode)
+		}
+		if attempt.Destination != "remote" || attempt.Method != "GET" || attempt.Path != "/_matrix/federation/v1/version" {
+			t.Errorf("attempt %d: wrong request recorded: %+v", i, attempt)
+		}
+		if (attempt.Error == nil) != (i == 2) {
+			t.Errorf("attempt %d: unexpected error %v", i, attempt.Error)
+		}
+		if (attempt.Backoff == 0) != (i == 2) {
+			t.Errorf("attempt %d: unexpected backoff %v", i, attempt.Backoff)
+		}
+	}
+}
+
+func TestRetryPolicyGivesUpAfterMaxAttempts(t *testing.T) {
+	client, bodies := retryTestClient([]*http.Response{
+		jsonResponse(502, "bad gateway"),
+		jsonResponse(502, "bad gateway"),
+		jsonResponse(502, "bad gateway"),
+	}, gomatrixserverlib.WithRetryPolicy(testRetryPolicy))
+
+	_, err := client.GetVersion(context.Background(), "remote")
+	httpErr, ok := err.(gomatrix.HTTPError)
+	if !ok || httpErr.Code != 502 {
+		t.Fatalf("want a 502 HTTPError, got %v", err)
+	}
+	if len(*bodies) != 3 {
+		t.Errorf("want 3 requests, got %d", len(*bodies))
+	}
+}
+
+func TestRetryPolicyDoesNotRetryClientErrors(t *testing.T) {
+	client, bodies := retryTestClient([]*http.Response{
+		jsonResponse(404, `{"errcode":"M_NOT_FOUND","error":"not found"}`),
+	}, gomatrixserverlib.WithRetryPolicy(testRetryPolicy))
+
+	if _, err := client.GetVersion(context.Background(), "remote"); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("want 1 request, got %d", len(*bodies))
+	}
+}
+
+func TestRetryPolicyRespectsRetryAfter(t *testing.T) {
+	client, _ := retryTestClient([]*http.Response{
+		jsonResponse(429, `{"errcode":"M_LIMIT_EXCEEDED","error":"slow down","retry_after_ms":50}`),
+		jsonResponse(200, `{"server":{"name":"test","version":"1"}}`),
+	}, gomatrixserverlib.WithRetryPolicy(testRetryPolicy))
+
+	ctx, history := gomatrixserverlib.ContextWithRequestAttemptHistory(context.Background())
+	start := time.Now()
+	if _, err := client.GetVersion(ctx, "remote"); err != nil {
+		t.Fatalf("GetVersion failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("retried after %v, wanted at least 50ms", elapsed)
+	}
+	if attempts := history.Attempts(); len(attempts) != 2 || attempts[0].Backoff != 50*time.Millisecond {
+		t.Errorf("want a 50ms backoff recorded, got %+v", attempts)
+	}
+
+	// A retry_after_ms longer than MaxRetryAfter is returned instead.
+	policy := testRetryPolicy
+	policy.MaxRetryAfter = 10 * time.Millisecond
+	client, bodies := retryTestClient([]*http.Response{
+		jsonResponse(429, `{"errcode":"M_LIMIT_EXCEEDED","error":"slow down","retry_after_ms":60000}`),
+	}, gomatrixserverlib.WithRetryPolicy(policy))
+	if _, err := client.GetVersion(context.Background(), "remote"); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("want 1 request, got %d", len(*bodies))
+	}
+}
+
+func TestRetryPolicyOnlyRetriesNonIdempotentRequestsWhenAllowed(t *testing.T) {
+	responses := func() []*http.Response {
+		return []*http.Response{
+			jsonResponse(500, "oops"),
+			jsonResponse(200, `{"server_keys":[]}`),
+		}
+	}
+	requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+		{ServerName: "target", KeyID: "ed25519:1"}: 1234,
+	}
+
+	client, bodies := retryTestClient(responses(), gomatrixserverlib.WithRetryPolicy(testRetryPolicy))
+	if _, err := client.LookupServerKeys(context.Background(), "notary", requests); err == nil {
+		t.Fatalf("expected the POST not to be retried")
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("want 1 request, got %d", len(*bodies))
+	}
+
+	client, bodies = retryTestClient(responses(), gomatrixserverlib.WithRetryPolicy(testRetryPolicy))
+	ctx := gomatrixserverlib.ContextWithRetryAllowed(context.Background(), true)
+	if _, err := client.LookupServerKeys(ctx, "notary", requests); err != nil {
+		t.Fatalf("LookupServerKeys failed: %v", err)
+	}
+	if len(*bodies) != 2 {
+		t.Fatalf("want 2 requests, got %d", len(*bodies))
+	}
+	if (*bodies)[0] == "" || (*bodies)[0] != (*bodies)[1] {
+		t.Errorf("retried request had a different body: %q != %q", (*bodies)[0], (*bodies)[1])
+	}
+}
+
+func TestDestinationRetryPolicy(t *testing.T) {
+	client, bodies := retryTestClient([]*http.Response{
+		jsonResponse(503, "unavailable"),
+	},
+		gomatrixserverlib.WithRetryPolicy(testRetryPolicy),
+		gomatrixserverlib.WithDestinationRetryPolicy("fragile", gomatrixserverlib.RetryPolicy{}),
+	)
+	if _, err := client.GetVersion(context.Background(), "fragile"); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if len(*bodies) != 1 {
+		t.Errorf("want 1 request, got %d", len(*bodies))
+	}
+}
+
+func TestRetryPolicyOnlyRetriesNetworkErrors(t *testing.T) {
+	testCases := []struct {
+		err   error
+		retry bool
+	}{
+		{errConnectionRefused, true},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{io.EOF, true},
+		{&net.DNSError{Err: "i/o timeout", Name: "remote", IsTimeout: true}, true},
+		{x509.UnknownAuthorityError{}, false},
+		{errors.New("unsupported protocol scheme"), false},
+		{fmt.Errorf("dialing: %w", context.Canceled), false},
+		{fmt.Errorf("dialing: %w", context.DeadlineExceeded), false},
+	}
+	for _, tc := range testCases {
+		attempts := 0
+		client := gomatrixserverlib.NewClient(
+			gomatrixserverlib.WithRetryPolicy(testRetryPolicy),
+			gomatrixserverlib.WithTransport(&roundTripper{
+				fn: func(req *http.Request) (*http.Response, error) {
+					attempts++
+					return nil, tc.err
+				},
+			}),
+		)
+		if _, err := client.GetVersion(context.Background(), "remote"); err == nil {
+			t.Fatalf("%v: expected an error", tc.err)
+		}
+		wantAttempts := 1
+		if tc.retry {
+			wantAttempts = testRetryPolicy.MaxAttempts
+		}
+		if attempts != wantAttempts {
+			t.Errorf("%v: want %d attempts, got %d", tc.err, wantAttempts, attempts)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// DestinationHealth is what a DestinationHealthTracker knows about whether a
+// destination is reachable.
+type DestinationHealth struct {
+	ServerName ServerName
+	// The number of requests in a row that failed to reach the destination.
+	ConsecutiveFailures int
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	// Requests to the destination fail fast until this time.
+	RetryAfter time.Time
+	// Whether the destination failed so many times in a row that requests to
+	// it fail fast until it is seen to be alive again.
+	Blacklisted bool
+}
+
+// DestinationUnavailableError is returned instead of sending a request to a
+// destination that a DestinationHealthTracker says is down.
+type DestinationUnavailableError struct {
+	ServerName  ServerName
+	Blacklisted bool
+	RetryAfter  time.Time
+}
+
+func (e DestinationUnavailableError) Error() string {
+	if e.Blacklisted {
+		return fmt.Sprintf("gomatrixserverlib: destination %s is blacklisted", e.ServerName)
+	}
+	return fmt.Sprintf(
+		"gomatrixserverlib: destination %s is backing off until %s",
+		e.ServerName, e.RetryAfter.Format(time.RFC3339),
+	)
+}
+
+// A DestinationHealthStore persists the health of destinations so that it
+// survives restarts.
+type DestinationHealthStore interface {
+	// LoadDestinationHealth returns the health of every destination stored.
+	LoadDestinationHealth(ctx context.Context) ([]DestinationHealth, error)
+	// StoreDestinationHealth stores the health of the destination, replacing
+	// any that was previously stored for it.
+	StoreDestinationHealth(ctx context.Context, health DestinationHealth) error
+}
+
+// A DestinationHealthTracker tracks whether destinations are reachable, so
+// that requests to destinations which are down fail fast. It can be shared by
+// several Clients, e.g. the federation sender's and the key fetchers', so that
+// they agree on which destinations are down. It is safe for concurrent use.
+//
+// Each failure to reach a destination backs it off for twice as long as the
+// previous one, and once it has failed BlacklistThreshold times in a row it is
+// blacklisted. A success resets both. Since requests to a blacklisted
+// destination aren't sent, the application should call RecordSuccess when it
+// receives a request from the destination.
+type DestinationHealthTracker struct {
+	// How long the first failure backs off a destination for.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// The number of failures in a row after which a destination is
+	// blacklisted. Zero means never.
+	BlacklistThreshold int
+	store              DestinationHealthStore
+	now                func() time.Time
+	mutex              sync.Mutex
+	destinations       map[ServerName]*DestinationHealth
+}
+
+// NewDestinationHealthTracker makes a DestinationHealthTracker which backs off
+// destinations for 2 seconds, doubling up to an hour, and blacklists them after
+// 16 failures in a row. If store isn't nil then the previously stored health of
+// destinations is loaded from it, and changes are stored to it.
+func NewDestinationHealthTracker(
+	ctx context.Context, store DestinationHealthStore,
+) (*DestinationHealthTracker, error) {
+	t := &DestinationHealthTracker{
+		InitialBackoff:     2 * time.Second,
+		MaxBackoff:         time.Hour,
+		BlacklistThreshold: 16,
+		store:              store,
+		now:                time.Now,
+		destinations:       map[ServerName]*DestinationHealth{},
+	}
+	if store == nil {
+		return t, nil
+	}
+	stored, err := store.LoadDestinationHealth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: failed to load destination health: %w", err)
+	}
+	for i := range stored {
+		health := stored[i]
+		t.destinations[health.ServerName] = &health
+	}
+	return t, nil
+}
+
+// WithDestinationHealth is an option that can be supplied to either NewClient
+// or NewFederationClient to track the health of destinations with the given
+// DestinationHealthTracker. Requests to destinations that it says are down
+// fail with a DestinationUnavailableError without being sent.
+func WithDestinationHealth(tracker *DestinationHealthTracker) ClientOption {
+	return func(options *clientOptions) {
+		options.health = tracker
+	}
+}
+
+// Health returns what is known about the destination. A destination that
+// nothing is known about is assumed to be healthy.
+func (t *DestinationHealthTracker) Health(serverName ServerName) DestinationHealth {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if health, ok := t.destinations[serverName]; ok {
+		return *health
+	}
+	return DestinationHealth{ServerName: serverName}
+}
+
+// Destinations returns what is known about every destination that requests
+// have been sent to, sorted by server name.
+func (t *DestinationHealthTracker) Destinations() []DestinationHealth {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	destinations := make([]DestinationHealth, 0, len(t.destinations))
+	for _, health := range t.destinations {
+		destinations = append(destinations, *health)
+	}
+	sort.Slice(destinations, func(i, j int) bool {
+		return destinations[i].ServerName < destinations[j].ServerName
+	})
+	return destinations
+}
+
+// Check returns a DestinationUnavailableError if requests to the destination
+// should fail fast, or nil if they should be sent.
+func (t *DestinationHealthTracker) Check(serverName ServerName) error {
+	now := t.now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	health, ok := t.destinations[serverName]
+	if !ok || (!health.Blacklisted && !now.Before(health.RetryAfter)) {
+		return nil
+	}
+	return DestinationUnavailableError{
+		ServerName:  serverName,
+		Blacklisted: health.Blacklisted,
+		RetryAfter:  health.RetryAfter,
+	}
+}
+
+// RecordSuccess records that the destination is alive, either because a
+// request to it succeeded or because we received a request from it. This
+// resets its backoff and takes it off the blacklist.
+func (t *DestinationHealthTracker) RecordSuccess(ctx context.Context, serverName ServerName) {
+	now := t.now()
+	t.mutex.Lock()
+	health, ok := t.destinations[serverName]
+	if !ok {
+		health = &DestinationHealth{ServerName: serverName}
+		t.destinations[serverName] = health
+	}
+	// Only store the change if the destination was down, otherwise we would
+	// write to the store for every request.
+	changed := !ok || health.ConsecutiveFailures > 0 || health.Blacklisted
+	health.ConsecutiveFailures = 0
+	health.LastSuccess = now
+	health.RetryAfter = time.Time{}
+	health.Blacklisted = false
+	stored := *health
+	t.mutex.Unlock()
+	if changed {
+		t.storeHealth(ctx, stored)
+	}
+}
+
+// RecordFailure records that a request to the destination failed to reach it,
+// which backs it off and may blacklist it.
+func (t *DestinationHealthTracker) RecordFailure(ctx context.Context, serverName ServerName) {
+	now := t.now()
+	t.mutex.Lock()
+	health, ok := t.destinations[serverName]
+	if !ok {
+		health = &DestinationHealth{ServerName: serverName}
+		t.destinations[serverName] = health
+	}
+	health.ConsecutiveFailures++
+	health.LastFailure = now
+	health.RetryAfter = now.Add(t.backoff(health.ConsecutiveFailures))
+	if t.BlacklistThreshold > 0 && health.ConsecutiveFailures >= t.BlacklistThreshold {
+		health.Blacklisted = true
+	}
+	stored := *health
+	t.mutex.Unlock()
+	t.storeHealth(ctx, stored)
+}
+
+// backoff returns how long to back off for after the given number of
+// consecutive failures.
+func (t *DestinationHealthTracker) backoff(failures int) time.Duration {
+	backoff := t.InitialBackoff
+	for i := 1; i < failures && backoff < t.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > t.MaxBackoff {
+		backoff = t.MaxBackoff
+	}
+	return backoff
+}
+
+func (t *DestinationHealthTracker) storeHealth(ctx context.Context, health DestinationHealth) {
+	if t.store == nil {
+		return
+	}
+	if err := t.store.StoreDestinationHealth(ctx, health); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("server_name", health.ServerName).
+			Warn("Failed to store destination health")
+	}
+}
+
+// record records the outcome of a request to the destination. Responses with
+// a 5xx status code, and requests which couldn't reach the destination or
+// whose connection was dropped, count as failures. Requests which the caller
+// cancelled or which timed out because of the caller's context don't count.
+func (t *DestinationHealthTracker) record(
+	ctx context.Context, serverName ServerName, statusCode int, err error,
+) {
+	if t == nil || ctx.Err() != nil {
+		return
+	}
+	if urlErr, ok := err.(*url.Error); (ok && isNetworkError(urlErr.Err)) || statusCode >= 500 {
+		t.RecordFailure(ctx, serverName)
+		return
+	}
+	if statusCode != 0 {
+		t.RecordSuccess(ctx, serverName)
+	}
+}
+
+// check is Check for a tracker that may be nil.
+func (t *DestinationHealthTracker) check(serverName ServerName) error {
+	if t == nil {
+		return nil
+	}
+	return t.Check(serverName)
+}
+
+// MemoryDestinationHealthStore is an in-memory implementation of
+// DestinationHealthStore, mostly useful for tests. The zero value is ready to
+// use.
+type MemoryDestinationHealthStore struct {
+	mutex        sync.Mutex
+	destinations map[ServerName]DestinationHealth
+}
+
+// LoadDestinationHealth implements DestinationHealthStore
+func (s *MemoryDestinationHealthStore) LoadDestinationHealth(ctx context.Context) ([]DestinationHealth, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	destinations := make([]DestinationHealth, 0, len(s.destinations))
+	for _, health := range s.destinations {
+		destinations = append(destinations, health)
+	}
+	return destinations, nil
+}
+
+// StoreDestinationHealth implements DestinationHealthStore
+func (s *MemoryDestinationHealthStore) StoreDestinationHealth(ctx context.Context, health DestinationHealth) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.destinations == nil {
+		s.destinations = map[ServerName]DestinationHealth{}
+	}
+	s.destinations[health.ServerName] = health
+	return nil
+}
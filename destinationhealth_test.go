@@ -0,0 +1,144 @@
+package gomatrixserverlib_test
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestDestinationHealthTrackerBlacklists(t *testing.T) {
+	ctx := context.Background()
+	store := &gomatrixserverlib.MemoryDestinationHealthStore{}
+	tracker, err := gomatrixserverlib.NewDestinationHealthTracker(ctx, store)
+	if err != nil {
+		t.Fatalf("NewDestinationHealthTracker failed: %v", err)
+	}
+	tracker.InitialBackoff = time.Minute
+	tracker.MaxBackoff = 3 * time.Minute
+	tracker.BlacklistThreshold = 3
+
+	if err = tracker.Check("remote"); err != nil {
+		t.Fatalf("unknown destination should be healthy, got %v", err)
+	}
+
+	wantBackoffs := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute}
+	for i, want := range wantBackoffs {
+		tracker.RecordFailure(ctx, "remote")
+		health := tracker.Health("remote")
+		if health.ConsecutiveFailures != i+1 {
+			t.Errorf("want %d failures, got %d", i+1, health.ConsecutiveFailures)
+		}
+		if got := health.RetryAfter.Sub(health.LastFailure); got != want {
+			t.Errorf("failure %d: want backoff %v, got %v", i+1, want, got)
+		}
+		if health.Blacklisted != (i == 2) {
+			t.Errorf("failure %d: unexpected blacklisted %v", i+1, health.Blacklisted)
+		}
+	}
+
+	err = tracker.Check("remote")
+	unavailable, ok := err.(gomatrixserverlib.DestinationUnavailableError)
+	if !ok || !unavailable.Blacklisted || unavailable.ServerName != "remote" {
+		t.Fatalf("want a blacklisted DestinationUnavailableError, got %v", err)
+	}
+
+	// The state is persisted, so a new tracker agrees that it is blacklisted.
+	reloaded, err := gomatrixserverlib.NewDestinationHealthTracker(ctx, store)
+	if err != nil {
+		t.Fatalf("NewDestinationHealthTracker failed: %v", err)
+	}
+	if health := reloaded.Health("remote"); !health.Blacklisted || health.ConsecutiveFailures != 3 {
+		t.Errorf("stored health wasn't loaded: %+v", health)
+	}
+
+	// An inbound request from the destination takes it off the blacklist.
+	reloaded.RecordSuccess(ctx, "remote")
+	if err = reloaded.Check("remote"); err != nil {
+		t.Errorf("want destination to be healthy, got %v", err)
+	}
+	destinations := reloaded.Destinations()
+	if len(destinations) != 1 || destinations[0].ConsecutiveFailures != 0 || destinations[0].LastSuccess.IsZero() {
+		t.Errorf("unexpected destinations: %+v", destinations)
+	}
+	stored, _ := store.LoadDestinationHealth(ctx)
+	if len(stored) != 1 || stored[0].Blacklisted {
+		t.Errorf("reset wasn't stored: %+v", stored)
+	}
+}
+
+func TestClientFailsFastForUnhealthyDestinations(t *testing.T) {
+	tracker, err := gomatrixserverlib.NewDestinationHealthTracker(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("NewDestinationHealthTracker failed: %v", err)
+	}
+	client, bodies := retryTestClient([]*http.Response{
+		jsonResponse(404, `{"errcode":"M_NOT_FOUND","error":"not found"}`),
+		jsonResponse(503, `{"errcode":"M_UNKNOWN","error":"overloaded"}`),
+	}, gomatrixserverlib.WithDestinationHealth(tracker))
+
+	// A 404 means that the destination is alive.
+	if _, err = client.GetVersion(context.Background(), "remote"); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if health := tracker.Health("remote"); health.ConsecutiveFailures != 0 || health.LastSuccess.IsZero() {
+		t.Errorf("want a success recorded, got %+v", health)
+	}
+
+	// A 503 means that it isn't.
+	if _, err = client.GetVersion(context.Background(), "remote"); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if health := tracker.Health("remote"); health.ConsecutiveFailures != 1 {
+		t.Errorf("want a failure recorded, got %+v", health)
+	}
+
+	// So the next request isn't sent.
+	_, err = client.GetVersion(context.Background(), "remote")
+	if _, ok := err.(gomatrixserverlib.DestinationUnavailableError); !ok {
+		t.Fatalf("want a DestinationUnavailableError, got %v", err)
+	}
+	if len(*bodies) != 2 {
+		t.Errorf("want 2 requests sent, got %d", len(*bodies))
+	}
+}
+
+func TestDestinationHealthOnlyCountsNetworkErrors(t *testing.T) {
+	testCases := []struct {
+		err     error
+		failure bool
+	}{
+		{errConnectionRefused, true},
+		{x509.UnknownAuthorityError{}, false},
+		{fmt.Errorf("dialing: %w", context.Canceled), false},
+		{fmt.Errorf("dialing: %w", context.DeadlineExceeded), false},
+	}
+	for _, tc := range testCases {
+		tracker, err := gomatrixserverlib.NewDestinationHealthTracker(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("NewDestinationHealthTracker failed: %v", err)
+		}
+		client := gomatrixserverlib.NewClient(
+			gomatrixserverlib.WithDestinationHealth(tracker),
+			gomatrixserverlib.WithTransport(&roundTripper{
+				fn: func(req *http.Request) (*http.Response, error) {
+					return nil, tc.err
+				},
+			}),
+		)
+		if _, err = client.GetVersion(context.Background(), "remote"); err == nil {
+			t.Fatalf("%v: expected an error", tc.err)
+		}
+		wantFailures := 0
+		if tc.failure {
+			wantFailures = 1
+		}
+		if health := tracker.Health("remote"); health.ConsecutiveFailures != wantFailures {
+			t.Errorf("%v: want %d failures recorded, got %+v", tc.err, wantFailures, health)
+		}
+	}
+}
@@ -12,3 +12,8 @@ type DeviceListUpdateEvent struct {
 	Deleted           bool            `json:"deleted"`
 	Keys              json.RawMessage `json:"keys"`
 }
+
+// CheckOrigin implements EDUContent
+func (e *DeviceListUpdateEvent) CheckOrigin(origin ServerName) error {
+	return checkUserOrigin(e.UserID, origin)
+}
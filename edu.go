@@ -13,6 +13,12 @@
 
 package gomatrixserverlib
 
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
 // EDU represents a EDU received via federation
 // https://matrix.org/docs/spec/server_server/unstable.html#edus
 type EDU struct {
@@ -21,3 +27,161 @@ type EDU struct {
 	Destination string  `json:"destination,omitempty"`
 	Content     RawJSON `json:"content,omitempty"`
 }
+
+// EDUContent is the decoded content of an EDU.
+type EDUContent interface {
+	// CheckOrigin returns an error if the content couldn't have been sent by
+	// the origin server, e.g. because it is about a user on another server.
+	CheckOrigin(origin ServerName) error
+}
+
+// UnknownEDUTypeError is returned when parsing the content of an EDU whose
+// type doesn't have a content type registered.
+type UnknownEDUTypeError struct {
+	Type string
+}
+
+func (e UnknownEDUTypeError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: unknown EDU type %q", e.Type)
+}
+
+var eduContentTypesMutex sync.RWMutex
+var eduContentTypes = map[string]func() EDUContent{
+	MTyping:           func() EDUContent { return &TypingContent{} },
+	MReceipt:          func() EDUContent { return &ReceiptContent{} },
+	MPresence:         func() EDUContent { return &PresenceContent{} },
+	MDeviceListUpdate: func() EDUContent { return &DeviceListUpdateEvent{} },
+	MDirectToDevice:   func() EDUContent { return &ToDeviceMessage{} },
+	MSigningKeyUpdate: func() EDUContent { return &SigningKeyUpdate{} },
+}
+
+// RegisterEDUContentType registers the content type for EDUs of the given
+// type, replacing any previously registered. newContent must return a pointer
+// that the content can be decoded into.
+func RegisterEDUContentType(eduType string, newContent func() EDUContent) {
+	eduContentTypesMutex.Lock()
+	defer eduContentTypesMutex.Unlock()
+	eduContentTypes[eduType] = newContent
+}
+
+// ParseContent decodes the content of the EDU into the content type
+// registered for its type, and checks that it could have been sent by the
+// origin server, which should be the authenticated origin of the transaction
+// that the EDU was received in. Returns an UnknownEDUTypeError if the type
+// doesn't have a content type registered.
+func (e EDU) ParseContent(origin ServerName) (EDUContent, error) {
+	eduContentTypesMutex.RLock()
+	newContent, ok := eduContentTypes[e.Type]
+	eduContentTypesMutex.RUnlock()
+	if !ok {
+		return nil, UnknownEDUTypeError{e.Type}
+	}
+	if e.Origin != "" && ServerName(e.Origin) != origin {
+		return nil, fmt.Errorf("gomatrixserverlib: %s EDU has origin %q but was sent by %q", e.Type, e.Origin, origin)
+	}
+	content := newContent()
+	if err := json.Unmarshal(e.Content, content); err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: failed to parse %s EDU content: %w", e.Type, err)
+	}
+	if err := content.CheckOrigin(origin); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// checkUserOrigin returns an error unless the user ID belongs to the origin
+// server.
+func checkUserOrigin(userID string, origin ServerName) error {
+	_, domain, err := SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	if domain != origin {
+		return fmt.Errorf("gomatrixserverlib: user %q doesn't belong to origin %q", userID, origin)
+	}
+	return nil
+}
+
+// TypingContent is the content of an m.typing EDU.
+// https://matrix.org/docs/spec/server_server/r0.1.4#typing-notifications
+type TypingContent struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	Typing bool   `json:"typing"`
+}
+
+// CheckOrigin implements EDUContent
+func (c *TypingContent) CheckOrigin(origin ServerName) error {
+	return checkUserOrigin(c.UserID, origin)
+}
+
+// ReceiptContent is the content of an m.receipt EDU, from room ID to the
+// receipts in that room.
+// https://matrix.org/docs/spec/server_server/r0.1.4#receipts
+type ReceiptContent map[string]RoomReceipts
+
+// RoomReceipts are the receipts for a room, from user ID to the user's read
+// receipt.
+type RoomReceipts struct {
+	Read map[string]ReadReceipt `json:"m.read"`
+}
+
+// ReadReceipt is a user's read receipt for a room.
+type ReadReceipt struct {
+	// The most recent event that the user has read, as a list with a single
+	// entry.
+	EventIDs []string `json:"event_ids"`
+	Data     struct {
+		TS Timestamp `json:"ts"`
+	} `json:"data"`
+}
+
+// CheckOrigin implements EDUContent
+func (c *ReceiptContent) CheckOrigin(origin ServerName) error {
+	for _, receipts := range *c {
+		for userID := range receipts.Read {
+			if err := checkUserOrigin(userID, origin); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PresenceContent is the content of an m.presence EDU.
+// https://matrix.org/docs/spec/server_server/r0.1.4#presence
+type PresenceContent struct {
+	Push []PresenceUpdate `json:"push"`
+}
+
+// PresenceUpdate is the presence of a single user.
+type PresenceUpdate struct {
+	UserID          string  `json:"user_id"`
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago"`
+	CurrentlyActive bool    `json:"currently_active,omitempty"`
+}
+
+// CheckOrigin implements EDUContent
+func (c *PresenceContent) CheckOrigin(origin ServerName) error {
+	for _, update := range c.Push {
+		if err := checkUserOrigin(update.UserID, origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SigningKeyUpdate is the content of an m.signing_key_update EDU.
+// https://matrix.org/docs/spec/server_server/r0.1.4#m-signing-key-update-schema
+type SigningKeyUpdate struct {
+	UserID         string          `json:"user_id"`
+	MasterKey      json.RawMessage `json:"master_key,omitempty"`
+	SelfSigningKey json.RawMessage `json:"self_signing_key,omitempty"`
+}
+
+// CheckOrigin implements EDUContent
+func (c *SigningKeyUpdate) CheckOrigin(origin ServerName) error {
+	return checkUserOrigin(c.UserID, origin)
+}
@@ -0,0 +1,47 @@
+package gomatrixserverlib
+
+import (
+	"testing"
+)
+
+func TestEDUParseContent(t *testing.T) {
+	tests := []struct {
+		edu     EDU
+		wantErr bool
+	}{
+		{EDU{Type: MTyping, Content: RawJSON(`{"room_id":"!room:a","user_id":"@alice:a","typing":true}`)}, false},
+		{EDU{Type: MTyping, Content: RawJSON(`{"room_id":"!room:a","user_id":"@bob:b","typing":true}`)}, true},
+		{EDU{Type: MTyping, Origin: "b", Content: RawJSON(`{"room_id":"!room:a","user_id":"@alice:a","typing":true}`)}, true},
+		{EDU{Type: MReceipt, Content: RawJSON(`{"!room:a":{"m.read":{"@alice:a":{"event_ids":["$ev"],"data":{"ts":1}}}}}`)}, false},
+		{EDU{Type: MReceipt, Content: RawJSON(`{"!room:a":{"m.read":{"@alice:a":{"event_ids":["$ev"]},"@bob:b":{"event_ids":["$ev"]}}}}`)}, true},
+		{EDU{Type: MPresence, Content: RawJSON(`{"push":[{"user_id":"@alice:a","presence":"online","last_active_ago":5}]}`)}, false},
+		{EDU{Type: MPresence, Content: RawJSON(`{"push":[{"user_id":"@alice:a","presence":"online"},{"user_id":"@bob:b","presence":"online"}]}`)}, true},
+		{EDU{Type: MDeviceListUpdate, Content: RawJSON(`{"user_id":"@alice:a","device_id":"DEV","stream_id":1}`)}, false},
+		{EDU{Type: MDeviceListUpdate, Content: RawJSON(`{"user_id":"@bob:b","device_id":"DEV","stream_id":1}`)}, true},
+		{EDU{Type: MDirectToDevice, Content: RawJSON(`{"sender":"@alice:a","type":"m.room_key","message_id":"1","messages":{}}`)}, false},
+		{EDU{Type: MDirectToDevice, Content: RawJSON(`{"sender":"@bob:b","type":"m.room_key","message_id":"1","messages":{}}`)}, true},
+		{EDU{Type: MSigningKeyUpdate, Content: RawJSON(`{"user_id":"@alice:a","master_key":{}}`)}, false},
+		{EDU{Type: MSigningKeyUpdate, Content: RawJSON(`{"user_id":"not a user ID"}`)}, true},
+		{EDU{Type: MTyping, Content: RawJSON(`[]`)}, true},
+	}
+	for i, test := range tests {
+		content, err := test.edu.ParseContent("a")
+		if (err != nil) != test.wantErr {
+			t.Errorf("test %d: %s: want error %v, got %v", i, test.edu.Type, test.wantErr, err)
+		}
+		if err == nil && content == nil {
+			t.Errorf("test %d: %s: no content returned", i, test.edu.Type)
+		}
+	}
+
+	content, err := EDU{Type: MTyping, Content: RawJSON(`{"room_id":"!room:a","user_id":"@alice:a","typing":true}`)}.ParseContent("a")
+	if typing, ok := content.(*TypingContent); err != nil || !ok || !typing.Typing || typing.RoomID != "!room:a" {
+		t.Errorf("unexpected typing content %#v, error %v", content, err)
+	}
+
+	if _, err = (EDU{Type: "org.example.custom"}).ParseContent("a"); err == nil {
+		t.Errorf("expected an error for an unknown EDU type")
+	} else if _, ok := err.(UnknownEDUTypeError); !ok {
+		t.Errorf("want an UnknownEDUTypeError, got %v", err)
+	}
+}
@@ -52,19 +52,45 @@ type EventReference struct {
 
 // Event validation errors
 const (
-	EventValidationTooLarge int = 1
+	EventValidationTooLarge      int = 1
+	EventValidationCanonicalJSON int = 2
 )
 
 // EventValidationError is returned if there is a problem validating an event
 type EventValidationError struct {
 	Message string
 	Code    int
+	// The values that failed enforced canonical JSON checks, if Code is
+	// EventValidationCanonicalJSON.
+	CanonicalJSONViolations []CanonicalJSONViolation
+	// The underlying error, if any.
+	Err error
 }
 
 func (e EventValidationError) Error() string {
 	return e.Message
 }
 
+func (e EventValidationError) Unwrap() error {
+	return e.Err
+}
+
+// eventCanonicalJSONError converts an error wrapping a CanonicalJSONError
+// into an EventValidationError so that callers can see which values were
+// at fault. Other errors are returned unchanged.
+func eventCanonicalJSONError(err error) error {
+	var canonicalErr CanonicalJSONError
+	if !errors.As(err, &canonicalErr) {
+		return err
+	}
+	return EventValidationError{
+		Code:                    EventValidationCanonicalJSON,
+		Message:                 canonicalErr.Error(),
+		CanonicalJSONViolations: canonicalErr.Violations,
+		Err:                     err,
+	}
+}
+
 // An EventBuilder is used to build a new event.
 // These can be exchanged between matrix servers in the federation APIs when
 // joining or leaving a room.
@@ -157,6 +183,13 @@ var emptyEventReferenceList = []EventReference{}
 func (eb *EventBuilder) Build(
 	now time.Time, origin ServerName, keyID KeyID,
 	privateKey ed25519.PrivateKey, roomVersion RoomVersion,
+) (result *Event, err error) {
+	return eb.BuildWithSigner(now, origin, NewEd25519Signer(keyID, privateKey), roomVersion)
+}
+
+// BuildWithSigner is the same as Build but signs the event using the Signer.
+func (eb *EventBuilder) BuildWithSigner(
+	now time.Time, origin ServerName, signer Signer, roomVersion RoomVersion,
 ) (result *Event, err error) {
 	eventFormat, err := roomVersion.EventFormat()
 	if err != nil {
@@ -237,7 +270,7 @@ func (eb *EventBuilder) Build(
 	}
 
 	var eventJSON []byte
-	if eventJSON, err = json.Marshal(&event); err != nil {
+	if eventJSON, err = MarshalCanonicalJSON(&event); err != nil {
 		return
 	}
 
@@ -251,11 +284,12 @@ func (eb *EventBuilder) Build(
 		return
 	}
 
-	if eventJSON, err = signEvent(string(origin), keyID, privateKey, eventJSON, roomVersion); err != nil {
+	if eventJSON, err = signEvent(string(origin), signer, eventJSON, roomVersion); err != nil {
 		return
 	}
 
 	if eventJSON, err = EnforcedCanonicalJSON(eventJSON, roomVersion); err != nil {
+		err = eventCanonicalJSONError(err)
 		return
 	}
 
@@ -289,7 +323,7 @@ func NewEventFromUntrustedJSON(eventJSON []byte, roomVersion RoomVersion) (resul
 	}
 	if enforceCanonicalJSON {
 		if err = verifyEnforcedCanonicalJSON(eventJSON); err != nil {
-			err = BadJSONError{err}
+			err = eventCanonicalJSONError(BadJSONError{err})
 			return
 		}
 	}
@@ -486,7 +520,7 @@ func (e *Event) SetUnsigned(unsigned interface{}) (*Event, error) {
 		return nil, err
 	}
 	if eventJSON, err = EnforcedCanonicalJSON(eventJSON, e.roomVersion); err != nil {
-		return nil, err
+		return nil, eventCanonicalJSONError(err)
 	}
 	if err = e.updateUnsignedFields(unsignedJSON); err != nil {
 		return nil, err
@@ -557,20 +591,32 @@ func (e *Event) EventReference() EventReference {
 
 // Sign returns a copy of the event with an additional signature.
 func (e *Event) Sign(signingName string, keyID KeyID, privateKey ed25519.PrivateKey) Event {
-	eventJSON, err := signEvent(signingName, keyID, privateKey, e.eventJSON, e.roomVersion)
+	result, err := e.SignWithSigner(signingName, NewEd25519Signer(keyID, privateKey))
 	if err != nil {
 		// This is unreachable for events created with EventBuilder.Build or NewEventFromUntrustedJSON
-		panic(fmt.Errorf("gomatrixserverlib: invalid event %v (%q)", err, string(e.eventJSON)))
+		panic(err)
+	}
+	return result
+}
+
+// SignWithSigner returns a copy of the event with an additional signature
+// from the Signer. Unlike Sign, this returns an error rather than panicking
+// since a Signer can fail, e.g. if a remote signing process is unavailable.
+func (e *Event) SignWithSigner(signingName string, signer Signer) (Event, error) {
+	eventJSON, err := signEvent(signingName, signer, e.eventJSON, e.roomVersion)
+	if err != nil {
+		return Event{}, fmt.Errorf("gomatrixserverlib: failed to sign event %v (%q)", err, string(e.eventJSON))
 	}
 	if eventJSON, err = EnforcedCanonicalJSON(eventJSON, e.roomVersion); err != nil {
 		// This is unreachable for events created with EventBuilder.Build or NewEventFromUntrustedJSON
-		panic(fmt.Errorf("gomatrixserverlib: invalid event %v (%q)", err, string(e.eventJSON)))
+		return Event{}, fmt.Errorf("gomatrixserverlib: invalid event %v (%q)", err, string(e.eventJSON))
 	}
 	return Event{
-		redacted:  e.redacted,
-		eventJSON: eventJSON,
-		fields:    e.fields,
-	}
+		redacted:    e.redacted,
+		eventJSON:   eventJSON,
+		fields:      e.fields,
+		roomVersion: e.roomVersion,
+	}, nil
 }
 
 // KeyIDs returns a list of key IDs that the named entity has signed the event with.
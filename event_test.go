@@ -180,3 +180,23 @@ func TestHeaderedEventToNewEventFromUntrustedJSON(t *testing.T) {
 		t.Fatal("expected an UnexpectedHeaderedEvent error but got:", err)
 	}
 }
+
+func TestUntrustedEventCanonicalJSONError(t *testing.T) {
+	eventJSON := `{"auth_events":[],"content":{"creator":"@userid:baba.is.you","score":1.5},"depth":0,"hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{},"state_key":"","type":"m.room.create"}`
+	_, err := NewEventFromUntrustedJSON([]byte(eventJSON), RoomVersionV6)
+	var validationErr EventValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("want EventValidationError, got %v", err)
+	}
+	if validationErr.Code != EventValidationCanonicalJSON {
+		t.Errorf("want code %d, got %d", EventValidationCanonicalJSON, validationErr.Code)
+	}
+	want := []CanonicalJSONViolation{{"content.score", CanonicalJSONFloat}}
+	if !reflect.DeepEqual(validationErr.CanonicalJSONViolations, want) {
+		t.Errorf("want violations %v, got %v", want, validationErr.CanonicalJSONViolations)
+	}
+	var badJSON BadJSONError
+	if !errors.As(err, &badJSON) {
+		t.Errorf("want the error to wrap BadJSONError")
+	}
+}
@@ -66,6 +66,10 @@ const (
 	MDeviceListUpdate = "m.device_list_update"
 	// MReceipt https://matrix.org/docs/spec/server_server/r0.1.4#receipts
 	MReceipt = "m.receipt"
+	// MPresence https://matrix.org/docs/spec/server_server/r0.1.4#presence
+	MPresence = "m.presence"
+	// MSigningKeyUpdate https://matrix.org/docs/spec/server_server/r0.1.4#m-signing-key-update-schema
+	MSigningKeyUpdate = "m.signing_key_update"
 )
 
 // StateNeeded lists the event types and state_keys needed to authenticate an event.
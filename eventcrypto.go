@@ -44,12 +44,7 @@ func addContentHashesToEvent(eventJSON []byte) ([]byte, error) {
 	delete(event, "unsigned")
 	delete(event, "hashes")
 
-	hashableEventJSON, err := json.Marshal(event)
-	if err != nil {
-		return nil, err
-	}
-
-	hashableEventJSON, err = CanonicalJSON(hashableEventJSON)
+	hashableEventJSON, err := MarshalCanonicalJSON(event)
 	if err != nil {
 		return nil, err
 	}
@@ -115,12 +110,7 @@ func referenceOfEvent(eventJSON []byte, roomVersion RoomVersion) (EventReference
 	delete(event, "signatures")
 	delete(event, "unsigned")
 
-	hashableEventJSON, err := json.Marshal(event)
-	if err != nil {
-		return EventReference{}, err
-	}
-
-	hashableEventJSON, err = CanonicalJSON(hashableEventJSON)
+	hashableEventJSON, err := MarshalCanonicalJSON(event)
 	if err != nil {
 		return EventReference{}, err
 	}
@@ -163,7 +153,7 @@ func referenceOfEvent(eventJSON []byte, roomVersion RoomVersion) (EventReference
 }
 
 // SignEvent adds a ED25519 signature to the event for the given key.
-func signEvent(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, eventJSON []byte, roomVersion RoomVersion) ([]byte, error) {
+func signEvent(signingName string, signer Signer, eventJSON []byte, roomVersion RoomVersion) ([]byte, error) {
 
 	// Redact the event before signing so signature that will remain valid even if the event is redacted.
 	redactedJSON, err := redactEvent(eventJSON, roomVersion)
@@ -173,7 +163,7 @@ func signEvent(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, e
 
 	// Sign the JSON, this adds a "signatures" key to the redacted event.
 	// TODO: Make an internal version of SignJSON that returns just the signatures so that we don't have to parse it out of the JSON.
-	signedJSON, err := SignJSON(signingName, keyID, privateKey, redactedJSON)
+	signedJSON, err := SignJSONWithSigner(signingName, signer, redactedJSON)
 	if err != nil {
 		return nil, err
 	}
@@ -219,11 +209,18 @@ func VerifyEventSignatures(ctx context.Context, events []*Event, keyRing JSONVer
 	// for each entry in 'events', a list of corresponding indexes in toVerify
 	verificationMap := make([][]int, len(events))
 
+	// Redacting the events is expensive so spread it across the CPU cores.
+	redactedJSONs := make([][]byte, len(events))
+	redactErrs := make([]error, len(events))
+	parallelFor(len(events), func(evtIdx int) {
+		redactedJSONs[evtIdx], redactErrs[evtIdx] = redactEvent(events[evtIdx].eventJSON, events[evtIdx].roomVersion)
+	})
+
 	for evtIdx, event := range events {
-		redactedJSON, err := redactEvent(event.eventJSON, event.roomVersion)
-		if err != nil {
+		if err := redactErrs[evtIdx]; err != nil {
 			return nil, err
 		}
+		redactedJSON := redactedJSONs[evtIdx]
 
 		domains := make(map[ServerName]bool)
 		// in general, we expect the domain of the sender id to be the
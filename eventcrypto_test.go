@@ -188,7 +188,7 @@ func TestSignEventTestVectors(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		signed, err := signEvent(entityName, keyID, privateKey, hashed, RoomVersionV1)
+		signed, err := signEvent(entityName, NewEd25519Signer(keyID, privateKey), hashed, RoomVersionV1)
 		if err != nil {
 			t.Fatal(err)
 		}
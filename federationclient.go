@@ -14,11 +14,14 @@ import (
 
 // A FederationClient is a matrix federation client that adds
 // "Authorization: X-Matrix" headers to requests that need ed25519 signatures
+//
+// Requests are sent from the client's server name, unless the context was
+// made with ContextWithOrigin, in which case they are sent from and signed for
+// that server name instead.
 type FederationClient struct {
 	Client
-	serverName       ServerName
-	serverKeyID      KeyID
-	serverPrivateKey ed25519.PrivateKey
+	serverName ServerName
+	signers    SignerProvider
 }
 
 // NewFederationClient makes a new FederationClient. You can supply
@@ -28,17 +31,62 @@ type FederationClient struct {
 func NewFederationClient(
 	serverName ServerName, keyID KeyID, privateKey ed25519.PrivateKey,
 	options ...ClientOption,
+) *FederationClient {
+	return NewFederationClientWithSigner(
+		serverName, NewEd25519Signer(keyID, privateKey), options...,
+	)
+}
+
+// NewFederationClientWithSigner makes a new FederationClient which signs
+// requests using the Signer rather than a private key.
+func NewFederationClientWithSigner(
+	serverName ServerName, signer Signer, options ...ClientOption,
+) *FederationClient {
+	return NewFederationClientWithSignerProvider(
+		serverName, StaticSignerProvider{serverName: signer}, options...,
+	)
+}
+
+// NewFederationClientWithSignerProvider makes a new FederationClient for a
+// process hosting several server names. Requests are sent from serverName
+// unless the context says otherwise, see ContextWithOrigin, and are signed
+// with the Signer that the SignerProvider returns for the server name they
+// are sent from.
+func NewFederationClientWithSignerProvider(
+	serverName ServerName, signers SignerProvider, options ...ClientOption,
 ) *FederationClient {
 	return &FederationClient{
-		Client:           *NewClient(options...),
-		serverName:       serverName,
-		serverKeyID:      keyID,
-		serverPrivateKey: privateKey,
+		Client:     *NewClient(options...),
+		serverName: serverName,
+		signers:    signers,
+	}
+}
+
+type originContextKey struct{}
+
+// ContextWithOrigin returns a context which makes a FederationClient send
+// requests made with it from the given server name, rather than from the
+// client's own server name.
+func ContextWithOrigin(ctx context.Context, origin ServerName) context.Context {
+	return context.WithValue(ctx, originContextKey{}, origin)
+}
+
+// origin returns the server name that requests made with the context are
+// sent from.
+func (ac *FederationClient) origin(ctx context.Context) ServerName {
+	if origin, ok := ctx.Value(originContextKey{}).(ServerName); ok && origin != "" {
+		return origin
 	}
+	return ac.serverName
 }
 
 func (ac *FederationClient) doRequest(ctx context.Context, r FederationRequest, resBody interface{}) error {
-	if err := r.Sign(ac.serverName, ac.serverKeyID, ac.serverPrivateKey); err != nil {
+	origin := ac.origin(ctx)
+	signer, err := ac.signers.SignerForServerName(ctx, origin)
+	if err != nil {
+		return err
+	}
+	if err = r.SignWithSigner(origin, signer); err != nil {
 		return err
 	}
 
@@ -53,10 +101,14 @@ func (ac *FederationClient) doRequest(ctx context.Context, r FederationRequest,
 var federationPathPrefixV1 = "/_matrix/federation/v1"
 var federationPathPrefixV2 = "/_matrix/federation/v2"
 
-// SendTransaction sends a transaction
+// SendTransaction sends a transaction. If the transaction has an origin then
+// it is sent from that server name.
 func (ac *FederationClient) SendTransaction(
 	ctx context.Context, t Transaction,
 ) (res RespSend, err error) {
+	if t.Origin != "" {
+		ctx = ContextWithOrigin(ctx, t.Origin)
+	}
 	path := federationPathPrefixV1 + "/send/" + string(t.TransactionID)
 	req := NewFederationRequest("PUT", t.Destination, path)
 	if err = req.SetContent(t); err != nil {
@@ -90,3 +90,51 @@ func TestSendJoinFallback(t *testing.T) {
 		t.Fatalf("SendJoin response got %+v want %+v", res.StateEvents, wantRes.StateEvents)
 	}
 }
+
+func TestFederationClientWithSignerProvider(t *testing.T) {
+	_, privateKeyA, _ := ed25519.GenerateKey(nil)
+	_, privateKeyB, _ := ed25519.GenerateKey(nil)
+	signers := gomatrixserverlib.StaticSignerProvider{
+		"a.example": gomatrixserverlib.NewEd25519Signer("ed25519:a", privateKeyA),
+		"b.example": gomatrixserverlib.NewEd25519Signer("ed25519:b", privateKeyB),
+	}
+	var authorization string
+	fc := gomatrixserverlib.NewFederationClientWithSignerProvider(
+		"a.example", signers,
+		gomatrixserverlib.WithTransport(&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				authorization = req.Header.Get("Authorization")
+				return &http.Response{
+					StatusCode: 200,
+					Body:       ioutil.NopCloser(strings.NewReader(`{"pdus":{}}`)),
+				}, nil
+			},
+		}),
+	)
+
+	tests := []struct {
+		ctx  context.Context
+		txn  gomatrixserverlib.Transaction
+		want string
+	}{
+		{context.Background(), gomatrixserverlib.Transaction{}, `X-Matrix origin="a.example",destination="remote.example",key="ed25519:a"`},
+		{gomatrixserverlib.ContextWithOrigin(context.Background(), "b.example"), gomatrixserverlib.Transaction{}, `X-Matrix origin="b.example",destination="remote.example",key="ed25519:b"`},
+		{context.Background(), gomatrixserverlib.Transaction{Origin: "b.example"}, `X-Matrix origin="b.example",destination="remote.example",key="ed25519:b"`},
+	}
+	for i, test := range tests {
+		test.txn.Destination = "remote.example"
+		test.txn.TransactionID = "1"
+		if _, err := fc.SendTransaction(test.ctx, test.txn); err != nil {
+			t.Fatalf("%d: SendTransaction failed: %v", i, err)
+		}
+		if !strings.HasPrefix(authorization, test.want) {
+			t.Errorf("%d: want Authorization starting with %q, got %q", i, test.want, authorization)
+		}
+	}
+
+	ctx := gomatrixserverlib.ContextWithOrigin(context.Background(), "c.example")
+	_, err := fc.SendTransaction(ctx, gomatrixserverlib.Transaction{Destination: "remote.example"})
+	if _, ok := err.(gomatrixserverlib.UnknownServerNameError); !ok {
+		t.Errorf("want UnknownServerNameError for a server name that isn't hosted, got %v", err)
+	}
+}
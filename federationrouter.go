@@ -0,0 +1,654 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// PublicRoomsRequest is the request to list the public rooms of a server,
+// either as the query parameters of GET /_matrix/federation/v1/publicRooms or
+// the body of a POST to it.
+// https://matrix.org/docs/spec/server_server/r0.1.4#public-room-directory
+type PublicRoomsRequest struct {
+	Limit  int    `json:"limit,omitempty"`
+	Since  string `json:"since,omitempty"`
+	Filter struct {
+		GenericSearchTerm string `json:"generic_search_term,omitempty"`
+	} `json:"filter"`
+	IncludeAllNetworks   bool   `json:"include_all_networks,omitempty"`
+	ThirdPartyInstanceID string `json:"third_party_instance_id,omitempty"`
+}
+
+// A FederationAPI handles the requests routed to it by a FederationRouter,
+// with one method per federation endpoint. The requests have already been
+// authenticated as coming from origin, and their path parameters and bodies
+// decoded. Implementations should embed UnimplementedFederationAPI so that
+// the endpoints they don't implement return M_UNRECOGNIZED. For a router
+// hosting several server names, DestinationFromContext returns the server
+// name that each authenticated request was sent to.
+//
+// The responses to endpoints which have both a v1 and a v2 version are in the
+// v2 format, and are converted to the v1 format by the FederationRouter.
+type FederationAPI interface {
+	// PUT /_matrix/federation/v1/send/{txnID}. The transaction's origin and
+	// ID are the authenticated ones, and it is within the PDU and EDU limits.
+	OnSendTransaction(ctx context.Context, origin ServerName, txnID TransactionID, txn Transaction) util.JSONResponse
+	// GET /_matrix/federation/v1/make_join/{roomID}/{userID}
+	OnMakeJoin(ctx context.Context, origin ServerName, roomID, userID string, roomVersions []RoomVersion) util.JSONResponse
+	// PUT /_matrix/federation/v1|v2/send_join/{roomID}/{eventID}
+	OnSendJoin(ctx context.Context, origin ServerName, roomID, eventID string, event *Event) util.JSONResponse
+	// GET /_matrix/federation/v1/make_leave/{roomID}/{userID}
+	OnMakeLeave(ctx context.Context, origin ServerName, roomID, userID string) util.JSONResponse
+	// PUT /_matrix/federation/v1|v2/send_leave/{roomID}/{eventID}
+	OnSendLeave(ctx context.Context, origin ServerName, roomID, eventID string, event *Event) util.JSONResponse
+	// PUT /_matrix/federation/v1|v2/invite/{roomID}/{eventID}. Invites sent
+	// to v1 are converted into a InviteV2Request whose RoomVersion is
+	// RoomVersionV1, but v1 doesn't say what version the room is so it may
+	// really be a version 2 room, which uses the same event format. Look up
+	// the room's version rather than trusting it for v1 invites.
+	OnInvite(ctx context.Context, origin ServerName, roomID, eventID string, request InviteV2Request) util.JSONResponse
+	// PUT /_matrix/federation/v1/exchange_third_party_invite/{roomID}
+	OnExchangeThirdPartyInvite(ctx context.Context, origin ServerName, roomID string, builder EventBuilder) util.JSONResponse
+	// GET /_matrix/federation/v1/state/{roomID}?event_id=
+	OnGetState(ctx context.Context, origin ServerName, roomID, eventID string) util.JSONResponse
+	// GET /_matrix/federation/v1/state_ids/{roomID}?event_id=
+	OnGetStateIDs(ctx context.Context, origin ServerName, roomID, eventID string) util.JSONResponse
+	// POST /_matrix/federation/v1/get_missing_events/{roomID}
+	OnGetMissingEvents(ctx context.Context, origin ServerName, roomID string, missing MissingEvents) util.JSONResponse
+	// GET /_matrix/federation/v1/event/{eventID}
+	OnGetEvent(ctx context.Context, origin ServerName, eventID string) util.JSONResponse
+	// GET /_matrix/federation/v1/event_auth/{roomID}/{eventID}
+	OnGetEventAuth(ctx context.Context, origin ServerName, roomID, eventID string) util.JSONResponse
+	// GET /_matrix/federation/v1/backfill/{roomID}?v=&limit=
+	OnBackfill(ctx context.Context, origin ServerName, roomID string, eventIDs []string, limit int) util.JSONResponse
+	// GET /_matrix/federation/v1/query/directory?room_alias=
+	OnQueryDirectory(ctx context.Context, origin ServerName, roomAlias string) util.JSONResponse
+	// GET /_matrix/federation/v1/query/profile?user_id=&field=
+	OnQueryProfile(ctx context.Context, origin ServerName, userID, field string) util.JSONResponse
+	// GET or POST /_matrix/federation/v1/publicRooms
+	OnGetPublicRooms(ctx context.Context, origin ServerName, request PublicRoomsRequest) util.JSONResponse
+	// GET /_matrix/federation/v1/user/devices/{userID}
+	OnGetUserDevices(ctx context.Context, origin ServerName, userID string) util.JSONResponse
+	// POST /_matrix/federation/v1/user/keys/claim
+	OnClaimKeys(ctx context.Context, origin ServerName, oneTimeKeys map[string]map[string]string) util.JSONResponse
+	// POST /_matrix/federation/v1/user/keys/query
+	OnQueryKeys(ctx context.Context, origin ServerName, deviceKeys map[string][]string) util.JSONResponse
+	// GET /_matrix/federation/v1/version. This isn't authenticated.
+	OnGetVersion(ctx context.Context) util.JSONResponse
+	// GET /_matrix/federation/v1/openid/userinfo?access_token=. This is
+	// authenticated by the access token rather than a signature.
+	OnOpenIDUserInfo(ctx context.Context, accessToken string) util.JSONResponse
+}
+
+// UnimplementedFederationAPI is a FederationAPI which responds to every
+// request with M_UNRECOGNIZED, as the specification requires for endpoints
+// that a server doesn't implement. Embed it in FederationAPI implementations.
+type UnimplementedFederationAPI struct{}
+
+func unrecognizedResponse() util.JSONResponse {
+	return util.MatrixErrorResponse(404, "M_UNRECOGNIZED", "Unrecognized request")
+}
+
+// OnSendTransaction implements FederationAPI
+func (UnimplementedFederationAPI) OnSendTransaction(ctx context.Context, origin ServerName, txnID TransactionID, txn Transaction) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnMakeJoin implements FederationAPI
+func (UnimplementedFederationAPI) OnMakeJoin(ctx context.Context, origin ServerName, roomID, userID string, roomVersions []RoomVersion) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnSendJoin implements FederationAPI
+func (UnimplementedFederationAPI) OnSendJoin(ctx context.Context, origin ServerName, roomID, eventID string, event *Event) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnMakeLeave implements FederationAPI
+func (UnimplementedFederationAPI) OnMakeLeave(ctx context.Context, origin ServerName, roomID, userID string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnSendLeave implements FederationAPI
+func (UnimplementedFederationAPI) OnSendLeave(ctx context.Context, origin ServerName, roomID, eventID string, event *Event) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnInvite implements FederationAPI
+func (UnimplementedFederationAPI) OnInvite(ctx context.Context, origin ServerName, roomID, eventID string, request InviteV2Request) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnExchangeThirdPartyInvite implements FederationAPI
+func (UnimplementedFederationAPI) OnExchangeThirdPartyInvite(ctx context.Context, origin ServerName, roomID string, builder EventBuilder) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetState implements FederationAPI
+func (UnimplementedFederationAPI) OnGetState(ctx context.Context, origin ServerName, roomID, eventID string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetStateIDs implements FederationAPI
+func (UnimplementedFederationAPI) OnGetStateIDs(ctx context.Context, origin ServerName, roomID, eventID string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetMissingEvents implements FederationAPI
+func (UnimplementedFederationAPI) OnGetMissingEvents(ctx context.Context, origin ServerName, roomID string, missing MissingEvents) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetEvent implements FederationAPI
+func (UnimplementedFederationAPI) OnGetEvent(ctx context.Context, origin ServerName, eventID string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetEventAuth implements FederationAPI
+func (UnimplementedFederationAPI) OnGetEventAuth(ctx context.Context, origin ServerName, roomID, eventID string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnBackfill implements FederationAPI
+func (UnimplementedFederationAPI) OnBackfill(ctx context.Context, origin ServerName, roomID string, eventIDs []string, limit int) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnQueryDirectory implements FederationAPI
+func (UnimplementedFederationAPI) OnQueryDirectory(ctx context.Context, origin ServerName, roomAlias string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnQueryProfile implements FederationAPI
+func (UnimplementedFederationAPI) OnQueryProfile(ctx context.Context, origin ServerName, userID, field string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetPublicRooms implements FederationAPI
+func (UnimplementedFederationAPI) OnGetPublicRooms(ctx context.Context, origin ServerName, request PublicRoomsRequest) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetUserDevices implements FederationAPI
+func (UnimplementedFederationAPI) OnGetUserDevices(ctx context.Context, origin ServerName, userID string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnClaimKeys implements FederationAPI
+func (UnimplementedFederationAPI) OnClaimKeys(ctx context.Context, origin ServerName, oneTimeKeys map[string]map[string]string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnQueryKeys implements FederationAPI
+func (UnimplementedFederationAPI) OnQueryKeys(ctx context.Context, origin ServerName, deviceKeys map[string][]string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnGetVersion implements FederationAPI
+func (UnimplementedFederationAPI) OnGetVersion(ctx context.Context) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// OnOpenIDUserInfo implements FederationAPI
+func (UnimplementedFederationAPI) OnOpenIDUserInfo(ctx context.Context, accessToken string) util.JSONResponse {
+	return unrecognizedResponse()
+}
+
+// A FederationRouter is an http.Handler for the /_matrix/federation/ API. It
+// verifies the X-Matrix signature of each request, decodes its path
+// parameters, query parameters and body, and calls the FederationAPI method
+// for its endpoint.
+type FederationRouter struct {
+	serverNames []ServerName
+	keyRing     JSONVerifier
+	roomVersion RoomVersionLookup
+	api         FederationAPI
+	handler     http.Handler
+}
+
+// NewFederationRouter makes a FederationRouter for requests sent to
+// serverName, whose signatures are checked using the keyRing. roomVersion is
+// used to decode the events sent to the send_join and send_leave endpoints.
+func NewFederationRouter(
+	serverName ServerName, keyRing JSONVerifier, roomVersion RoomVersionLookup, api FederationAPI,
+) *FederationRouter {
+	return NewFederationRouterForServerNames([]ServerName{serverName}, keyRing, roomVersion, api)
+}
+
+// NewFederationRouterForServerNames is like NewFederationRouter, but for a
+// process hosting several server names. Requests are accepted if they were
+// sent to any of the serverNames, as checked by
+// VerifyHTTPRequestForServerNames.
+func NewFederationRouterForServerNames(
+	serverNames []ServerName, keyRing JSONVerifier, roomVersion RoomVersionLookup, api FederationAPI,
+) *FederationRouter {
+	r := &FederationRouter{
+		serverNames: append([]ServerName(nil), serverNames...),
+		keyRing:     keyRing,
+		roomVersion: roomVersion,
+		api:         api,
+	}
+	r.handler = util.MakeJSONAPI(util.NewJSONRequestHandler(r.route))
+	return r
+}
+
+type destinationContextKey struct{}
+
+// DestinationFromContext returns the server name that the request being
+// handled by a FederationAPI was sent to, or "" if the request wasn't
+// authenticated.
+func DestinationFromContext(ctx context.Context) ServerName {
+	destination, _ := ctx.Value(destinationContextKey{}).(ServerName)
+	return destination
+}
+
+// ServeHTTP implements http.Handler
+func (r *FederationRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.ServeHTTP(w, req)
+}
+
+const federationPathPrefix = "/_matrix/federation/"
+
+// A federationRoute is an endpoint handled by a FederationRouter.
+type federationRoute struct {
+	method string
+	// The path after federationPathPrefix, split on "/". Segments which are
+	// "*" are path parameters.
+	path []string
+	// Whether the request is authenticated by the X-Matrix signature.
+	signed bool
+	handle func(r *FederationRouter, req *federationRouteRequest) util.JSONResponse
+}
+
+// federationRouteRequest is a request being handled by a federationRoute.
+type federationRouteRequest struct {
+	ctx     context.Context
+	origin  ServerName
+	content []byte
+	query   url.Values
+	// The path parameters.
+	vars []string
+}
+
+func newFederationRoute(
+	method, path string, signed bool,
+	handle func(r *FederationRouter, req *federationRouteRequest) util.JSONResponse,
+) federationRoute {
+	return federationRoute{method, strings.Split(path, "/"), signed, handle}
+}
+
+var federationRoutes = []federationRoute{
+	newFederationRoute("PUT", "v1/send/*", true, routeSendTransaction),
+	newFederationRoute("GET", "v1/make_join/*/*", true, routeMakeJoin),
+	newFederationRoute("PUT", "v1/send_join/*/*", true, routeSendJoin(true)),
+	newFederationRoute("PUT", "v2/send_join/*/*", true, routeSendJoin(false)),
+	newFederationRoute("GET", "v1/make_leave/*/*", true, routeMakeLeave),
+	newFederationRoute("PUT", "v1/send_leave/*/*", true, routeSendLeave(true)),
+	newFederationRoute("PUT", "v2/send_leave/*/*", true, routeSendLeave(false)),
+	newFederationRoute("PUT", "v1/invite/*/*", true, routeInviteV1),
+	newFederationRoute("PUT", "v2/invite/*/*", true, routeInviteV2),
+	newFederationRoute("PUT", "v1/exchange_third_party_invite/*", true, routeExchangeThirdPartyInvite),
+	newFederationRoute("GET", "v1/state/*", true, routeGetState),
+	newFederationRoute("GET", "v1/state_ids/*", true, routeGetStateIDs),
+	newFederationRoute("POST", "v1/get_missing_events/*", true, routeGetMissingEvents),
+	newFederationRoute("GET", "v1/event/*", true, routeGetEvent),
+	newFederationRoute("GET", "v1/event_auth/*/*", true, routeGetEventAuth),
+	newFederationRoute("GET", "v1/backfill/*", true, routeBackfill),
+	newFederationRoute("GET", "v1/query/directory", true, routeQueryDirectory),
+	newFederationRoute("GET", "v1/query/profile", true, routeQueryProfile),
+	newFederationRoute("GET", "v1/publicRooms", true, routeGetPublicRooms),
+	newFederationRoute("POST", "v1/publicRooms", true, routePostPublicRooms),
+	newFederationRoute("GET", "v1/user/devices/*", true, routeGetUserDevices),
+	newFederationRoute("POST", "v1/user/keys/claim", true, routeClaimKeys),
+	newFederationRoute("POST", "v1/user/keys/query", true, routeQueryKeys),
+	newFederationRoute("GET", "v1/version", false, routeGetVersion),
+	newFederationRoute("GET", "v1/openid/userinfo", false, routeOpenIDUserInfo),
+}
+
+// match returns the path parameters if the path matches the route.
+func (route *federationRoute) match(path []string) ([]string, bool) {
+	if len(path) != len(route.path) {
+		return nil, false
+	}
+	var vars []string
+	for i, segment := range route.path {
+		if segment == "*" {
+			vars = append(vars, path[i])
+		} else if segment != path[i] {
+			return nil, false
+		}
+	}
+	return vars, true
+}
+
+func (r *FederationRouter) route(req *http.Request) util.JSONResponse {
+	escapedPath := req.URL.EscapedPath()
+	if !strings.HasPrefix(escapedPath, federationPathPrefix) {
+		return unrecognizedResponse()
+	}
+	// Split the path before unescaping it since IDs can contain "/".
+	path := strings.Split(escapedPath[len(federationPathPrefix):], "/")
+	for i := range path {
+		segment, err := url.PathUnescape(path[i])
+		if err != nil {
+			return util.MatrixErrorResponse(400, "M_INVALID_PARAM", "Invalid path: "+err.Error())
+		}
+		path[i] = segment
+	}
+
+	pathMatched := false
+	for i := range federationRoutes {
+		route := &federationRoutes[i]
+		vars, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if route.method != req.Method {
+			continue
+		}
+		routeReq := &federationRouteRequest{
+			ctx:   req.Context(),
+			query: req.URL.Query(),
+			vars:  vars,
+		}
+		if route.signed {
+			fedReq, errRes := VerifyHTTPRequestForServerNames(req, time.Now(), r.serverNames, r.keyRing)
+			if fedReq == nil {
+				return errRes
+			}
+			routeReq.ctx = context.WithValue(routeReq.ctx, destinationContextKey{}, fedReq.Destination())
+			routeReq.origin = fedReq.Origin()
+			routeReq.content = fedReq.Content()
+		}
+		return route.handle(r, routeReq)
+	}
+	if pathMatched {
+		return util.MatrixErrorResponse(405, "M_UNRECOGNIZED", "Method not allowed")
+	}
+	return unrecognizedResponse()
+}
+
+// decode decodes the content of the request into v.
+func (req *federationRouteRequest) decode(v interface{}) *util.JSONResponse {
+	if err := json.Unmarshal(req.content, v); err != nil {
+		res := util.MatrixErrorResponse(400, "M_BAD_JSON", "The request body could not be decoded into valid JSON. "+err.Error())
+		return &res
+	}
+	return nil
+}
+
+// requiredQuery returns the query parameter, or an error response if it is
+// missing.
+func (req *federationRouteRequest) requiredQuery(name string) (string, *util.JSONResponse) {
+	value := req.query.Get(name)
+	if value == "" {
+		res := util.MatrixErrorResponse(400, "M_MISSING_PARAM", "Missing "+name+" query parameter")
+		return "", &res
+	}
+	return value, nil
+}
+
+// decodeEvent decodes the content of the request as an event in the room,
+// checking that it has the room and event IDs in the request path.
+func (r *FederationRouter) decodeEvent(req *federationRouteRequest, roomVersion RoomVersion) (*Event, *util.JSONResponse) {
+	roomID, eventID := req.vars[0], req.vars[1]
+	if roomVersion == "" {
+		var err error
+		if roomVersion, err = r.roomVersion(req.ctx, roomID); err != nil {
+			res := util.MatrixErrorResponse(404, "M_NOT_FOUND", "Unknown room "+roomID)
+			return nil, &res
+		}
+	}
+	event, err := NewEventFromUntrustedJSON(req.content, roomVersion)
+	if err != nil {
+		res := util.MatrixErrorResponse(400, "M_BAD_JSON", "The request body could not be decoded into a valid event. "+err.Error())
+		return nil, &res
+	}
+	if errRes := checkEventPath(event, roomID, eventID); errRes != nil {
+		return nil, errRes
+	}
+	return event, nil
+}
+
+// checkEventPath returns an error response unless the event has the room and
+// event IDs in the request path.
+func checkEventPath(event *Event, roomID, eventID string) *util.JSONResponse {
+	if event.RoomID() != roomID || event.EventID() != eventID {
+		res := util.MatrixErrorResponse(400, "M_BAD_JSON", "The event doesn't match the room ID and event ID in the path")
+		return &res
+	}
+	return nil
+}
+
+// v1Response converts a successful response into the v1 format, which is an
+// array of the status code and the response.
+func v1Response(res util.JSONResponse) util.JSONResponse {
+	if res.Code == 200 {
+		res.JSON = []interface{}{200, res.JSON}
+	}
+	return res
+}
+
+func routeSendTransaction(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var txn Transaction
+	if errRes := req.decode(&txn); errRes != nil {
+		return *errRes
+	}
+	if err := checkTransactionLimits(txn); err != nil {
+		return util.MatrixErrorResponse(400, "M_BAD_JSON", err.Error())
+	}
+	// The origin and transaction ID in the body aren't authenticated.
+	txn.Origin = req.origin
+	txn.TransactionID = TransactionID(req.vars[0])
+	return r.api.OnSendTransaction(req.ctx, req.origin, txn.TransactionID, txn)
+}
+
+func routeMakeJoin(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var roomVersions []RoomVersion
+	for _, ver := range req.query["ver"] {
+		roomVersions = append(roomVersions, RoomVersion(ver))
+	}
+	if len(roomVersions) == 0 {
+		// Servers that don't send versions only support version 1.
+		roomVersions = []RoomVersion{RoomVersionV1}
+	}
+	return r.api.OnMakeJoin(req.ctx, req.origin, req.vars[0], req.vars[1], roomVersions)
+}
+
+func routeSendJoin(v1 bool) func(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	return func(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+		event, errRes := r.decodeEvent(req, "")
+		if errRes != nil {
+			return *errRes
+		}
+		res := r.api.OnSendJoin(req.ctx, req.origin, req.vars[0], req.vars[1], event)
+		if v1 {
+			return v1Response(res)
+		}
+		return res
+	}
+}
+
+func routeMakeLeave(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	return r.api.OnMakeLeave(req.ctx, req.origin, req.vars[0], req.vars[1])
+}
+
+func routeSendLeave(v1 bool) func(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	return func(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+		event, errRes := r.decodeEvent(req, "")
+		if errRes != nil {
+			return *errRes
+		}
+		res := r.api.OnSendLeave(req.ctx, req.origin, req.vars[0], req.vars[1], event)
+		if v1 {
+			return v1Response(res)
+		}
+		return res
+	}
+}
+
+func routeInviteV1(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	// The v1 API is only used for rooms with the version 1 event format,
+	// which version 2 rooms share, so the room version is only a guess.
+	event, errRes := r.decodeEvent(req, RoomVersionV1)
+	if errRes != nil {
+		return *errRes
+	}
+	request, err := NewInviteV2Request(event.Headered(RoomVersionV1), nil)
+	if err != nil {
+		return util.MatrixErrorResponse(400, "M_BAD_JSON", err.Error())
+	}
+	return v1Response(r.api.OnInvite(req.ctx, req.origin, req.vars[0], req.vars[1], request))
+}
+
+func routeInviteV2(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var request InviteV2Request
+	if errRes := req.decode(&request); errRes != nil {
+		return *errRes
+	}
+	if errRes := checkEventPath(request.Event(), req.vars[0], req.vars[1]); errRes != nil {
+		return *errRes
+	}
+	return r.api.OnInvite(req.ctx, req.origin, req.vars[0], req.vars[1], request)
+}
+
+func routeExchangeThirdPartyInvite(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var builder EventBuilder
+	if errRes := req.decode(&builder); errRes != nil {
+		return *errRes
+	}
+	if builder.RoomID != req.vars[0] {
+		return util.MatrixErrorResponse(400, "M_BAD_JSON", "The event doesn't match the room ID in the path")
+	}
+	return r.api.OnExchangeThirdPartyInvite(req.ctx, req.origin, req.vars[0], builder)
+}
+
+func routeGetState(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	eventID, errRes := req.requiredQuery("event_id")
+	if errRes != nil {
+		return *errRes
+	}
+	return r.api.OnGetState(req.ctx, req.origin, req.vars[0], eventID)
+}
+
+func routeGetStateIDs(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	eventID, errRes := req.requiredQuery("event_id")
+	if errRes != nil {
+		return *errRes
+	}
+	return r.api.OnGetStateIDs(req.ctx, req.origin, req.vars[0], eventID)
+}
+
+func routeGetMissingEvents(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var missing MissingEvents
+	if errRes := req.decode(&missing); errRes != nil {
+		return *errRes
+	}
+	return r.api.OnGetMissingEvents(req.ctx, req.origin, req.vars[0], missing)
+}
+
+func routeGetEvent(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	return r.api.OnGetEvent(req.ctx, req.origin, req.vars[0])
+}
+
+func routeGetEventAuth(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	return r.api.OnGetEventAuth(req.ctx, req.origin, req.vars[0], req.vars[1])
+}
+
+func routeBackfill(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	eventIDs := req.query["v"]
+	if len(eventIDs) == 0 {
+		return util.MatrixErrorResponse(400, "M_MISSING_PARAM", "Missing v query parameter")
+	}
+	limitStr, errRes := req.requiredQuery("limit")
+	if errRes != nil {
+		return *errRes
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit < 0 {
+		return util.MatrixErrorResponse(400, "M_INVALID_PARAM", "Invalid limit query parameter")
+	}
+	return r.api.OnBackfill(req.ctx, req.origin, req.vars[0], eventIDs, limit)
+}
+
+func routeQueryDirectory(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	roomAlias, errRes := req.requiredQuery("room_alias")
+	if errRes != nil {
+		return *errRes
+	}
+	return r.api.OnQueryDirectory(req.ctx, req.origin, roomAlias)
+}
+
+func routeQueryProfile(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	userID, errRes := req.requiredQuery("user_id")
+	if errRes != nil {
+		return *errRes
+	}
+	return r.api.OnQueryProfile(req.ctx, req.origin, userID, req.query.Get("field"))
+}
+
+func routeGetPublicRooms(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var request PublicRoomsRequest
+	if limit := req.query.Get("limit"); limit != "" {
+		var err error
+		if request.Limit, err = strconv.Atoi(limit); err != nil {
+			return util.MatrixErrorResponse(400, "M_INVALID_PARAM", "Invalid limit query parameter")
+		}
+	}
+	request.Since = req.query.Get("since")
+	request.IncludeAllNetworks = req.query.Get("include_all_networks") == "true"
+	request.ThirdPartyInstanceID = req.query.Get("third_party_instance_id")
+	return r.api.OnGetPublicRooms(req.ctx, req.origin, request)
+}
+
+func routePostPublicRooms(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var request PublicRoomsRequest
+	if errRes := req.decode(&request); errRes != nil {
+		return *errRes
+	}
+	return r.api.OnGetPublicRooms(req.ctx, req.origin, request)
+}
+
+func routeGetUserDevices(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	return r.api.OnGetUserDevices(req.ctx, req.origin, req.vars[0])
+}
+
+func routeClaimKeys(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var body struct {
+		OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+	}
+	if errRes := req.decode(&body); errRes != nil {
+		return *errRes
+	}
+	return r.api.OnClaimKeys(req.ctx, req.origin, body.OneTimeKeys)
+}
+
+func routeQueryKeys(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	var body struct {
+		DeviceKeys map[string][]string `json:"device_keys"`
+	}
+	if errRes := req.decode(&body); errRes != nil {
+		return *errRes
+	}
+	return r.api.OnQueryKeys(req.ctx, req.origin, body.DeviceKeys)
+}
+
+func routeGetVersion(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	return r.api.OnGetVersion(req.ctx)
+}
+
+func routeOpenIDUserInfo(r *FederationRouter, req *federationRouteRequest) util.JSONResponse {
+	accessToken, errRes := req.requiredQuery("access_token")
+	if errRes != nil {
+		return *errRes
+	}
+	return r.api.OnOpenIDUserInfo(req.ctx, accessToken)
+}
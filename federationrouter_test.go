@@ -0,0 +1,264 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testFederationAPI struct {
+	UnimplementedFederationAPI
+	origin      ServerName
+	destination ServerName
+	txn         Transaction
+	event       *Event
+}
+
+func (a *testFederationAPI) OnSendTransaction(ctx context.Context, origin ServerName, txnID TransactionID, txn Transaction) util.JSONResponse {
+	a.origin, a.destination, a.txn = origin, DestinationFromContext(ctx), txn
+	return util.JSONResponse{Code: 200, JSON: RespSend{PDUs: map[string]PDUResult{}}}
+}
+
+func (a *testFederationAPI) OnSendJoin(ctx context.Context, origin ServerName, roomID, eventID string, event *Event) util.JSONResponse {
+	a.origin, a.event = origin, event
+	return util.JSONResponse{Code: 200, JSON: map[string]string{"origin": string(origin)}}
+}
+
+func (a *testFederationAPI) OnGetVersion(ctx context.Context) util.JSONResponse {
+	return util.JSONResponse{Code: 200, JSON: map[string]string{"name": "test"}}
+}
+
+type testFederationRouter struct {
+	t           *testing.T
+	router      *FederationRouter
+	api         *testFederationAPI
+	privateKey  ed25519.PrivateKey
+	destination ServerName
+}
+
+// newTestFederationRouter makes a router for local which accepts every
+// signature.
+func newTestFederationRouter(t *testing.T) *testFederationRouter {
+	return newTestFederationRouterWithVerifier(t, &testNopJSONVerifier{})
+}
+
+// newTestFederationRouterWithVerifier makes a router for the server names,
+// which default to local, that checks signatures using the keyRing.
+func newTestFederationRouterWithVerifier(
+	t *testing.T, keyRing JSONVerifier, serverNames ...ServerName,
+) *testFederationRouter {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	api := &testFederationAPI{}
+	roomVersion := func(ctx context.Context, roomID string) (RoomVersion, error) {
+		return RoomVersionV1, nil
+	}
+	if len(serverNames) == 0 {
+		serverNames = []ServerName{"local"}
+	}
+	return &testFederationRouter{
+		t:           t,
+		router:      NewFederationRouterForServerNames(serverNames, keyRing, roomVersion, api),
+		api:         api,
+		privateKey:  privateKey,
+		destination: serverNames[0],
+	}
+}
+
+// storeTestFederationRouterKey stores the key that the router's requests
+// are signed with in the database.
+func storeTestFederationRouterKey(t *testing.T, r *testFederationRouter, db KeyDatabase) {
+	err := db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{ServerName: "baba.is.you", KeyID: "ed25519:auto"}: {
+			VerifyKey:    VerifyKey{Key: Base64Bytes(r.privateKey.Public().(ed25519.PublicKey))},
+			ValidUntilTS: AsTimestamp(time.Now().Add(time.Hour)),
+			ExpiredTS:    PublicKeyNotExpired,
+		},
+	})
+	if err != nil {
+		t.Fatalf("StoreKeys failed: %v", err)
+	}
+}
+
+// do sends a request to the router, signed by baba.is.you if sign is true,
+// and returns the status code and the decoded response.
+func (r *testFederationRouter) do(method, path string, content interface{}, sign bool) (int, interface{}) {
+	fedReq := NewFederationRequest(method, r.destination, path)
+	if content != nil {
+		if err := fedReq.SetContent(content); err != nil {
+			r.t.Fatalf("SetContent failed: %v", err)
+		}
+	}
+	if sign {
+		if err := fedReq.Sign("baba.is.you", "ed25519:auto", r.privateKey); err != nil {
+			r.t.Fatalf("Sign failed: %v", err)
+		}
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		r.t.Fatalf("HTTPRequest failed: %v", err)
+	}
+	if req.Body == nil {
+		// The server always gives handlers a non-nil body.
+		req.Body = http.NoBody
+	}
+	w := httptest.NewRecorder()
+	r.router.ServeHTTP(w, req)
+	var res interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		r.t.Fatalf("failed to decode response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, res
+}
+
+func TestFederationRouterSendTransaction(t *testing.T) {
+	r := newTestFederationRouter(t)
+	code, _ := r.do("PUT", "/_matrix/federation/v1/send/txn1", Transaction{
+		Origin: "spoofed",
+		PDUs:   []json.RawMessage{testTransactionEvents[0]},
+	}, true)
+	if code != 200 {
+		t.Fatalf("want 200, got %d", code)
+	}
+	if r.api.origin != "baba.is.you" || r.api.txn.Origin != "baba.is.you" {
+		t.Errorf("want origin baba.is.you, got %q and %q", r.api.origin, r.api.txn.Origin)
+	}
+	if r.api.txn.TransactionID != "txn1" || len(r.api.txn.PDUs) != 1 {
+		t.Errorf("transaction wasn't decoded: %+v", r.api.txn)
+	}
+
+	code, _ = r.do("PUT", "/_matrix/federation/v1/send/txn2", Transaction{
+		PDUs: make([]json.RawMessage, MaxPDUsPerTransaction+1),
+	}, true)
+	if code != 400 {
+		t.Errorf("want 400 for too many PDUs, got %d", code)
+	}
+
+	code, _ = r.do("PUT", "/_matrix/federation/v1/send/txn3", Transaction{}, false)
+	if code != 401 {
+		t.Errorf("want 401 for an unsigned request, got %d", code)
+	}
+}
+
+func TestFederationRouterChecksSignatures(t *testing.T) {
+	db := NewMemoryKeyDatabase(0)
+	r := newTestFederationRouterWithVerifier(t, &KeyRing{nil, db, nil})
+	storeTestFederationRouterKey(t, r, db)
+
+	if code, res := r.do("PUT", "/_matrix/federation/v1/send/txn1", Transaction{}, true); code != 200 {
+		t.Fatalf("want 200, got %d: %v", code, res)
+	}
+
+	// A request signed with a different key.
+	signingKey := r.privateKey
+	_, r.privateKey, _ = ed25519.GenerateKey(nil)
+	if code, _ := r.do("PUT", "/_matrix/federation/v1/send/txn2", Transaction{}, true); code != 401 {
+		t.Errorf("want 401 for a bad signature, got %d", code)
+	}
+	r.privateKey = signingKey
+
+	// A request for another server, which could be replayed to it.
+	r.destination = "elsewhere"
+	if code, _ := r.do("PUT", "/_matrix/federation/v1/send/txn3", Transaction{}, true); code != 401 {
+		t.Errorf("want 401 for the wrong destination, got %d", code)
+	}
+	if r.api.txn.TransactionID != "txn1" {
+		t.Errorf("want only txn1 handled, got %q", r.api.txn.TransactionID)
+	}
+}
+
+func TestFederationRouterHostsSeveralServerNames(t *testing.T) {
+	db := NewMemoryKeyDatabase(0)
+	r := newTestFederationRouterWithVerifier(t, &KeyRing{nil, db, nil}, "local", "other.local")
+	storeTestFederationRouterKey(t, r, db)
+
+	for _, destination := range []ServerName{"local", "other.local"} {
+		r.destination = destination
+		txnID := "txn-" + string(destination)
+		if code, res := r.do("PUT", "/_matrix/federation/v1/send/"+txnID, Transaction{}, true); code != 200 {
+			t.Fatalf("%s: want 200, got %d: %v", destination, code, res)
+		}
+		if r.api.destination != destination || string(r.api.txn.TransactionID) != txnID {
+			t.Errorf("%s: want the transaction handled for it, got %q for %q", destination, r.api.txn.TransactionID, r.api.destination)
+		}
+	}
+
+	r.destination = "elsewhere"
+	if code, _ := r.do("PUT", "/_matrix/federation/v1/send/txn", Transaction{}, true); code != 401 {
+		t.Errorf("want 401 for a server name that isn't hosted, got %d", code)
+	}
+}
+
+func TestFederationRouterSendJoin(t *testing.T) {
+	r := newTestFederationRouter(t)
+	event := json.RawMessage(testTransactionEvents[1])
+	path := "/send_join/" + url.PathEscape("!roomid:baba.is.you") + "/" + url.PathEscape("$fnwGrQEpiOIUoDU2:baba.is.you")
+
+	code, res := r.do("PUT", "/_matrix/federation/v2"+path, event, true)
+	if code != 200 {
+		t.Fatalf("want 200, got %d: %v", code, res)
+	}
+	if r.api.event == nil || r.api.event.EventID() != "$fnwGrQEpiOIUoDU2:baba.is.you" {
+		t.Errorf("event wasn't decoded: %v", r.api.event)
+	}
+	if body, ok := res.(map[string]interface{}); !ok || body["origin"] != "baba.is.you" {
+		t.Errorf("unexpected v2 response: %v", res)
+	}
+
+	// The v1 response is wrapped in an array with the status code.
+	code, res = r.do("PUT", "/_matrix/federation/v1"+path, event, true)
+	if code != 200 {
+		t.Fatalf("want 200, got %d: %v", code, res)
+	}
+	if body, ok := res.([]interface{}); !ok || len(body) != 2 || body[0] != float64(200) {
+		t.Errorf("unexpected v1 response: %v", res)
+	}
+
+	// The event must match the path.
+	code, _ = r.do("PUT", "/_matrix/federation/v2/send_join/"+url.PathEscape("!roomid:baba.is.you")+"/"+url.PathEscape("$other:baba.is.you"), event, true)
+	if code != 400 {
+		t.Errorf("want 400 for mismatched event ID, got %d", code)
+	}
+}
+
+func TestFederationRouterUnrecognized(t *testing.T) {
+	r := newTestFederationRouter(t)
+	tests := []struct {
+		method, path string
+		wantCode     int
+	}{
+		// Not implemented by the test API.
+		{"GET", "/_matrix/federation/v1/user/devices/" + url.PathEscape("@alice:local"), 404},
+		// Not an endpoint.
+		{"GET", "/_matrix/federation/v1/nonexistent", 404},
+		// The wrong method.
+		{"POST", "/_matrix/federation/v1/event/" + url.PathEscape("$event:local"), 405},
+	}
+	for _, test := range tests {
+		code, res := r.do(test.method, test.path, nil, true)
+		if code != test.wantCode {
+			t.Errorf("%s %s: want %d, got %d", test.method, test.path, test.wantCode, code)
+		}
+		if body, ok := res.(map[string]interface{}); !ok || body["errcode"] != "M_UNRECOGNIZED" {
+			t.Errorf("%s %s: want M_UNRECOGNIZED, got %v", test.method, test.path, res)
+		}
+	}
+
+	if code, _ := r.do("GET", "/_matrix/federation/v1/state/"+url.PathEscape("!room:local"), nil, true); code != 400 {
+		t.Errorf("want 400 for missing event_id, got %d", code)
+	}
+}
+
+func TestFederationRouterVersionIsUnauthenticated(t *testing.T) {
+	r := newTestFederationRouter(t)
+	code, res := r.do(http.MethodGet, "/_matrix/federation/v1/version", nil, false)
+	if code != 200 {
+		t.Fatalf("want 200, got %d: %v", code, res)
+	}
+}
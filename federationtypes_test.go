@@ -1,8 +1,14 @@
 package gomatrixserverlib
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 const emptyRespStateResponse = `{"pdus":[],"auth_chain":[]}`
@@ -129,3 +135,94 @@ func TestRespSendJoinUnmarshalJSON(t *testing.T) {
 		t.Errorf("json.Marshal(RespSendJoin(%q)): wanted %q, got %q", inputData, emptyRespStateResponse, got)
 	}
 }
+
+// benchmarkRespState builds the state of a public room that the given number
+// of users have joined, signed by a server whose key is in the returned
+// KeyRing.
+func benchmarkRespState(b *testing.B, users int) (RespState, KeyRing) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+	creator := "@creator:bench.server"
+	var authEvents, stateEvents []*Event
+	var prev *Event
+	build := func(sender, eventType, stateKey string, content interface{}, authEventIDs []string) *Event {
+		eb := EventBuilder{
+			Sender:     sender,
+			RoomID:     "!room:bench.server",
+			Type:       eventType,
+			StateKey:   &stateKey,
+			AuthEvents: authEventIDs,
+			PrevEvents: []string{},
+			Depth:      1,
+		}
+		if prev != nil {
+			eb.PrevEvents = []string{prev.EventID()}
+			eb.Depth = prev.Depth() + 1
+		}
+		if err = eb.SetContent(content); err != nil {
+			b.Fatal(err)
+		}
+		event, err := eb.Build(now, "bench.server", "ed25519:bench", privateKey, RoomVersionV6)
+		if err != nil {
+			b.Fatal(err)
+		}
+		prev = event
+		stateEvents = append(stateEvents, event)
+		return event
+	}
+
+	create := build(creator, MRoomCreate, "", map[string]string{"creator": creator, "room_version": "6"}, []string{})
+	join := build(creator, MRoomMember, creator, map[string]string{"membership": Join}, []string{create.EventID()})
+	powerLevels := build(creator, MRoomPowerLevels, "", map[string]interface{}{"users": map[string]int{creator: 100}},
+		[]string{create.EventID(), join.EventID()})
+	joinRules := build(creator, MRoomJoinRules, "", map[string]string{"join_rule": Public},
+		[]string{create.EventID(), join.EventID(), powerLevels.EventID()})
+	authEvents = append(authEvents, create, join, powerLevels, joinRules)
+	for i := 0; i < users; i++ {
+		user := fmt.Sprintf("@user%d:bench.server", i)
+		build(user, MRoomMember, user, map[string]string{"membership": Join},
+			[]string{create.EventID(), powerLevels.EventID(), joinRules.EventID()})
+	}
+
+	db := NewMemoryKeyDatabase(0)
+	err = db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+		{ServerName: "bench.server", KeyID: "ed25519:bench"}: {
+			VerifyKey:    VerifyKey{Key: Base64Bytes(publicKey)},
+			ValidUntilTS: AsTimestamp(now.Add(24 * time.Hour)),
+			ExpiredTS:    PublicKeyNotExpired,
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return RespState{
+		roomVersion: RoomVersionV6,
+		StateEvents: stateEvents,
+		AuthEvents:  authEvents,
+	}, KeyRing{KeyDatabase: db}
+}
+
+func BenchmarkRespStateCheck(b *testing.B) {
+	for _, users := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("users=%d", users), func(b *testing.B) {
+			state, keyRing := benchmarkRespState(b, users)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := RespState{
+					roomVersion: state.roomVersion,
+					StateEvents: append([]*Event(nil), state.StateEvents...),
+					AuthEvents:  append([]*Event(nil), state.AuthEvents...),
+				}
+				if err := r.Check(context.Background(), keyRing, nil); err != nil {
+					b.Fatal(err)
+				}
+				if len(r.StateEvents) != len(state.StateEvents) {
+					b.Fatalf("%d state events failed the checks", len(state.StateEvents)-len(r.StateEvents))
+				}
+			}
+		})
+	}
+}
@@ -16,9 +16,13 @@
 package gomatrixserverlib
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"unicode/utf8"
 
@@ -41,7 +45,8 @@ func CanonicalJSON(input []byte) ([]byte, error) {
 
 // Returns a gomatrixserverlib.BadJSONError if the canonical JSON fails enforced
 // checks or if JSON validation fails. At present this function performs:
-// * integer bounds checking for room version 6 and above:
+// * float, integer bounds, duplicate key and UTF-8 checking for room version 6
+//   and above, wrapping a CanonicalJSONError listing the offending paths:
 //   https://matrix.org/docs/spec/rooms/v6#canonical-json
 // * shortest encoding, sorted lexicographically by UTF-8 codepoint:
 //   https://matrix.org/docs/spec/appendices#canonical-json
@@ -56,34 +61,343 @@ func EnforcedCanonicalJSON(input []byte, roomVersion RoomVersion) ([]byte, error
 	return CanonicalJSON(input)
 }
 
+// ErrCanonicalJSON is matched by errors.Is for any CanonicalJSONError.
 var ErrCanonicalJSON = errors.New("value is outside of safe range")
 
+// CanonicalJSONViolationReason describes why a JSON value isn't permitted in
+// enforced canonical JSON.
+type CanonicalJSONViolationReason string
+
+// Reasons that a JSON value can fail enforced canonical JSON checks.
+const (
+	CanonicalJSONFloat             CanonicalJSONViolationReason = "float"
+	CanonicalJSONIntegerOutOfRange CanonicalJSONViolationReason = "integer out of range"
+	CanonicalJSONDuplicateKey      CanonicalJSONViolationReason = "duplicate key"
+	CanonicalJSONInvalidUTF8       CanonicalJSONViolationReason = "invalid UTF-8"
+)
+
+// A CanonicalJSONViolation is a single value that failed enforced canonical
+// JSON checks.
+type CanonicalJSONViolation struct {
+	// The path to the offending value, e.g. `content.body` or `content.list[2]`.
+	// Keys that aren't simple identifiers are quoted, e.g. `content["m.relates_to"]`.
+	Path   string
+	Reason CanonicalJSONViolationReason
+}
+
+func (v CanonicalJSONViolation) String() string {
+	if v.Path == "" {
+		return string(v.Reason)
+	}
+	return v.Path + ": " + string(v.Reason)
+}
+
+// CanonicalJSONError is returned if JSON fails enforced canonical JSON checks.
+// It lists every offending value.
+type CanonicalJSONError struct {
+	Violations []CanonicalJSONViolation
+}
+
+func (e CanonicalJSONError) Error() string {
+	reasons := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		reasons[i] = v.String()
+	}
+	return "gomatrixserverlib: invalid canonical JSON: " + strings.Join(reasons, ", ")
+}
+
+// Is makes CanonicalJSONError match ErrCanonicalJSON.
+func (e CanonicalJSONError) Is(target error) bool {
+	return target == ErrCanonicalJSON
+}
+
+// verifyEnforcedCanonicalJSON checks the JSON for floats, out of range
+// integers, duplicate keys and invalid UTF-8.
+// Returns a CanonicalJSONError listing every problem that was found, or a
+// plain error if the JSON couldn't be parsed.
 func verifyEnforcedCanonicalJSON(input []byte) error {
-	valid := true
-	res := gjson.ParseBytes(input)
-	var iter func(key, value gjson.Result) bool
-	iter = func(_, value gjson.Result) bool {
-		if value.IsArray() || value.IsObject() {
-			value.ForEach(iter)
-			return true
+	v := canonicalJSONValidator{input: input}
+	v.skipWhitespace()
+	if err := v.value(); err != nil {
+		return err
+	}
+	v.skipWhitespace()
+	if v.pos != len(v.input) {
+		return v.syntaxError()
+	}
+	if len(v.violations) > 0 {
+		return CanonicalJSONError{v.violations}
+	}
+	return nil
+}
+
+// canonicalJSONValidator is a minimal JSON parser that records the paths of
+// values that aren't permitted in canonical JSON.
+type canonicalJSONValidator struct {
+	input      []byte
+	pos        int
+	violations []CanonicalJSONViolation
+	// The keys and indexes leading to the current value. These are only
+	// turned into a path string when a violation is recorded, since valid
+	// JSON is by far the most common case.
+	path []canonicalJSONPathElement
+}
+
+// A canonicalJSONPathElement is an object key, or an array index if index
+// isn't negative.
+type canonicalJSONPathElement struct {
+	key   string
+	index int
+}
+
+func (v *canonicalJSONValidator) syntaxError() error {
+	return fmt.Errorf("gomatrixserverlib: invalid JSON at offset %d", v.pos)
+}
+
+func (v *canonicalJSONValidator) violation(reason CanonicalJSONViolationReason) {
+	path := ""
+	for _, element := range v.path {
+		if element.index >= 0 {
+			path += "[" + strconv.Itoa(element.index) + "]"
+		} else {
+			path = joinCanonicalJSONPath(path, element.key)
+		}
+	}
+	v.violations = append(v.violations, CanonicalJSONViolation{path, reason})
+}
+
+func (v *canonicalJSONValidator) skipWhitespace() {
+	for v.pos < len(v.input) {
+		switch v.input[v.pos] {
+		case ' ', '\t', '\n', '\r':
+			v.pos++
+		default:
+			return
 		}
-		if value.Num < -9007199254740991 || value.Num > 9007199254740991 {
-			valid = false
-			return false
+	}
+}
+
+func (v *canonicalJSONValidator) value() error {
+	if v.pos >= len(v.input) {
+		return v.syntaxError()
+	}
+	switch c := v.input[v.pos]; {
+	case c == '{':
+		return v.object()
+	case c == '[':
+		return v.array()
+	case c == '"':
+		_, validUTF8, err := v.string()
+		if err == nil && !validUTF8 {
+			v.violation(CanonicalJSONInvalidUTF8)
 		}
-		if value.Num != 0 && strings.ContainsRune(value.Raw, '.') {
-			valid = false
-			return false
+		return err
+	case c == '-' || ('0' <= c && c <= '9'):
+		return v.number()
+	default:
+		for _, literal := range []string{"true", "false", "null"} {
+			if bytes.HasPrefix(v.input[v.pos:], []byte(literal)) {
+				v.pos += len(literal)
+				return nil
+			}
 		}
-		return true
+		return v.syntaxError()
 	}
-	res.ForEach(iter)
-	if !valid {
-		return ErrCanonicalJSON
+}
+
+func (v *canonicalJSONValidator) object() error {
+	v.pos++ // '{'
+	seen := map[string]bool{}
+	v.skipWhitespace()
+	if v.pos < len(v.input) && v.input[v.pos] == '}' {
+		v.pos++
+		return nil
+	}
+	for {
+		v.skipWhitespace()
+		if v.pos >= len(v.input) || v.input[v.pos] != '"' {
+			return v.syntaxError()
+		}
+		key, validUTF8, err := v.string()
+		if err != nil {
+			return err
+		}
+		v.path = append(v.path, canonicalJSONPathElement{key: key, index: -1})
+		if !validUTF8 {
+			v.violation(CanonicalJSONInvalidUTF8)
+		}
+		if seen[key] {
+			v.violation(CanonicalJSONDuplicateKey)
+		}
+		seen[key] = true
+		v.skipWhitespace()
+		if v.pos >= len(v.input) || v.input[v.pos] != ':' {
+			return v.syntaxError()
+		}
+		v.pos++
+		v.skipWhitespace()
+		if err = v.value(); err != nil {
+			return err
+		}
+		v.path = v.path[:len(v.path)-1]
+		v.skipWhitespace()
+		if v.pos >= len(v.input) {
+			return v.syntaxError()
+		}
+		switch v.input[v.pos] {
+		case ',':
+			v.pos++
+		case '}':
+			v.pos++
+			return nil
+		default:
+			return v.syntaxError()
+		}
+	}
+}
+
+func (v *canonicalJSONValidator) array() error {
+	v.pos++ // '['
+	v.skipWhitespace()
+	if v.pos < len(v.input) && v.input[v.pos] == ']' {
+		v.pos++
+		return nil
+	}
+	for i := 0; ; i++ {
+		v.skipWhitespace()
+		v.path = append(v.path, canonicalJSONPathElement{index: i})
+		if err := v.value(); err != nil {
+			return err
+		}
+		v.path = v.path[:len(v.path)-1]
+		v.skipWhitespace()
+		if v.pos >= len(v.input) {
+			return v.syntaxError()
+		}
+		switch v.input[v.pos] {
+		case ',':
+			v.pos++
+		case ']':
+			v.pos++
+			return nil
+		default:
+			return v.syntaxError()
+		}
+	}
+}
+
+// string parses a JSON string, returning its decoded value and whether it
+// was valid UTF-8.
+func (v *canonicalJSONValidator) string() (string, bool, error) {
+	start := v.pos
+	v.pos++ // '"'
+	escaped := false
+	for v.pos < len(v.input) {
+		switch c := v.input[v.pos]; {
+		case c == '\\':
+			escaped = true
+			v.pos += 2
+		case c == '"':
+			v.pos++
+			raw := v.input[start:v.pos]
+			validUTF8 := utf8.Valid(raw)
+			if !escaped {
+				return string(raw[1 : len(raw)-1]), validUTF8, nil
+			}
+			var decoded string
+			if err := json.Unmarshal(raw, &decoded); err != nil {
+				return "", false, v.syntaxError()
+			}
+			return decoded, validUTF8, nil
+		case c < ' ':
+			return "", false, v.syntaxError()
+		default:
+			v.pos++
+		}
+	}
+	return "", false, v.syntaxError()
+}
+
+// number parses a JSON number. Numbers are checked the same way as they
+// were before the violations were reported: a number is out of range if its
+// value is, and is a float if it has a fractional part written with a "."
+// and isn't zero. So 0.0 and 1e5 are allowed.
+func (v *canonicalJSONValidator) number() error {
+	start := v.pos
+	digits := func() int {
+		n := 0
+		for v.pos < len(v.input) && '0' <= v.input[v.pos] && v.input[v.pos] <= '9' {
+			v.pos++
+			n++
+		}
+		return n
+	}
+	if v.input[v.pos] == '-' {
+		v.pos++
+	}
+	intStart := v.pos
+	if n := digits(); n == 0 || (n > 1 && v.input[intStart] == '0') {
+		// Leading zeros aren't valid JSON.
+		return v.syntaxError()
+	}
+	isInteger, hasFraction := true, false
+	if v.pos < len(v.input) && v.input[v.pos] == '.' {
+		v.pos++
+		if digits() == 0 {
+			return v.syntaxError()
+		}
+		isInteger, hasFraction = false, true
+	}
+	if v.pos < len(v.input) && (v.input[v.pos] == 'e' || v.input[v.pos] == 'E') {
+		v.pos++
+		if v.pos < len(v.input) && (v.input[v.pos] == '+' || v.input[v.pos] == '-') {
+			v.pos++
+		}
+		if digits() == 0 {
+			return v.syntaxError()
+		}
+		isInteger = false
+	}
+	raw := string(v.input[start:v.pos])
+
+	if isInteger {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < minCanonicalJSONInt || n > maxCanonicalJSONInt {
+			v.violation(CanonicalJSONIntegerOutOfRange)
+		}
+		return nil
+	}
+	// Values too large for a float64 are returned as infinity with an error,
+	// which is out of range.
+	f, _ := strconv.ParseFloat(raw, 64)
+	switch {
+	case f < minCanonicalJSONInt || f > maxCanonicalJSONInt:
+		v.violation(CanonicalJSONIntegerOutOfRange)
+	case hasFraction && f != 0:
+		v.violation(CanonicalJSONFloat)
 	}
 	return nil
 }
 
+// joinCanonicalJSONPath appends an object key to a path, quoting the key if
+// it isn't a simple identifier.
+func joinCanonicalJSONPath(path, key string) string {
+	simple := key != ""
+	for _, c := range key {
+		if !(c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')) {
+			simple = false
+			break
+		}
+	}
+	if !simple {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
 // CanonicalJSONAssumeValid is the same as CanonicalJSON, but assumes the
 // input is valid JSON
 func CanonicalJSONAssumeValid(input []byte) []byte {
@@ -16,6 +16,10 @@
 package gomatrixserverlib
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
 	"testing"
 )
 
@@ -127,3 +131,201 @@ func TestReadHex(t *testing.T) {
 	testReadHex(t, "89ab", 0x89AB)
 	testReadHex(t, "cdef", 0xCDEF)
 }
+
+type canonicalTestEmbedded struct {
+	Shadowed string `json:"shadowed"`
+	Promoted int    `json:"promoted"`
+}
+
+type canonicalTestStruct struct {
+	canonicalTestEmbedded
+	Shadowed   string                 `json:"shadowed"`
+	Zebra      string                 `json:"zebra"`
+	Apple      []string               `json:"apple"`
+	Omitted    string                 `json:"omitted,omitempty"`
+	Ignored    string                 `json:"-"`
+	Untagged   bool                   // encoded as "Untagged"
+	Raw        RawJSON                `json:"raw"`
+	Bytes      Base64Bytes            `json:"bytes"`
+	Map        map[string]interface{} `json:"map"`
+	Pointer    *int64                 `json:"pointer"`
+	Quoted     int                    `json:"quoted,string"`
+	Unexported string
+	unexported string
+}
+
+func TestMarshalCanonicalJSON(t *testing.T) {
+	n := int64(-42)
+	inputs := []interface{}{
+		nil,
+		map[string]string{
+			"escapes": "a \"quoted\" \\ string with <html> & \u2028 and \x01 and é",
+			"invalid": "invalid utf-8 \xff",
+		},
+		[]interface{}{1, "two", 3.5, true, nil},
+		map[string]int{"b": 2, "a": 1, "é": 3, "Z": 0},
+		map[ServerName]map[KeyID]Base64Bytes{
+			"example.com": {"ed25519:b": Base64Bytes("b"), "ed25519:a": Base64Bytes("a")},
+		},
+		[]byte("bytes"),
+		canonicalTestStruct{
+			canonicalTestEmbedded: canonicalTestEmbedded{"hidden", 7},
+			Shadowed:              "visible",
+			Zebra:                 "z",
+			Apple:                 []string{"a", "b"},
+			Ignored:               "ignored",
+			Untagged:              true,
+			Raw:                   RawJSON(`{ "z": 1, "a": [ "A", "\/" ] }`),
+			Bytes:                 Base64Bytes("hello"),
+			Map:                   map[string]interface{}{"y": map[string]int{"d": 4, "c": 3}, "x": []int{}},
+			Pointer:               &n,
+			Quoted:                12,
+			unexported:            "unexported",
+		},
+		&EventReference{EventID: "$event:example.com", EventSHA256: Base64Bytes("hash")},
+		ServerKeys{},
+	}
+	for _, input := range inputs {
+		unsorted, err := json.Marshal(input)
+		if err != nil {
+			t.Fatalf("json.Marshal(%#v): %s", input, err)
+		}
+		want, err := CanonicalJSON(unsorted)
+		if err != nil {
+			t.Fatalf("CanonicalJSON(%s): %s", unsorted, err)
+		}
+		got, err := MarshalCanonicalJSON(input)
+		if err != nil {
+			t.Fatalf("MarshalCanonicalJSON(%#v): %s", input, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("MarshalCanonicalJSON(%#v):\nwant %s\n got %s", input, want, got)
+		}
+	}
+}
+
+func TestMarshalCanonicalJSONIntegerRanges(t *testing.T) {
+	if _, err := MarshalCanonicalJSON(map[string]int64{"ok": 9007199254740991}); err != nil {
+		t.Errorf("should be valid: %s", err)
+	}
+	if _, err := MarshalCanonicalJSON(map[string]int64{"bad": -9007199254740992}); !errors.Is(err, ErrCanonicalJSON) {
+		t.Errorf("want ErrCanonicalJSON, got %v", err)
+	}
+	if _, err := MarshalCanonicalJSON([]uint64{9007199254740992}); !errors.Is(err, ErrCanonicalJSON) {
+		t.Errorf("want ErrCanonicalJSON, got %v", err)
+	}
+}
+
+// benchmarkCanonicalJSONInput is representative of the request and event
+// structures that are signed.
+func benchmarkCanonicalJSONInput() interface{} {
+	stateKey := "@alice:example.com"
+	return struct {
+		EventBuilder
+		OriginServerTS Timestamp  `json:"origin_server_ts"`
+		Origin         ServerName `json:"origin"`
+	}{
+		EventBuilder: EventBuilder{
+			Sender:     "@alice:example.com",
+			RoomID:     "!room:example.com",
+			Type:       "m.room.member",
+			StateKey:   &stateKey,
+			PrevEvents: []string{"$prev1:example.com", "$prev2:example.com"},
+			AuthEvents: []string{"$create:example.com", "$power:example.com", "$join_rules:example.com"},
+			Depth:      12345,
+			Content:    RawJSON(`{"membership":"join","displayname":"Alice","avatar_url":"mxc://example.com/abcdef"}`),
+		},
+		OriginServerTS: 1593000000000,
+		Origin:         "example.com",
+	}
+}
+
+func BenchmarkCanonicalJSONFromMarshal(b *testing.B) {
+	input := benchmarkCanonicalJSONInput()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		unsorted, err := json.Marshal(input)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = CanonicalJSON(unsorted); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshalCanonicalJSON(b *testing.B) {
+	input := benchmarkCanonicalJSONInput()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := MarshalCanonicalJSON(input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEnforcedCanonicalJSONViolations(t *testing.T) {
+	input := "{\"content\": {\"body\": 1.5, \"list\": [1, 9007199254740992, 100000000000000000000], \"m.key\": \"\xff\"}, \"dup\": 1, \"dup\": 2}"
+	_, err := EnforcedCanonicalJSON([]byte(input), RoomVersionV6)
+	if !errors.Is(err, ErrCanonicalJSON) {
+		t.Fatalf("want ErrCanonicalJSON, got %v", err)
+	}
+	var badJSON BadJSONError
+	if !errors.As(err, &badJSON) {
+		t.Fatalf("want BadJSONError, got %T", err)
+	}
+	var canonicalErr CanonicalJSONError
+	if !errors.As(err, &canonicalErr) {
+		t.Fatalf("want CanonicalJSONError, got %T", err)
+	}
+	want := []CanonicalJSONViolation{
+		{`content.body`, CanonicalJSONFloat},
+		{`content.list[1]`, CanonicalJSONIntegerOutOfRange},
+		{`content.list[2]`, CanonicalJSONIntegerOutOfRange},
+		{`content["m.key"]`, CanonicalJSONInvalidUTF8},
+		{`dup`, CanonicalJSONDuplicateKey},
+	}
+	if !reflect.DeepEqual(canonicalErr.Violations, want) {
+		t.Errorf("wrong violations:\nwant %v\n got %v", want, canonicalErr.Violations)
+	}
+
+	if _, err = EnforcedCanonicalJSON([]byte(`{"foo": [1, {"bar": "baz"}], "x": -9007199254740991}`), RoomVersionV6); err != nil {
+		t.Errorf("should be valid: %s", err)
+	}
+	if _, err = EnforcedCanonicalJSON([]byte(`{"foo": 1,}`), RoomVersionV6); err == nil || errors.Is(err, ErrCanonicalJSON) {
+		t.Errorf("want a syntax error, got %v", err)
+	}
+}
+
+func TestEnforcedCanonicalJSONNumbers(t *testing.T) {
+	// These were accepted before violations were reported, so events that
+	// other servers accepted must still be accepted.
+	for _, input := range []string{`{"a": 0.0}`, `{"a": -0.0}`, `{"a": 1e5}`, `{"a": 1E+2}`, `[0, -1, 9007199254740991]`} {
+		if _, err := EnforcedCanonicalJSON([]byte(input), RoomVersionV6); err != nil {
+			t.Errorf("%s should be valid: %v", input, err)
+		}
+	}
+	for _, input := range []string{`{"a": 1.0}`, `{"a": 1.5e3}`, `{"a": 1e16}`, `{"a": 1e400}`} {
+		if _, err := EnforcedCanonicalJSON([]byte(input), RoomVersionV6); !errors.Is(err, ErrCanonicalJSON) {
+			t.Errorf("%s should be invalid, got %v", input, err)
+		}
+	}
+	for _, input := range []string{`{"a": 01}`, `{"a": -01}`, `{"a": 1.}`, `{"a": 1e}`, `{"a": -}`} {
+		if _, err := EnforcedCanonicalJSON([]byte(input), RoomVersionV6); err == nil || errors.Is(err, ErrCanonicalJSON) {
+			t.Errorf("%s: want a syntax error, got %v", input, err)
+		}
+	}
+}
+
+func TestEnforcedCanonicalJSONInvalidUTF8KeyPath(t *testing.T) {
+	input := "{\"content\": {\"\xff\": 1}}"
+	_, err := EnforcedCanonicalJSON([]byte(input), RoomVersionV6)
+	var canonicalErr CanonicalJSONError
+	if !errors.As(err, &canonicalErr) {
+		t.Fatalf("want CanonicalJSONError, got %v", err)
+	}
+	want := []CanonicalJSONViolation{{`content["\xff"]`, CanonicalJSONInvalidUTF8}}
+	if !reflect.DeepEqual(canonicalErr.Violations, want) {
+		t.Errorf("want violations %v, got %v", want, canonicalErr.Violations)
+	}
+}
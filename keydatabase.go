@@ -0,0 +1,382 @@
+package gomatrixserverlib
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// betterPublicKeyLookupResult decides which of two results for the same key
+// a KeyDatabase should keep. Once a key has expired it stays expired, and
+// otherwise the result that is valid for longer wins.
+// Returns true if candidate should replace existing.
+func betterPublicKeyLookupResult(existing, candidate PublicKeyLookupResult) bool {
+	if existing.ExpiredTS != PublicKeyNotExpired {
+		return candidate.ExpiredTS != PublicKeyNotExpired
+	}
+	if candidate.ExpiredTS != PublicKeyNotExpired {
+		return true
+	}
+	return candidate.ValidUntilTS >= existing.ValidUntilTS
+}
+
+// A MemoryKeyDatabase is a KeyDatabase which holds keys in memory.
+// It holds at most a fixed number of keys, evicting the least recently used
+// key when full.
+type MemoryKeyDatabase struct {
+	mutex      sync.Mutex
+	maxEntries int
+	order      *list.List // of *memoryKeyDatabaseEntry, most recently used first
+	entries    map[PublicKeyLookupRequest]*list.Element
+}
+
+type memoryKeyDatabaseEntry struct {
+	request PublicKeyLookupRequest
+	result  PublicKeyLookupResult
+}
+
+// NewMemoryKeyDatabase creates a MemoryKeyDatabase holding up to maxEntries
+// keys. If maxEntries is zero or less then the database is unbounded.
+func NewMemoryKeyDatabase(maxEntries int) *MemoryKeyDatabase {
+	return &MemoryKeyDatabase{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[PublicKeyLookupRequest]*list.Element{},
+	}
+}
+
+// FetcherName implements KeyFetcher
+func (d *MemoryKeyDatabase) FetcherName() string {
+	return "MemoryKeyDatabase"
+}
+
+// FetchKeys implements KeyFetcher
+func (d *MemoryKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		if element, ok := d.entries[req]; ok {
+			d.order.MoveToFront(element)
+			results[req] = element.Value.(*memoryKeyDatabaseEntry).result
+		}
+	}
+	return results, nil
+}
+
+// StoreKeys implements KeyDatabase
+func (d *MemoryKeyDatabase) StoreKeys(
+	ctx context.Context, results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for req, res := range results {
+		d.store(req, res)
+	}
+	return nil
+}
+
+// better returns true if storing the key would replace or add to what the
+// database holds. The caller must hold the mutex.
+func (d *MemoryKeyDatabase) better(req PublicKeyLookupRequest, res PublicKeyLookupResult) bool {
+	element, ok := d.entries[req]
+	return !ok || betterPublicKeyLookupResult(element.Value.(*memoryKeyDatabaseEntry).result, res)
+}
+
+// store adds or updates a single key. The caller must hold the mutex.
+// Returns false if the existing key was better and was kept instead.
+func (d *MemoryKeyDatabase) store(req PublicKeyLookupRequest, res PublicKeyLookupResult) bool {
+	if element, ok := d.entries[req]; ok {
+		d.order.MoveToFront(element)
+		entry := element.Value.(*memoryKeyDatabaseEntry)
+		if !betterPublicKeyLookupResult(entry.result, res) {
+			return false
+		}
+		entry.result = res
+		return true
+	}
+	d.entries[req] = d.order.PushFront(&memoryKeyDatabaseEntry{req, res})
+	for d.maxEntries > 0 && d.order.Len() > d.maxEntries {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(*memoryKeyDatabaseEntry).request)
+	}
+	return true
+}
+
+// Len returns the number of keys in the database.
+func (d *MemoryKeyDatabase) Len() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.order.Len()
+}
+
+// A FileKeyDatabase is a KeyDatabase which keeps keys in memory and persists
+// them to an append-only log of JSON records, one per line. The log is
+// replayed when the database is opened and is compacted once it holds
+// enough superseded records.
+type FileKeyDatabase struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	keys    *MemoryKeyDatabase
+	records int   // The number of records in the log file.
+	size    int64 // The length of the log file up to the last complete record.
+}
+
+// The log is compacted once it holds this many times more records than keys.
+const fileKeyDatabaseCompactionRatio = 2
+
+// Logs with fewer records than this are never compacted automatically.
+const fileKeyDatabaseMinCompaction = 1024
+
+type fileKeyDatabaseRecord struct {
+	Request PublicKeyLookupRequest `json:"request"`
+	Result  PublicKeyLookupResult  `json:"result"`
+}
+
+// NewFileKeyDatabase opens the key log at the given path, creating it if it
+// doesn't exist.
+// Returns an error if the log couldn't be opened or is corrupt. A truncated
+// final record, e.g. from a crash while writing, is ignored.
+func NewFileKeyDatabase(path string) (*FileKeyDatabase, error) {
+	d := &FileKeyDatabase{
+		path: path,
+		keys: NewMemoryKeyDatabase(0),
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := d.replay(file)
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+	// Drop anything after the last complete record so that new records are
+	// appended cleanly.
+	if err = file.Truncate(offset); err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close() // nolint: errcheck
+		return nil, err
+	}
+	d.file = file
+	d.size = offset
+	return d, nil
+}
+
+// replay loads the records from the log into memory.
+// Returns the offset of the end of the last complete record.
+func (d *FileKeyDatabase) replay(file *os.File) (int64, error) {
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Either the end of the log or a truncated final record.
+			return offset, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var record fileKeyDatabaseRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			return 0, fmt.Errorf("gomatrixserverlib: corrupt key log %q at offset %d: %w", d.path, offset, err)
+		}
+		d.keys.store(record.Request, record.Result)
+		d.records++
+		offset += int64(len(line))
+	}
+}
+
+// FetcherName implements KeyFetcher
+func (d *FileKeyDatabase) FetcherName() string {
+	return "FileKeyDatabase"
+}
+
+// FetchKeys implements KeyFetcher
+func (d *FileKeyDatabase) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	return d.keys.FetchKeys(ctx, requests)
+}
+
+// StoreKeys implements KeyDatabase
+func (d *FileKeyDatabase) StoreKeys(
+	ctx context.Context, results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.file == nil {
+		return fmt.Errorf("gomatrixserverlib: key database %q is closed", d.path)
+	}
+
+	// The keys in memory are only changed by StoreKeys while holding
+	// d.mutex, so the keys that are better than what we have can be worked
+	// out before writing them.
+	var buffer []byte
+	stored := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	d.keys.mutex.Lock()
+	for req, res := range results {
+		if !d.keys.better(req, res) {
+			// We already have a better copy of this key.
+			continue
+		}
+		line, err := json.Marshal(fileKeyDatabaseRecord{req, res})
+		if err != nil {
+			d.keys.mutex.Unlock()
+			return err
+		}
+		buffer = append(append(buffer, line...), '\n')
+		stored[req] = res
+	}
+	d.keys.mutex.Unlock()
+
+	if len(buffer) == 0 {
+		return nil
+	}
+	// Write the keys to the log before storing them in memory, so that the
+	// two agree if writing fails.
+	if err := d.appendRecords(buffer); err != nil {
+		return err
+	}
+	d.keys.mutex.Lock()
+	for req, res := range stored {
+		d.keys.store(req, res)
+	}
+	d.keys.mutex.Unlock()
+	d.records += len(stored)
+
+	if d.records >= fileKeyDatabaseMinCompaction && d.records > fileKeyDatabaseCompactionRatio*d.keys.Len() {
+		return d.compact()
+	}
+	return nil
+}
+
+// appendRecords writes the records to the end of the log and syncs it. If
+// that fails then the log is truncated back to the end of the last complete
+// record, so that later records aren't appended to a partial one. If even
+// that fails then the database is closed. The caller must hold the mutex.
+func (d *FileKeyDatabase) appendRecords(buffer []byte) error {
+	_, err := d.file.Write(buffer)
+	if err == nil {
+		err = d.file.Sync()
+	}
+	if err == nil {
+		d.size += int64(len(buffer))
+		return nil
+	}
+	if truncateErr := d.file.Truncate(d.size); truncateErr != nil {
+		d.file.Close() // nolint: errcheck
+		d.file = nil
+		return fmt.Errorf("gomatrixserverlib: failed to write key log %q (%s), closing it after failing to truncate it: %w", d.path, err, truncateErr)
+	}
+	if _, seekErr := d.file.Seek(d.size, io.SeekStart); seekErr != nil {
+		d.file.Close() // nolint: errcheck
+		d.file = nil
+		return fmt.Errorf("gomatrixserverlib: failed to write key log %q (%s), closing it after failing to seek in it: %w", d.path, err, seekErr)
+	}
+	return err
+}
+
+// Len returns the number of keys in the database.
+func (d *FileKeyDatabase) Len() int {
+	return d.keys.Len()
+}
+
+// Compact rewrites the log so that it only holds the current copy of each key.
+func (d *FileKeyDatabase) Compact() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.file == nil {
+		return fmt.Errorf("gomatrixserverlib: key database %q is closed", d.path)
+	}
+	return d.compact()
+}
+
+// compact rewrites the log to a temporary file and then atomically replaces
+// the log with it. The caller must hold the mutex.
+func (d *FileKeyDatabase) compact() error {
+	tmpPath := d.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	records := 0
+	var size int64
+
+	d.keys.mutex.Lock()
+	for element := d.keys.order.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*memoryKeyDatabaseEntry)
+		var line []byte
+		if line, err = json.Marshal(fileKeyDatabaseRecord{entry.request, entry.result}); err != nil {
+			break
+		}
+		if _, err = writer.Write(append(line, '\n')); err != nil {
+			break
+		}
+		records++
+		size += int64(len(line)) + 1
+	}
+	d.keys.mutex.Unlock()
+
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, d.path)
+	}
+	if err != nil {
+		tmp.Close()        // nolint: errcheck
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+
+	d.file.Close() // nolint: errcheck
+	d.file = tmp
+	d.records = records
+	d.size = size
+	// The rename isn't durable until the directory holding the log has been
+	// synced, so a crash could otherwise leave the old log in place.
+	return syncDir(filepath.Dir(d.path))
+}
+
+// syncDir flushes the directory's entries to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Close closes the log file. The database can't be written to afterwards.
+func (d *FileKeyDatabase) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
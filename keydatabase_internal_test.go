@@ -0,0 +1,68 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileKeyDatabaseFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keydatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	path := filepath.Join(dir, "keys.log")
+	db, err := NewFileKeyDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+
+	a := PublicKeyLookupRequest{ServerName: "a.server", KeyID: "ed25519:1"}
+	b := PublicKeyLookupRequest{ServerName: "b.server", KeyID: "ed25519:1"}
+	store := func(req PublicKeyLookupRequest) error {
+		return db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			req: {ValidUntilTS: 1000},
+		})
+	}
+	if err = store(a); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make writing to the log fail.
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mutex.Lock()
+	db.file.Close() // nolint: errcheck
+	db.file = readOnly
+	db.mutex.Unlock()
+
+	if err = store(b); err == nil {
+		t.Fatal("expected an error writing to a read-only log")
+	}
+	results, err := db.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{a: 0, b: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results[a]; !ok {
+		t.Error("a.server was lost")
+	}
+	if _, ok := results[b]; ok {
+		t.Error("b.server was stored in memory despite failing to be written")
+	}
+
+	// The log must still be readable.
+	reopened, err := NewFileKeyDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close() // nolint: errcheck
+	if reopened.keys.Len() != 1 {
+		t.Errorf("expected 1 key in the log, got %d", reopened.keys.Len())
+	}
+}
@@ -0,0 +1,168 @@
+package gomatrixserverlib_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/keydbtest"
+)
+
+func tempKeyLogPath(t *testing.T, parent string) string {
+	dir, err := ioutil.TempDir(parent, "keydatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "keys.log")
+}
+
+func TestMemoryKeyDatabaseConformance(t *testing.T) {
+	keydbtest.RunConformanceTests(t, func(t *testing.T) gomatrixserverlib.KeyDatabase {
+		return gomatrixserverlib.NewMemoryKeyDatabase(1000)
+	})
+}
+
+func TestFileKeyDatabaseConformance(t *testing.T) {
+	parent, err := ioutil.TempDir("", "keydatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent) // nolint: errcheck
+	var databases []*gomatrixserverlib.FileKeyDatabase
+	defer func() {
+		for _, db := range databases {
+			db.Close() // nolint: errcheck
+		}
+	}()
+	keydbtest.RunConformanceTests(t, func(t *testing.T) gomatrixserverlib.KeyDatabase {
+		db, err := gomatrixserverlib.NewFileKeyDatabase(tempKeyLogPath(t, parent))
+		if err != nil {
+			t.Fatal(err)
+		}
+		databases = append(databases, db)
+		return db
+	})
+}
+
+func storeTestKey(t *testing.T, db gomatrixserverlib.KeyDatabase, server string, validUntil gomatrixserverlib.Timestamp) {
+	err := db.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		{ServerName: gomatrixserverlib.ServerName(server), KeyID: "ed25519:1"}: {
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes(server)},
+			ValidUntilTS: validUntil,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fetchTestKey(t *testing.T, db gomatrixserverlib.KeyDatabase, server string) (gomatrixserverlib.PublicKeyLookupResult, bool) {
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: gomatrixserverlib.ServerName(server), KeyID: "ed25519:1"}
+	results, err := db.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{req: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := results[req]
+	return res, ok
+}
+
+func TestMemoryKeyDatabaseEvictsLeastRecentlyUsed(t *testing.T) {
+	db := gomatrixserverlib.NewMemoryKeyDatabase(2)
+	storeTestKey(t, db, "a.server", 1000)
+	storeTestKey(t, db, "b.server", 1000)
+	// Use a.server so that b.server is the least recently used.
+	if _, ok := fetchTestKey(t, db, "a.server"); !ok {
+		t.Fatal("a.server should be cached")
+	}
+	storeTestKey(t, db, "c.server", 1000)
+
+	if _, ok := fetchTestKey(t, db, "b.server"); ok {
+		t.Error("b.server should have been evicted")
+	}
+	for _, server := range []string{"a.server", "c.server"} {
+		if _, ok := fetchTestKey(t, db, server); !ok {
+			t.Errorf("%s should still be cached", server)
+		}
+	}
+}
+
+func TestMemoryKeyDatabaseKeepsLongestValidity(t *testing.T) {
+	db := gomatrixserverlib.NewMemoryKeyDatabase(0)
+	storeTestKey(t, db, "a.server", 2000)
+	storeTestKey(t, db, "a.server", 1000)
+	if res, _ := fetchTestKey(t, db, "a.server"); res.ValidUntilTS != 2000 {
+		t.Errorf("a stale result replaced a fresher one: got valid_until_ts %d", res.ValidUntilTS)
+	}
+}
+
+func TestFileKeyDatabasePersistence(t *testing.T) {
+	parent, err := ioutil.TempDir("", "keydatabase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent) // nolint: errcheck
+	path := tempKeyLogPath(t, parent)
+	db, err := gomatrixserverlib.NewFileKeyDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeTestKey(t, db, "a.server", 1000)
+	storeTestKey(t, db, "a.server", 2000)
+	storeTestKey(t, db, "b.server", 1000)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash part way through writing a record.
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteString(`{"request":"c.server/ed25519:1","res`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close() // nolint: errcheck
+
+	db, err = gomatrixserverlib.NewFileKeyDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close() // nolint: errcheck
+	if res, ok := fetchTestKey(t, db, "a.server"); !ok || res.ValidUntilTS != 2000 {
+		t.Errorf("a.server wasn't restored: %v %#v", ok, res)
+	}
+	if _, ok := fetchTestKey(t, db, "b.server"); !ok {
+		t.Error("b.server wasn't restored")
+	}
+	if _, ok := fetchTestKey(t, db, "c.server"); ok {
+		t.Error("c.server was restored from a truncated record")
+	}
+
+	// Records appended after reopening must still be readable.
+	storeTestKey(t, db, "c.server", 1000)
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(contents), "\n"); lines != 3 {
+		t.Errorf("expected 3 records after compaction, got %d:\n%s", lines, contents)
+	}
+
+	reopened, err := gomatrixserverlib.NewFileKeyDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close() // nolint: errcheck
+	for _, server := range []string{"a.server", "b.server", "c.server"} {
+		if _, ok := fetchTestKey(t, reopened, server); !ok {
+			t.Errorf("%s wasn't restored after compaction", server)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package keydbtest provides a conformance test suite for implementations of
+// gomatrixserverlib.KeyDatabase.
+package keydbtest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// RunConformanceTests runs the KeyDatabase conformance tests against
+// databases created by newDatabase. Each test calls newDatabase to get a
+// fresh, empty database.
+func RunConformanceTests(t *testing.T, newDatabase func(t *testing.T) gomatrixserverlib.KeyDatabase) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, db gomatrixserverlib.KeyDatabase)
+	}{
+		{"EmptyDatabase", testEmptyDatabase},
+		{"StoreAndFetch", testStoreAndFetch},
+		{"UpdateValidity", testUpdateValidity},
+		{"ExpireKey", testExpireKey},
+		{"Concurrent", testConcurrent},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newDatabase(t))
+		})
+	}
+}
+
+func testRequest(server string, keyID string) gomatrixserverlib.PublicKeyLookupRequest {
+	return gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: gomatrixserverlib.ServerName(server),
+		KeyID:      gomatrixserverlib.KeyID(keyID),
+	}
+}
+
+func testResult(key string, validUntil, expired gomatrixserverlib.Timestamp) gomatrixserverlib.PublicKeyLookupResult {
+	return gomatrixserverlib.PublicKeyLookupResult{
+		VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes(key)},
+		ValidUntilTS: validUntil,
+		ExpiredTS:    expired,
+	}
+}
+
+// fetch fetches the requested keys, failing the test on error and checking
+// that only the requested keys with results are returned.
+func fetch(
+	t *testing.T, db gomatrixserverlib.KeyDatabase, requests ...gomatrixserverlib.PublicKeyLookupRequest,
+) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+	t.Helper()
+	query := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+	for _, req := range requests {
+		query[req] = 1000
+	}
+	results, err := db.FetchKeys(context.Background(), query)
+	if err != nil {
+		t.Fatalf("FetchKeys failed: %s", err)
+	}
+	return results
+}
+
+func store(
+	t *testing.T, db gomatrixserverlib.KeyDatabase,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	t.Helper()
+	if err := db.StoreKeys(context.Background(), results); err != nil {
+		t.Fatalf("StoreKeys failed: %s", err)
+	}
+}
+
+func testEmptyDatabase(t *testing.T, db gomatrixserverlib.KeyDatabase) {
+	if results := fetch(t, db, testRequest("a.server", "ed25519:1")); len(results) != 0 {
+		t.Errorf("expected no results from an empty database, got %v", results)
+	}
+}
+
+func testStoreAndFetch(t *testing.T, db gomatrixserverlib.KeyDatabase) {
+	reqA := testRequest("a.server", "ed25519:1")
+	reqB := testRequest("b.server", "ed25519:1")
+	reqOld := testRequest("a.server", "ed25519:old")
+	want := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		reqA:   testResult("key A", 2000, gomatrixserverlib.PublicKeyNotExpired),
+		reqB:   testResult("key B", 3000, gomatrixserverlib.PublicKeyNotExpired),
+		reqOld: testResult("old key", gomatrixserverlib.PublicKeyNotValid, 500),
+	}
+	store(t, db, want)
+
+	results := fetch(t, db, reqA, reqB, reqOld, testRequest("c.server", "ed25519:1"))
+	for req, res := range want {
+		if !reflect.DeepEqual(results[req], res) {
+			t.Errorf("wrong result for %v: want %#v, got %#v", req, res, results[req])
+		}
+	}
+	if _, ok := results[testRequest("c.server", "ed25519:1")]; ok {
+		t.Errorf("got a result for a key that was never stored")
+	}
+}
+
+func testUpdateValidity(t *testing.T, db gomatrixserverlib.KeyDatabase) {
+	req := testRequest("a.server", "ed25519:1")
+	store(t, db, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: testResult("key", 2000, gomatrixserverlib.PublicKeyNotExpired),
+	})
+	want := testResult("key", 4000, gomatrixserverlib.PublicKeyNotExpired)
+	store(t, db, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: want,
+	})
+	if got := fetch(t, db, req)[req]; !reflect.DeepEqual(got, want) {
+		t.Errorf("key wasn't updated: want %#v, got %#v", want, got)
+	}
+}
+
+func testExpireKey(t *testing.T, db gomatrixserverlib.KeyDatabase) {
+	req := testRequest("a.server", "ed25519:1")
+	store(t, db, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: testResult("key", 2000, gomatrixserverlib.PublicKeyNotExpired),
+	})
+	want := testResult("key", gomatrixserverlib.PublicKeyNotValid, 1500)
+	store(t, db, map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: want,
+	})
+	if got := fetch(t, db, req)[req]; !reflect.DeepEqual(got, want) {
+		t.Errorf("key wasn't expired: want %#v, got %#v", want, got)
+	}
+}
+
+func testConcurrent(t *testing.T, db gomatrixserverlib.KeyDatabase) {
+	const workers = 8
+	const keysPerWorker = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWorker; i++ {
+				req := testRequest(fmt.Sprintf("server%d", w), fmt.Sprintf("ed25519:%d", i))
+				res := testResult(fmt.Sprintf("key %d %d", w, i), 2000, gomatrixserverlib.PublicKeyNotExpired)
+				err := db.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+					req: res,
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				got, err := db.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+					req: 1000,
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(got[req], res) {
+					errs <- fmt.Errorf("wrong result for %v: want %#v, got %#v", req, res, got[req])
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,267 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The default period that our published keys are valid for.
+const defaultKeyValidityPeriod = 24 * time.Hour
+
+// The characters used in generated key versions.
+const keyVersionAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// A SigningKey is one of our server's ed25519 signing keys.
+type SigningKey struct {
+	KeyID      KeyID
+	PrivateKey ed25519.PrivateKey
+}
+
+// An OldSigningKey is one of our server's signing keys that has been rotated
+// out. Only the public key is kept so that other servers can still check
+// the events that it signed.
+type OldSigningKey struct {
+	KeyID     KeyID
+	PublicKey ed25519.PublicKey
+	// When the key stopped being used for signing.
+	ExpiredTS Timestamp
+}
+
+// SigningKeys are all of our server's signing keys.
+type SigningKeys struct {
+	// The key that we currently sign with.
+	Current SigningKey
+	// The keys that we used to sign with.
+	Old []OldSigningKey
+}
+
+// A SigningKeyStore persists our server's signing keys.
+// Implementations must be safe for concurrent use.
+type SigningKeyStore interface {
+	// LoadSigningKeys returns the stored keys, or nil if no keys have been
+	// stored yet.
+	LoadSigningKeys(ctx context.Context) (*SigningKeys, error)
+	// StoreSigningKeys replaces the stored keys.
+	StoreSigningKeys(ctx context.Context, keys SigningKeys) error
+}
+
+// GenerateSigningKey generates a new ed25519 signing key with a random key ID.
+func GenerateSigningKey() (SigningKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	version := make([]byte, 6)
+	max := big.NewInt(int64(len(keyVersionAlphabet)))
+	for i := range version {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		version[i] = keyVersionAlphabet[n.Int64()]
+	}
+	return SigningKey{
+		KeyID:      KeyID("ed25519:" + string(version)),
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// A KeyManager owns our server's signing keys. It publishes them to other
+// servers on /_matrix/key/v2/server and rotates them.
+type KeyManager struct {
+	// The name of our server.
+	ServerName ServerName
+	// Where the keys are persisted.
+	Store SigningKeyStore
+	// How long other servers can cache our published keys for.
+	ValidityPeriod time.Duration
+
+	mutex sync.RWMutex
+	keys  SigningKeys
+}
+
+// NewKeyManager creates a KeyManager for our server, loading the keys from
+// the store or generating and storing a new key if there aren't any.
+// If the validity period is zero then a default of one day is used.
+func NewKeyManager(
+	ctx context.Context, serverName ServerName, store SigningKeyStore, validityPeriod time.Duration,
+) (*KeyManager, error) {
+	if validityPeriod == 0 {
+		validityPeriod = defaultKeyValidityPeriod
+	}
+	m := &KeyManager{
+		ServerName:     serverName,
+		Store:          store,
+		ValidityPeriod: validityPeriod,
+	}
+	keys, err := store.LoadSigningKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		m.keys = *keys
+		return m, nil
+	}
+	current, err := GenerateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	m.keys = SigningKeys{Current: current}
+	if err = store.StoreSigningKeys(ctx, m.keys); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Signer returns a Signer which always uses the current key, so it switches
+// to the new key when the keys are rotated.
+func (m *KeyManager) Signer() Signer {
+	return keyManagerSigner{m}
+}
+
+// keyManagerSigner is a Signer for the current key of a KeyManager.
+type keyManagerSigner struct {
+	m *KeyManager
+}
+
+func (s keyManagerSigner) current() SigningKey {
+	s.m.mutex.RLock()
+	defer s.m.mutex.RUnlock()
+	return s.m.keys.Current
+}
+
+// KeyID implements Signer
+func (s keyManagerSigner) KeyID() KeyID {
+	return s.current().KeyID
+}
+
+// PublicKey implements Signer
+func (s keyManagerSigner) PublicKey() ed25519.PublicKey {
+	return s.current().PrivateKey.Public().(ed25519.PublicKey)
+}
+
+// Sign implements Signer
+func (s keyManagerSigner) Sign(message []byte) (KeyID, []byte, error) {
+	// The key ID and signature come from the same key even if the keys are
+	// rotated meanwhile.
+	key := s.current()
+	return key.KeyID, ed25519.Sign(key.PrivateKey, message), nil
+}
+
+// SigningKeys returns a copy of all of our keys.
+func (m *KeyManager) SigningKeys() SigningKeys {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	keys := m.keys
+	keys.Old = append([]OldSigningKey(nil), m.keys.Old...)
+	return keys
+}
+
+// Rotate generates a new key to sign with. The current key is moved to the
+// old keys, expiring at the given time.
+func (m *KeyManager) Rotate(ctx context.Context, now time.Time) (SigningKey, error) {
+	current, err := GenerateSigningKey()
+	if err != nil {
+		return SigningKey{}, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := SigningKeys{
+		Current: current,
+		Old: append(append([]OldSigningKey(nil), m.keys.Old...), OldSigningKey{
+			KeyID:     m.keys.Current.KeyID,
+			PublicKey: m.keys.Current.PrivateKey.Public().(ed25519.PublicKey),
+			ExpiredTS: AsTimestamp(now),
+		}),
+	}
+	if err = m.Store.StoreSigningKeys(ctx, keys); err != nil {
+		return SigningKey{}, err
+	}
+	m.keys = keys
+	return current, nil
+}
+
+// ServerKeys returns the signed document that we publish on
+// /_matrix/key/v2/server, which is valid for the validity period from now.
+func (m *KeyManager) ServerKeys(now time.Time) (ServerKeys, error) {
+	m.mutex.RLock()
+	current := m.keys.Current
+	fields := ServerKeyFields{
+		ServerName: m.ServerName,
+		VerifyKeys: map[KeyID]VerifyKey{
+			current.KeyID: {Key: Base64Bytes(current.PrivateKey.Public().(ed25519.PublicKey))},
+		},
+		ValidUntilTS:  AsTimestamp(now.Add(m.ValidityPeriod)),
+		OldVerifyKeys: map[KeyID]OldVerifyKey{},
+	}
+	for _, old := range m.keys.Old {
+		fields.OldVerifyKeys[old.KeyID] = OldVerifyKey{
+			VerifyKey: VerifyKey{Key: Base64Bytes(old.PublicKey)},
+			ExpiredTS: old.ExpiredTS,
+		}
+	}
+	m.mutex.RUnlock()
+
+	unsigned, err := json.Marshal(fields)
+	if err != nil {
+		return ServerKeys{}, err
+	}
+	signed, err := SignJSON(string(m.ServerName), current.KeyID, current.PrivateKey, unsigned)
+	if err != nil {
+		return ServerKeys{}, err
+	}
+	var keys ServerKeys
+	err = json.Unmarshal(signed, &keys)
+	return keys, err
+}
+
+// OnServerKeysRequest handles a GET to /_matrix/key/v2/server, and to the
+// deprecated /_matrix/key/v2/server/{keyID} which returns the same document.
+// https://matrix.org/docs/spec/server_server/r0.1.3#get-matrix-key-v2-server-keyid
+func (m *KeyManager) OnServerKeysRequest(req *http.Request, now time.Time) util.JSONResponse {
+	if req.Method != http.MethodGet {
+		return util.MatrixErrorResponse(405, "M_UNRECOGNIZED", "Method not allowed")
+	}
+	keys, err := m.ServerKeys(now)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to sign server keys")
+		return util.MessageResponse(500, "Internal Server Error")
+	}
+	return util.JSONResponse{Code: 200, JSON: keys}
+}
+
+// MemorySigningKeyStore is an in-memory implementation of SigningKeyStore,
+// mostly useful for tests. The zero value is ready to use.
+type MemorySigningKeyStore struct {
+	mutex sync.Mutex
+	keys  *SigningKeys
+}
+
+// LoadSigningKeys implements SigningKeyStore
+func (s *MemorySigningKeyStore) LoadSigningKeys(ctx context.Context) (*SigningKeys, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.keys == nil {
+		return nil, nil
+	}
+	keys := *s.keys
+	keys.Old = append([]OldSigningKey(nil), s.keys.Old...)
+	return &keys, nil
+}
+
+// StoreSigningKeys implements SigningKeyStore
+func (s *MemorySigningKeyStore) StoreSigningKeys(ctx context.Context, keys SigningKeys) error {
+	keys.Old = append([]OldSigningKey(nil), keys.Old...)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = &keys
+	return nil
+}
@@ -0,0 +1,130 @@
+package gomatrixserverlib_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestKeyManagerPublishAndRotate(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := &gomatrixserverlib.MemorySigningKeyStore{}
+	manager, err := gomatrixserverlib.NewKeyManager(ctx, "our.server", store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := manager.Signer()
+	firstKeyID, firstPublicKey := first.KeyID(), first.PublicKey()
+
+	keys, err := manager.ServerKeys(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checks, _ := gomatrixserverlib.CheckKeys("our.server", now, keys); !checks.AllChecksOK {
+		t.Fatalf("the published keys failed checks: %#v", checks)
+	}
+	if keys.ValidUntilTS != gomatrixserverlib.AsTimestamp(now.Add(time.Hour)) {
+		t.Errorf("wanted the keys to be valid for an hour, got valid_until_ts %d", keys.ValidUntilTS)
+	}
+	if _, ok := keys.VerifyKeys[firstKeyID]; !ok || len(keys.OldVerifyKeys) != 0 {
+		t.Errorf("wanted only %q to be published, got %#v", first.KeyID(), keys.ServerKeyFields)
+	}
+
+	rotatedAt := now.Add(time.Minute)
+	current, err := manager.Rotate(ctx, rotatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.KeyID == firstKeyID {
+		t.Fatalf("the rotated key has the same ID %q", current.KeyID)
+	}
+	if manager.Signer().KeyID() != current.KeyID {
+		t.Errorf("wanted the signer to use the new key %q, got %q", current.KeyID, manager.Signer().KeyID())
+	}
+	// Signers that were got before the rotation switch to the new key too.
+	if first.KeyID() != current.KeyID {
+		t.Errorf("wanted the old signer to use the new key %q, got %q", current.KeyID, first.KeyID())
+	}
+
+	res := manager.OnServerKeysRequest(httptest.NewRequest("GET", "/_matrix/key/v2/server", nil), rotatedAt)
+	if res.Code != 200 {
+		t.Fatalf("wanted 200, got %d", res.Code)
+	}
+	keys = res.JSON.(gomatrixserverlib.ServerKeys)
+	if checks, _ := gomatrixserverlib.CheckKeys("our.server", rotatedAt, keys); !checks.AllChecksOK {
+		t.Fatalf("the published keys failed checks after rotation: %#v", checks)
+	}
+	old, ok := keys.OldVerifyKeys[firstKeyID]
+	if !ok || !reflect.DeepEqual([]byte(old.Key), []byte(firstPublicKey)) {
+		t.Fatalf("wanted %q to be an old key, got %#v", firstKeyID, keys.OldVerifyKeys)
+	}
+	if old.ExpiredTS != gomatrixserverlib.AsTimestamp(rotatedAt) {
+		t.Errorf("wanted the old key to expire at %d, got %d", gomatrixserverlib.AsTimestamp(rotatedAt), old.ExpiredTS)
+	}
+
+	// A new manager picks up the stored keys.
+	reloaded, err := gomatrixserverlib.NewKeyManager(ctx, "our.server", store, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reloaded.SigningKeys(), manager.SigningKeys()) {
+		t.Errorf("the reloaded keys don't match: %#v", reloaded.SigningKeys())
+	}
+}
+
+func TestKeyManagerSignerDuringRotation(t *testing.T) {
+	ctx := context.Background()
+	manager, err := gomatrixserverlib.NewKeyManager(ctx, "our.server", &gomatrixserverlib.MemorySigningKeyStore{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := manager.Signer()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, rotateErr := manager.Rotate(ctx, time.Now()); rotateErr != nil {
+				t.Error(rotateErr)
+				return
+			}
+		}
+	}()
+	var signed [][]byte
+	for i := 0; i < 200; i++ {
+		message, signErr := gomatrixserverlib.SignJSONWithSigner("our.server", signer, []byte(`{"n":1}`))
+		if signErr != nil {
+			t.Fatal(signErr)
+		}
+		signed = append(signed, message)
+	}
+	<-done
+
+	// Every signature is labelled with the key that made it, so it verifies
+	// with one of the published keys.
+	keys := manager.SigningKeys()
+	publicKeys := map[gomatrixserverlib.KeyID]ed25519.PublicKey{
+		keys.Current.KeyID: keys.Current.PrivateKey.Public().(ed25519.PublicKey),
+	}
+	for _, old := range keys.Old {
+		publicKeys[old.KeyID] = old.PublicKey
+	}
+	for _, message := range signed {
+		verified := false
+		for keyID, publicKey := range publicKeys {
+			if gomatrixserverlib.VerifyJSON("our.server", keyID, publicKey, message) == nil {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			t.Fatalf("signature doesn't verify with the key it is labelled with: %s", message)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -82,11 +84,17 @@ func (r PublicKeyLookupResult) WasValidAt(atTs Timestamp, strictValidityChecking
 	return true
 }
 
+// A PublicKeyNotaryLookupRequest is the body of a request to a notary server
+// for the keys of other servers.
 type PublicKeyNotaryLookupRequest struct {
 	ServerKeys map[ServerName]map[KeyID]PublicKeyNotaryQueryCriteria `json:"server_keys"`
 }
 
+// PublicKeyNotaryQueryCriteria are the criteria for a key in a
+// PublicKeyNotaryLookupRequest.
 type PublicKeyNotaryQueryCriteria struct {
+	// The notary server should fetch a fresh copy of the key if its cached
+	// copy isn't valid until at least this time.
 	MinimumValidUntilTS Timestamp `json:"minimum_valid_until_ts"`
 }
 
@@ -99,7 +107,9 @@ type KeyFetcher interface {
 	// that server name containing that key ID
 	// The result may have fewer (server name, key ID) pairs than were in the request.
 	// The result may have more (server name, key ID) pairs than were in the request.
-	// Returns an error if there was a problem fetching the keys.
+	// Returns an error if there was a problem fetching the keys. Returns a
+	// ServerKeyFetchErrors along with the keys that were fetched if only some
+	// of the servers couldn't be reached.
 	FetchKeys(ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error)
 
 	// FetcherName returns the name of this fetcher, which can then be used for
@@ -107,6 +117,27 @@ type KeyFetcher interface {
 	FetcherName() string
 }
 
+// ServerKeyFetchErrors is returned by a KeyFetcher when it couldn't get a
+// response from some of the servers that it was asked for keys of. A KeyRing
+// backs off from fetching keys for those servers, whereas a server that
+// responded without a key is only asked for that key again once the
+// KeyRing's not found TTL has passed.
+type ServerKeyFetchErrors map[ServerName]error
+
+// Error implements error
+func (e ServerKeyFetchErrors) Error() string {
+	serverNames := make([]string, 0, len(e))
+	for serverName := range e {
+		serverNames = append(serverNames, string(serverName))
+	}
+	sort.Strings(serverNames)
+	errs := make([]string, len(serverNames))
+	for i, serverName := range serverNames {
+		errs[i] = fmt.Sprintf("%s: %s", serverName, e[ServerName(serverName)])
+	}
+	return "gomatrixserverlib: failed to fetch keys from servers: " + strings.Join(errs, "; ")
+}
+
 // A KeyDatabase is a store for caching public keys.
 type KeyDatabase interface {
 	KeyFetcher
@@ -121,9 +152,120 @@ type KeyDatabase interface {
 }
 
 // A KeyRing stores keys for matrix servers and provides methods for verifying JSON messages.
+// A KeyRing made with NewKeyRing coalesces concurrent fetches for the same keys,
+// backs off from fetching keys that the KeyFetchers recently failed to find,
+// refreshes cached keys in the background before they expire, and reports what
+// it is doing to a KeyRingObserver if it has one.
 type KeyRing struct {
 	KeyFetchers []KeyFetcher
 	KeyDatabase KeyDatabase
+	// The state of a KeyRing made by NewKeyRing, or nil.
+	shared *keyRingState
+}
+
+// keyRingState is the state of a KeyRing made by NewKeyRing, which is shared
+// between copies of the KeyRing.
+type keyRingState struct {
+	// The context for work that outlives VerifyJSONs calls, which is
+	// cancelled by Close.
+	ctx      context.Context
+	cancel   context.CancelFunc
+	fetches  *keyFetchCoalescer
+	backoff  *keyFetchBackoff
+	refresh  *keyRefresher
+	observer KeyRingObserver
+}
+
+// noKeyRingState is the state of KeyRings that weren't made by NewKeyRing.
+// It must not be modified.
+var noKeyRingState keyRingState
+
+// state returns the state of the KeyRing. All of its fields are nil if the
+// KeyRing wasn't made by NewKeyRing.
+func (k KeyRing) state() *keyRingState {
+	if k.shared == nil {
+		return &noKeyRingState
+	}
+	return k.shared
+}
+
+// NewKeyRing creates a KeyRing which looks up keys in the database, and
+// then in each of the fetchers in turn.
+func NewKeyRing(keyFetchers []KeyFetcher, keyDatabase KeyDatabase, options ...KeyRingOption) *KeyRing {
+	ctx, cancel := context.WithCancel(context.Background())
+	k := &KeyRing{
+		KeyFetchers: keyFetchers,
+		KeyDatabase: keyDatabase,
+		shared: &keyRingState{
+			ctx:     ctx,
+			cancel:  cancel,
+			fetches: newKeyFetchCoalescer(),
+			backoff: newKeyFetchBackoff(),
+			refresh: newKeyRefresher(),
+		},
+	}
+	for _, option := range options {
+		option(k)
+	}
+	return k
+}
+
+// FetchStats returns the number of keys that have been requested from the
+// KeyFetchers, and the number that were shared with a concurrent request.
+func (k KeyRing) FetchStats() KeyFetchStats {
+	if k.state().fetches == nil {
+		return KeyFetchStats{}
+	}
+	return k.state().fetches.stats()
+}
+
+// KeyFetchBackoffs returns the servers whose keys won't be fetched until
+// their backoff expires, sorted by server name.
+func (k KeyRing) KeyFetchBackoffs() []KeyFetchBackoff {
+	if k.state().backoff == nil {
+		return nil
+	}
+	return k.state().backoff.backoffs()
+}
+
+// KeyFetchBackoff returns the backoff for the server if its keys won't be
+// fetched until the backoff expires.
+func (k KeyRing) KeyFetchBackoff(serverName ServerName) (KeyFetchBackoff, bool) {
+	if k.state().backoff == nil {
+		return KeyFetchBackoff{}, false
+	}
+	return k.state().backoff.backoff(serverName)
+}
+
+// NotFoundKeys returns the keys that the KeyFetchers recently failed to find
+// even though the server was reachable, along with when they will next be
+// fetched.
+func (k KeyRing) NotFoundKeys() map[PublicKeyLookupRequest]time.Time {
+	if k.state().backoff == nil {
+		return nil
+	}
+	return k.state().backoff.notFoundKeys()
+}
+
+// ResetKeyFetchBackoff allows the keys for the given servers to be fetched
+// again straight away. Resets every server if none are given.
+func (k KeyRing) ResetKeyFetchBackoff(serverNames ...ServerName) {
+	if k.state().backoff != nil {
+		k.state().backoff.reset(serverNames)
+	}
+}
+
+// Close cancels the KeyRing's background work, which is refreshing cached
+// keys that are about to expire and fetching keys for VerifyJSONs calls that
+// have given up waiting for them, and waits for the refreshes to stop. The
+// KeyRing mustn't be used after it is closed.
+func (k KeyRing) Close() {
+	state := k.state()
+	if state.cancel == nil {
+		return
+	}
+	state.cancel()
+	state.refresh.close()
 }
 
 // A VerifyJSONRequest is a request to check for a signature on a JSON message.
@@ -160,8 +302,8 @@ type JSONVerifier interface {
 
 // VerifyJSONs implements JSONVerifier.
 func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) { // nolint: gocyclo
-	logger := util.GetLogger(ctx)
 	results := make([]VerifyJSONResult, len(requests))
+	reasons := make([]VerifyFailureReason, len(requests))
 	keyIDs := make([][]KeyID, len(requests))
 
 	// Store the initial number of requests that were made. We'll remove
@@ -173,6 +315,7 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 		ids, err := ListKeyIDs(string(requests[i].ServerName), requests[i].Message)
 		if err != nil {
 			results[i].Error = fmt.Errorf("gomatrixserverlib: error extracting key IDs")
+			reasons[i] = VerifyFailureMalformed
 			continue
 		}
 		for _, keyID := range ids {
@@ -184,6 +327,7 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 			results[i].Error = fmt.Errorf(
 				"gomatrixserverlib: not signed by %q with a supported algorithm", requests[i].ServerName,
 			)
+			reasons[i] = VerifyFailureNoSupportedSignature
 			continue
 		}
 		// Set a place holder error in the result field.
@@ -193,12 +337,14 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 		results[i].Error = fmt.Errorf(
 			"gomatrixserverlib: could not download key for %q", requests[i].ServerName,
 		)
+		reasons[i] = VerifyFailureKeyNotFound
 	}
 
 	keyRequests := k.publicKeyRequests(requests, results, keyIDs)
 	if len(keyRequests) == 0 {
 		// There aren't any keys to fetch so we can stop here.
 		// This will happen if all the objects are missing supported signatures.
+		k.observeVerifyFailures(requests, results, reasons)
 		return results, nil
 	}
 	keysFromDatabase, err := k.KeyDatabase.FetchKeys(ctx, keyRequests)
@@ -207,27 +353,52 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 	}
 
 	keysFetched := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
-	now := AsTimestamp(time.Now())
+	keysToRefresh := map[PublicKeyLookupRequest]Timestamp{}
+	nowTime := time.Now()
+	now := AsTimestamp(nowTime)
+	hits := 0
 	for req, res := range keysFromDatabase {
 		if res.ExpiredTS != PublicKeyNotExpired {
 			// The key is expired - it's not going to change so just return
 			// it and don't bother requesting it again.
 			keysFetched[req] = res
 			delete(keyRequests, req)
+			hits++
 			continue
 		}
 		// The key isn't expired so include it in the results.
 		keysFetched[req] = res
-		// If the key is inside validity then we don't need to update it.
-		if now < res.ValidUntilTS && res.ExpiredTS == PublicKeyNotExpired {
-			delete(keyRequests, req)
+		// If the key is outside validity then we need to update it.
+		if now >= res.ValidUntilTS {
+			continue
+		}
+		// If the key isn't valid for long enough to cover the messages
+		// then ask for a copy that is. The timestamp in the request is the
+		// latest time that the messages need the key to be valid at, which
+		// becomes the minimum_valid_until_ts if we ask a notary server.
+		if res.ValidUntilTS < keyRequests[req] {
+			util.GetLogger(ctx).WithField("server_name", req.ServerName).WithField("key_id", req.KeyID).
+				Info("Cached key isn't valid for long enough, requesting a fresher copy")
+			continue
+		}
+		// Otherwise we don't need to update it, but if it's about to expire
+		// then update it in the background so that we don't have to wait
+		// for it later.
+		delete(keyRequests, req)
+		hits++
+		if refresh := k.state().refresh; refresh != nil && refresh.due(res, nowTime) {
+			keysToRefresh[req] = AsTimestamp(nowTime.Add(refresh.window))
 		}
 	}
+	if len(keysToRefresh) > 0 {
+		k.refreshKeys(keysToRefresh)
+	}
+	k.observe().OnKeyCacheLookup(hits, len(keyRequests))
 
 	if len(keysFetched) == numRequests {
 		// If our key requests are all satisfied then we can try performing
 		// a verification using our keys.
-		k.checkUsingKeys(requests, results, keyIDs, keysFetched)
+		k.checkUsingKeys(requests, results, reasons, keyIDs, keysFetched)
 
 		// If we run into any errors when verifying using the keys that we
 		// have then we can hit federation and check for updated keys.
@@ -243,6 +414,113 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 		}
 	}
 
+	keysFromFetchers := 0
+	if len(keyRequests) > 0 {
+		fetched := k.fetchKeys(ctx, keyRequests)
+		for req, res := range fetched {
+			keysFetched[req] = res
+		}
+		keysFromFetchers = len(fetched)
+	}
+
+	// Now that we've fetched all of the keys we need, try to check
+	// if the requests are valid.
+	k.checkUsingKeys(requests, results, reasons, keyIDs, keysFetched)
+
+	// Add the keys to the database so that we won't need to fetch them again.
+	if err := k.KeyDatabase.StoreKeys(ctx, keysFetched); err != nil {
+		return nil, err
+	}
+	k.observeKeysStored(keysFromFetchers)
+
+	k.observeVerifyFailures(requests, results, reasons)
+	return results, nil
+}
+
+// How long a KeyRing spends fetching keys that it has been asked for before
+// giving up on them.
+const keyFetchTimeout = 30 * time.Second
+
+// fetchKeys fetches the keys from the KeyFetchers. If another VerifyJSONs
+// call is already fetching some of the keys then we wait for its results
+// rather than fetching them again. Keys that are backed off aren't fetched.
+func (k KeyRing) fetchKeys(
+	ctx context.Context, keyRequests map[PublicKeyLookupRequest]Timestamp,
+) map[PublicKeyLookupRequest]PublicKeyLookupResult {
+	state := k.state()
+	if state.backoff != nil {
+		numRequests := len(keyRequests)
+		keyRequests = state.backoff.filter(keyRequests)
+		if skipped := numRequests - len(keyRequests); skipped > 0 {
+			util.GetLogger(ctx).WithField("num_key_requests", skipped).
+				Info("Not requesting keys that recently failed to fetch")
+		}
+		if len(keyRequests) == 0 {
+			return map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+		}
+	}
+	if state.fetches == nil {
+		keysFetched, _ := k.fetchKeysFromFetchers(ctx, keyRequests)
+		return keysFetched
+	}
+
+	// Everyone, including whoever claims the keys, waits for the results of
+	// the fetches.
+	claimed, waiting := state.fetches.claim(keyRequests)
+	keysFetched := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	if len(claimed) > 0 {
+		// The fetch is shared with anyone else who wants the same keys, so
+		// it mustn't be cut short by this caller's context.
+		go k.fetchClaimedKeys(util.ContextWithLogger(state.ctx, util.GetLogger(ctx)), claimed, waiting)
+	}
+	if len(waiting) > len(claimed) {
+		util.GetLogger(ctx).WithField("num_key_requests", len(waiting)-len(claimed)).
+			Info("Waiting for keys that are already being fetched")
+	}
+	state.fetches.wait(ctx, waiting, keysFetched)
+	return keysFetched
+}
+
+// fetchClaimedKeys fetches the keys claimed from the keyFetchCoalescer and
+// publishes the results to everyone waiting for them, giving up after
+// keyFetchTimeout.
+func (k KeyRing) fetchClaimedKeys(
+	ctx context.Context, claimed map[PublicKeyLookupRequest]Timestamp,
+	waiting map[PublicKeyLookupRequest]*inFlightKeyFetch,
+) {
+	state := k.state()
+	ctx, cancel := context.WithTimeout(ctx, keyFetchTimeout)
+	defer cancel()
+	keysFetched := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	defer func() {
+		if r := recover(); r != nil {
+			util.GetLogger(ctx).WithField("panic", r).Errorf("Panic while fetching keys\n%s", debug.Stack())
+		}
+		state.fetches.complete(claimed, waiting, keysFetched)
+	}()
+	keysFetched, unreached := k.fetchKeysFromFetchers(ctx, claimed)
+	// Don't blame the servers if we gave up on them.
+	if state.backoff != nil && ctx.Err() == nil {
+		state.backoff.record(claimed, keysFetched, unreached)
+	}
+}
+
+// fetchKeysFromFetchers asks each of the KeyFetchers in turn for the keys
+// that are still missing. Also returns the servers that none of the
+// KeyFetchers got a response from.
+func (k KeyRing) fetchKeysFromFetchers(
+	ctx context.Context, keyRequests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, map[ServerName]bool) {
+	logger := util.GetLogger(ctx)
+	keysFetched := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	answered := map[ServerName]bool{}
+	requested := keyRequests
+	remaining := make(map[PublicKeyLookupRequest]Timestamp, len(keyRequests))
+	for req, ts := range keyRequests {
+		remaining[req] = ts
+	}
+	keyRequests = remaining
+
 	for _, fetcher := range k.KeyFetchers {
 		// If we have all of the keys that we need now then we can
 		// break the loop.
@@ -252,17 +530,25 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 
 		fetcherLogger := logger.WithField("fetcher", fetcher.FetcherName())
 
-		// TODO: Coalesce in-flight requests for the same keys.
-		// Otherwise we risk spamming the servers we query the keys from.
-
 		fetcherLogger.WithField("num_key_requests", len(keyRequests)).
 			Info("Requesting keys from fetcher")
 
+		numKeyRequests := len(keyRequests)
+		start := time.Now()
 		fetched, err := fetcher.FetchKeys(ctx, keyRequests)
-		if err != nil {
+		k.observe().OnKeyFetch(fetcher.FetcherName(), time.Since(start), numKeyRequests, len(fetched), err)
+		var serverErrs ServerKeyFetchErrors
+		if errors.As(err, &serverErrs) {
+			fetcherLogger.WithError(err).Warn("Failed to request keys from some servers")
+		} else if err != nil {
 			fetcherLogger.WithError(err).Warn("Failed to request keys from fetcher")
 			continue
 		}
+		for req := range keyRequests {
+			if _, failed := serverErrs[req.ServerName]; !failed {
+				answered[req.ServerName] = true
+			}
+		}
 
 		if len(fetched) == 0 {
 			fetcherLogger.Warn("Failed to retrieve any keys")
@@ -279,16 +565,24 @@ func (k KeyRing) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest)
 		}
 	}
 
-	// Now that we've fetched all of the keys we need, try to check
-	// if the requests are valid.
-	k.checkUsingKeys(requests, results, keyIDs, keysFetched)
-
-	// Add the keys to the database so that we won't need to fetch them again.
-	if err := k.KeyDatabase.StoreKeys(ctx, keysFetched); err != nil {
-		return nil, err
+	// The results may have more keys for a server than were requested, and
+	// any of them means that we reached the server.
+	for req := range keysFetched {
+		answered[req.ServerName] = true
 	}
-
-	return results, nil
+	unreached := map[ServerName]bool{}
+	for req := range requested {
+		if !answered[req.ServerName] {
+			unreached[req.ServerName] = true
+		}
+	}
+	// Don't blame the servers if we gave up on them.
+	if ctx.Err() == nil {
+		for serverName := range unreached {
+			k.observe().OnKeyFetchFailure(serverName)
+		}
+	}
+	return keysFetched, unreached
 }
 
 func (k *KeyRing) isAlgorithmSupported(keyID KeyID) bool {
@@ -321,16 +615,30 @@ func (k *KeyRing) publicKeyRequests(
 	return keyRequests
 }
 
+// checkUsingKeys checks the signatures of the messages that haven't passed
+// the checks yet. The messages are checked in parallel across the CPU cores,
+// and each distinct message is only decoded once even if it is checked for
+// several servers.
 func (k *KeyRing) checkUsingKeys(
-	requests []VerifyJSONRequest, results []VerifyJSONResult, keyIDs [][]KeyID,
+	requests []VerifyJSONRequest, results []VerifyJSONResult, reasons []VerifyFailureReason, keyIDs [][]KeyID,
 	keys map[PublicKeyLookupRequest]PublicKeyLookupResult,
 ) {
+	var pending []int
 	for i := range requests {
 		if results[i].Error == nil {
 			// We've already checked this message and it passed the signature checks.
 			// So we can skip to the next message.
 			continue
 		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	prepared := prepareJSONsForVerification(requests, pending)
+	parallelFor(len(pending), func(p int) {
+		i := pending[p]
 		for _, keyID := range keyIDs[i] {
 			serverKey, ok := keys[PublicKeyLookupRequest{requests[i].ServerName, keyID}]
 			if !ok {
@@ -344,20 +652,70 @@ func (k *KeyRing) checkUsingKeys(
 					"gomatrixserverlib: key with ID %q for %q not valid at %d",
 					keyID, requests[i].ServerName, requests[i].AtTS,
 				)
+				reasons[i] = VerifyFailureKeyNotValid
 				continue
 			}
-			if err := VerifyJSON(
-				string(requests[i].ServerName), keyID, ed25519.PublicKey(serverKey.Key), requests[i].Message,
-			); err != nil {
+			err := prepared[p].err
+			if err == nil {
+				err = prepared[p].json.verify(string(requests[i].ServerName), keyID, ed25519.PublicKey(serverKey.Key))
+			}
+			if err != nil {
 				// The signature wasn't valid, record the error and try the next key ID.
 				results[i].Error = err
+				reasons[i] = VerifyFailureBadSignature
 				continue
 			}
 			// The signature is valid, set the result to nil.
 			results[i].Error = nil
+			reasons[i] = ""
 			break
 		}
+	})
+}
+
+// A preparedJSONResult is a decoded message or the error from decoding it.
+type preparedJSONResult struct {
+	json *preparedJSON
+	err  error
+}
+
+// prepareJSONsForVerification decodes the messages of the given requests in
+// parallel. Requests that share the same message bytes, e.g. because
+// VerifyEventSignatures checks an event's signatures from several servers,
+// share the result. Returns a result for each of the given indexes.
+func prepareJSONsForVerification(requests []VerifyJSONRequest, indexes []int) []preparedJSONResult {
+	type messageIdentity struct {
+		first  *byte
+		length int
+	}
+	// For each of the indexes, which of the distinct messages it has.
+	distinct := make([]int, len(indexes))
+	var messages [][]byte
+	seen := map[messageIdentity]int{}
+	for p, i := range indexes {
+		message := requests[i].Message
+		if len(message) > 0 {
+			id := messageIdentity{&message[0], len(message)}
+			if m, ok := seen[id]; ok {
+				distinct[p] = m
+				continue
+			}
+			seen[id] = len(messages)
+		}
+		distinct[p] = len(messages)
+		messages = append(messages, message)
 	}
+
+	prepared := make([]preparedJSONResult, len(messages))
+	parallelFor(len(messages), func(m int) {
+		prepared[m].json, prepared[m].err = prepareJSONForVerification(messages[m])
+	})
+
+	results := make([]preparedJSONResult, len(indexes))
+	for p := range indexes {
+		results[p] = prepared[distinct[p]]
+	}
+	return results
 }
 
 type KeyClient interface {
@@ -472,6 +830,7 @@ func (d *DirectKeyFetcher) FetchKeys(
 	// Prepare somewhere to put the results. This map is protected
 	// by the below mutex.
 	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	errs := ServerKeyFetchErrors{}
 	var resultsMutex sync.Mutex
 
 	// Populate the wait group with the number of workers.
@@ -493,8 +852,10 @@ func (d *DirectKeyFetcher) FetchKeys(
 			if err != nil {
 				serverResults, err = d.fetchNotaryKeysForServer(ctx, server)
 				if err != nil {
-					// TODO: Should we actually be erroring here? or should we just drop those keys from the result map?
 					fetcherLogger.WithError(err).Error("Failed to fetch key for server")
+					resultsMutex.Lock()
+					errs[server] = err
+					resultsMutex.Unlock()
 					continue
 				}
 			}
@@ -514,6 +875,9 @@ func (d *DirectKeyFetcher) FetchKeys(
 	// Wait for the workers to finish before returning
 	// the results.
 	wait.Wait()
+	if len(errs) > 0 {
+		return results, errs
+	}
 	return results, nil
 }
 
@@ -3,6 +3,7 @@ package gomatrixserverlib
 import (
 	"context"
 	"encoding/json"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -102,7 +103,7 @@ func (db *testKeyDatabase) StoreKeys(
 
 func TestVerifyJSONsSuccess(t *testing.T) {
 	// Check that trying to verify the server key JSON works.
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := KeyRing{nil, &testKeyDatabase{}, nil}
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName:             "localhost:8800",
 		Message:                []byte(testKeys),
@@ -119,7 +120,7 @@ func TestVerifyJSONsSuccess(t *testing.T) {
 
 func TestVerifyJSONsFailureWithStrictChecking(t *testing.T) {
 	// Check that trying to verify the server key JSON works.
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := KeyRing{nil, &testKeyDatabase{}, nil}
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName:             "localhost:8800",
 		Message:                []byte(testKeys),
@@ -181,7 +182,7 @@ func TestExpiredTS(t *testing.T) {
 
 func TestVerifyJSONsFailureWithoutStrictChecking(t *testing.T) {
 	// Check that trying to verify the server key JSON works.
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := KeyRing{nil, &testKeyDatabase{}, nil}
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName:             "localhost:8800",
 		Message:                []byte(testKeys),
@@ -198,7 +199,7 @@ func TestVerifyJSONsFailureWithoutStrictChecking(t *testing.T) {
 
 func TestVerifyJSONsUnknownServerFails(t *testing.T) {
 	// Check that trying to verify JSON for an unknown server fails.
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := KeyRing{nil, &testKeyDatabase{}, nil}
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName:             "unknown:8800",
 		Message:                []byte(testKeys),
@@ -216,7 +217,7 @@ func TestVerifyJSONsUnknownServerFails(t *testing.T) {
 func TestVerifyJSONsDistantFutureFails(t *testing.T) {
 	// Check that trying to verify JSON from the distant future fails.
 	distantFuture := Timestamp(2000000000000)
-	k := KeyRing{nil, &testKeyDatabase{}}
+	k := KeyRing{nil, &testKeyDatabase{}, nil}
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName:             "unknown:8800",
 		Message:                []byte(testKeys),
@@ -233,7 +234,7 @@ func TestVerifyJSONsDistantFutureFails(t *testing.T) {
 
 func TestVerifyJSONsFetcherError(t *testing.T) {
 	// Check that if the database errors then the attempt to verify JSON fails.
-	k := KeyRing{nil, &erroringKeyDatabase{}}
+	k := KeyRing{nil, &erroringKeyDatabase{}, nil}
 	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
 		ServerName:             "localhost:8800",
 		Message:                []byte(testKeys),
@@ -271,6 +272,7 @@ func TestRequestKeyAfterValidity(t *testing.T) {
 	k := KeyRing{
 		[]KeyFetcher{&requestDummy},
 		&testKeyDatabase{},
+		nil,
 	}
 	// Create a message that uses the ed25519:pastvalidity key. The
 	// testKeyDatabase will return it but we're past the validity now.
@@ -295,6 +297,152 @@ func TestRequestKeyAfterValidity(t *testing.T) {
 	}
 }
 
+// blockingKeyFetcher is a KeyFetcher which counts its calls and doesn't
+// return until it is released.
+type blockingKeyFetcher struct {
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingKeyFetcher) FetchKeys(ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.started <- struct{}{}
+	<-f.release
+	return map[PublicKeyLookupRequest]PublicKeyLookupResult{}, nil
+}
+
+func (f *blockingKeyFetcher) FetcherName() string {
+	return "blockingKeyFetcher"
+}
+
+func TestVerifyJSONsCoalescesFetches(t *testing.T) {
+	const callers = 5
+	fetcher := &blockingKeyFetcher{
+		started: make(chan struct{}, callers),
+		release: make(chan struct{}),
+	}
+	k := NewKeyRing([]KeyFetcher{fetcher}, &testKeyDatabase{})
+	message := `{"signatures": {"other.server": {"ed25519:unknown": "signature_here"}}}`
+	verify := func(done chan<- []VerifyJSONResult) {
+		results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
+			ServerName: "other.server",
+			Message:    []byte(message),
+			AtTS:       1493142432964,
+		}})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- results
+	}
+
+	done := make(chan []VerifyJSONResult, callers)
+	go verify(done)
+	<-fetcher.started
+	for i := 1; i < callers; i++ {
+		go verify(done)
+	}
+	// Wait for the other callers to start waiting on the first fetch.
+	for k.FetchStats().Coalesced < callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(fetcher.release)
+	for i := 0; i < callers; i++ {
+		if results := <-done; len(results) != 1 || results[0].Error == nil {
+			t.Errorf("VerifyJSONs(): Wanted [{Error: <some error>}] got %#v", results)
+		}
+	}
+
+	if calls := atomic.LoadInt32(&fetcher.calls); calls != 1 {
+		t.Errorf("wanted the fetcher to be called once, got %d calls", calls)
+	}
+	if stats := k.FetchStats(); stats.Requested != 1 || stats.Coalesced != callers-1 {
+		t.Errorf("wanted {Requested: 1, Coalesced: %d}, got %#v", callers-1, stats)
+	}
+}
+
+// keyReturningKeyFetcher is a blockingKeyFetcher which returns a key for
+// every request once it is released.
+type keyReturningKeyFetcher struct {
+	blockingKeyFetcher
+}
+
+func (f *keyReturningKeyFetcher) FetchKeys(ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	_, _ = f.blockingKeyFetcher.FetchKeys(ctx, requests)
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req := range requests {
+		results[req] = PublicKeyLookupResult{ValidUntilTS: PublicKeyNotExpired, ExpiredTS: PublicKeyNotExpired}
+	}
+	return results, nil
+}
+
+func TestFetchKeysOutlivesCancelledClaimant(t *testing.T) {
+	fetcher := &keyReturningKeyFetcher{blockingKeyFetcher{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}}
+	k := NewKeyRing([]KeyFetcher{fetcher}, &testKeyDatabase{})
+	req := PublicKeyLookupRequest{ServerName: "other.server", KeyID: "ed25519:unknown"}
+	requests := func() map[PublicKeyLookupRequest]Timestamp {
+		return map[PublicKeyLookupRequest]Timestamp{req: 1493142432964}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	claimant := make(chan map[PublicKeyLookupRequest]PublicKeyLookupResult, 1)
+	go func() { claimant <- k.fetchKeys(ctx, requests()) }()
+	<-fetcher.started
+	waiter := make(chan map[PublicKeyLookupRequest]PublicKeyLookupResult, 1)
+	go func() { waiter <- k.fetchKeys(context.Background(), requests()) }()
+	for k.FetchStats().Coalesced < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The caller that claimed the fetch gives up, but the fetch carries on
+	// for the caller that is still waiting.
+	cancel()
+	if keys := <-claimant; len(keys) != 0 {
+		t.Errorf("wanted no keys for the cancelled caller, got %v", keys)
+	}
+	close(fetcher.release)
+	if keys := <-waiter; len(keys) != 1 {
+		t.Errorf("wanted the key for the waiting caller, got %v", keys)
+	}
+}
+
+func TestFetchKeysOnlySharesFetchesValidForLongEnough(t *testing.T) {
+	fetcher := &keyReturningKeyFetcher{blockingKeyFetcher{
+		started: make(chan struct{}, 3),
+		release: make(chan struct{}),
+	}}
+	k := NewKeyRing([]KeyFetcher{fetcher}, &testKeyDatabase{})
+	req := PublicKeyLookupRequest{ServerName: "other.server", KeyID: "ed25519:unknown"}
+	fetch := func(atTS Timestamp, done chan<- map[PublicKeyLookupRequest]PublicKeyLookupResult) {
+		done <- k.fetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: atTS})
+	}
+
+	done := make(chan map[PublicKeyLookupRequest]PublicKeyLookupResult, 3)
+	go fetch(1000, done)
+	<-fetcher.started
+	// A request that needs the key to be valid for longer can't share the
+	// first fetch, but a request that needs it for less time can share the
+	// second.
+	go fetch(2000, done)
+	<-fetcher.started
+	go fetch(1500, done)
+	for k.FetchStats().Coalesced < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(fetcher.release)
+	for i := 0; i < 3; i++ {
+		if keys := <-done; len(keys) != 1 {
+			t.Errorf("wanted the key, got %v", keys)
+		}
+	}
+	if stats := k.FetchStats(); stats.Requested != 2 || stats.Coalesced != 1 {
+		t.Errorf("wanted {Requested: 2, Coalesced: 1}, got %#v", stats)
+	}
+}
+
 func TestPublicKeyRequestMarshalUnmarshalText(t *testing.T) {
 	// The test must only separate based on the first forward slash.
 	// The key ID therefore should remain intact even if it contains one.
@@ -0,0 +1,224 @@
+package gomatrixserverlib
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// keyFetchBackoffPruneInterval is how often a KeyRing forgets about the
+// servers and keys whose backoff has expired.
+const keyFetchBackoffPruneInterval = time.Minute
+
+// A KeyRingOption modifies a KeyRing made by NewKeyRing.
+type KeyRingOption func(*KeyRing)
+
+// WithKeyFetchBackoff sets how long a KeyRing waits before asking its
+// KeyFetchers for the keys of a server that none of them could reach.
+// The wait starts at initial and doubles with each consecutive failure, up to
+// maximum. Defaults to 30 seconds, up to an hour.
+func WithKeyFetchBackoff(initial, maximum time.Duration) KeyRingOption {
+	return func(k *KeyRing) {
+		k.state().backoff.initial = initial
+		k.state().backoff.maximum = maximum
+	}
+}
+
+// WithNotFoundKeyTTL sets how long a KeyRing remembers that a server didn't
+// have a key with a given key ID before asking for it again. Defaults to a
+// minute.
+func WithNotFoundKeyTTL(ttl time.Duration) KeyRingOption {
+	return func(k *KeyRing) {
+		k.state().backoff.notFoundTTL = ttl
+	}
+}
+
+// A KeyFetchBackoff describes a server whose keys a KeyRing won't fetch
+// until its backoff expires.
+type KeyFetchBackoff struct {
+	ServerName ServerName
+	// The number of consecutive fetches that couldn't reach the server.
+	Failures int
+	// The time after which the server's keys will be fetched again.
+	RetryAfter time.Time
+}
+
+// keyFetchBackoff tracks the servers and keys that the KeyFetchers recently
+// failed to find, so that we don't keep asking for them.
+type keyFetchBackoff struct {
+	mutex       sync.Mutex
+	initial     time.Duration
+	maximum     time.Duration
+	notFoundTTL time.Duration
+	now         func() time.Time
+	servers     map[ServerName]*KeyFetchBackoff
+	notFound    map[PublicKeyLookupRequest]time.Time // until when
+	lastPrune   time.Time
+}
+
+func newKeyFetchBackoff() *keyFetchBackoff {
+	return &keyFetchBackoff{
+		initial:     30 * time.Second,
+		maximum:     time.Hour,
+		notFoundTTL: time.Minute,
+		now:         time.Now,
+		servers:     map[ServerName]*KeyFetchBackoff{},
+		notFound:    map[PublicKeyLookupRequest]time.Time{},
+	}
+}
+
+// filter returns the requests that aren't backed off.
+func (b *keyFetchBackoff) filter(
+	requests map[PublicKeyLookupRequest]Timestamp,
+) map[PublicKeyLookupRequest]Timestamp {
+	now := b.now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	filtered := make(map[PublicKeyLookupRequest]Timestamp, len(requests))
+	for req, ts := range requests {
+		if server, ok := b.servers[req.ServerName]; ok && now.Before(server.RetryAfter) {
+			continue
+		}
+		if until, ok := b.notFound[req]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(b.notFound, req)
+		}
+		filtered[req] = ts
+	}
+	return filtered
+}
+
+// record updates the backoff state with the results of fetching the
+// requested keys. A server that couldn't be reached is backed off, and
+// otherwise the keys that it didn't return are remembered as not found.
+func (b *keyFetchBackoff) record(
+	requests map[PublicKeyLookupRequest]Timestamp,
+	results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+	failed map[ServerName]bool,
+) {
+	now := b.now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.prune(now)
+	for req := range requests {
+		if failed[req.ServerName] {
+			continue
+		}
+		delete(b.servers, req.ServerName)
+		if _, ok := results[req]; ok {
+			delete(b.notFound, req)
+		} else {
+			b.notFound[req] = now.Add(b.notFoundTTL)
+		}
+	}
+	for serverName := range failed {
+		server, ok := b.servers[serverName]
+		if !ok {
+			server = &KeyFetchBackoff{ServerName: serverName}
+			b.servers[serverName] = server
+		}
+		server.Failures++
+		server.RetryAfter = now.Add(b.duration(server.Failures))
+	}
+}
+
+// prune forgets about the keys that are no longer remembered as not found,
+// and the servers whose backoff expired more than twice the maximum backoff
+// ago, so that their failures no longer count towards the next backoff. It
+// does so at most once every
+// keyFetchBackoffPruneInterval so that the cost is spread over many calls.
+// The caller must hold the mutex.
+func (b *keyFetchBackoff) prune(now time.Time) {
+	if now.Sub(b.lastPrune) < keyFetchBackoffPruneInterval {
+		return
+	}
+	b.lastPrune = now
+	for serverName, server := range b.servers {
+		if now.Sub(server.RetryAfter) > 2*b.maximum {
+			delete(b.servers, serverName)
+		}
+	}
+	for req, until := range b.notFound {
+		if !now.Before(until) {
+			delete(b.notFound, req)
+		}
+	}
+}
+
+// duration returns how long to back off for after the given number of
+// consecutive failures.
+func (b *keyFetchBackoff) duration(failures int) time.Duration {
+	backoff := b.initial
+	for i := 1; i < failures && backoff < b.maximum; i++ {
+		backoff *= 2
+	}
+	if backoff > b.maximum {
+		backoff = b.maximum
+	}
+	return backoff
+}
+
+// backoffs returns the servers that are currently backed off, sorted by name.
+func (b *keyFetchBackoff) backoffs() []KeyFetchBackoff {
+	now := b.now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var backoffs []KeyFetchBackoff
+	for _, server := range b.servers {
+		if now.Before(server.RetryAfter) {
+			backoffs = append(backoffs, *server)
+		}
+	}
+	sort.Slice(backoffs, func(i, j int) bool {
+		return backoffs[i].ServerName < backoffs[j].ServerName
+	})
+	return backoffs
+}
+
+// backoff returns the server's backoff if it is currently backed off.
+func (b *keyFetchBackoff) backoff(serverName ServerName) (KeyFetchBackoff, bool) {
+	now := b.now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if server, ok := b.servers[serverName]; ok && now.Before(server.RetryAfter) {
+		return *server, true
+	}
+	return KeyFetchBackoff{}, false
+}
+
+// notFoundKeys returns the keys that are currently remembered as not found,
+// along with when they will next be fetched.
+func (b *keyFetchBackoff) notFoundKeys() map[PublicKeyLookupRequest]time.Time {
+	now := b.now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	keys := map[PublicKeyLookupRequest]time.Time{}
+	for req, until := range b.notFound {
+		if now.Before(until) {
+			keys[req] = until
+		}
+	}
+	return keys
+}
+
+// reset forgets the backoff state for the given servers, or for all servers
+// if none are given.
+func (b *keyFetchBackoff) reset(serverNames []ServerName) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(serverNames) == 0 {
+		b.servers = map[ServerName]*KeyFetchBackoff{}
+		b.notFound = map[PublicKeyLookupRequest]time.Time{}
+		return
+	}
+	for _, serverName := range serverNames {
+		delete(b.servers, serverName)
+		for req := range b.notFound {
+			if req.ServerName == serverName {
+				delete(b.notFound, req)
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingKeyFetcher is a KeyFetcher which counts the keys requested from it,
+// only has keys for reachable.server and can't reach unreachable.server.
+type countingKeyFetcher struct {
+	requested map[PublicKeyLookupRequest]int
+}
+
+func (f *countingKeyFetcher) FetchKeys(ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	errs := ServerKeyFetchErrors{}
+	for req := range requests {
+		f.requested[req]++
+		switch req.ServerName {
+		case "reachable.server":
+			results[PublicKeyLookupRequest{"reachable.server", "ed25519:a"}] = PublicKeyLookupResult{}
+		case "unreachable.server":
+			errs[req.ServerName] = errors.New("connection refused")
+		}
+	}
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+func (f *countingKeyFetcher) FetcherName() string {
+	return "countingKeyFetcher"
+}
+
+func TestKeyFetchBackoff(t *testing.T) {
+	fetcher := &countingKeyFetcher{requested: map[PublicKeyLookupRequest]int{}}
+	k := NewKeyRing(
+		[]KeyFetcher{fetcher}, &testKeyDatabase{},
+		WithKeyFetchBackoff(10*time.Second, 30*time.Second),
+		WithNotFoundKeyTTL(5*time.Second),
+	)
+	now := time.Unix(1000, 0)
+	k.state().backoff.now = func() time.Time { return now }
+
+	unreachable := PublicKeyLookupRequest{"unreachable.server", "ed25519:a"}
+	missing := PublicKeyLookupRequest{"reachable.server", "ed25519:missing"}
+	verify := func() {
+		for _, req := range []PublicKeyLookupRequest{unreachable, missing} {
+			message := `{"signatures": {"` + string(req.ServerName) + `": {"` + string(req.KeyID) + `": "signature_here"}}}`
+			_, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
+				ServerName: req.ServerName,
+				Message:    []byte(message),
+				AtTS:       1493142432964,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expectRequested := func(unreachableCount, missingCount int) {
+		t.Helper()
+		if fetcher.requested[unreachable] != unreachableCount || fetcher.requested[missing] != missingCount {
+			t.Fatalf(
+				"wanted %d requests for the unreachable server and %d for the missing key, got %d and %d",
+				unreachableCount, missingCount, fetcher.requested[unreachable], fetcher.requested[missing],
+			)
+		}
+	}
+
+	verify()
+	verify()
+	expectRequested(1, 1)
+	backoffs := k.KeyFetchBackoffs()
+	if len(backoffs) != 1 || backoffs[0].ServerName != "unreachable.server" || backoffs[0].Failures != 1 ||
+		!backoffs[0].RetryAfter.Equal(now.Add(10*time.Second)) {
+		t.Fatalf("unexpected backoffs: %#v", backoffs)
+	}
+	if notFound := k.NotFoundKeys(); len(notFound) != 1 || !notFound[missing].Equal(now.Add(5*time.Second)) {
+		t.Fatalf("unexpected not found keys: %#v", notFound)
+	}
+
+	// The missing key is fetched again once it has been forgotten, but the
+	// server stays backed off.
+	now = now.Add(6 * time.Second)
+	verify()
+	expectRequested(1, 2)
+
+	// The backoff doubles with each failure, up to the maximum.
+	for i, want := range []time.Duration{20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		now = now.Add(time.Minute)
+		verify()
+		expectRequested(i+2, i+3)
+		if backoffs = k.KeyFetchBackoffs(); len(backoffs) != 1 || !backoffs[0].RetryAfter.Equal(now.Add(want)) {
+			t.Fatalf("wanted a backoff of %s, got %#v", want, backoffs)
+		}
+	}
+
+	k.ResetKeyFetchBackoff("unreachable.server")
+	if backoffs = k.KeyFetchBackoffs(); len(backoffs) != 0 {
+		t.Fatalf("wanted no backoffs after reset, got %#v", backoffs)
+	}
+	verify()
+	expectRequested(5, 5)
+
+	k.ResetKeyFetchBackoff()
+	verify()
+	expectRequested(6, 6)
+}
+
+func TestKeyFetchBackoffOnlyForUnreachableServers(t *testing.T) {
+	fetcher := &countingKeyFetcher{requested: map[PublicKeyLookupRequest]int{}}
+	k := NewKeyRing([]KeyFetcher{fetcher}, &testKeyDatabase{}, WithNotFoundKeyTTL(5*time.Second))
+	now := time.Unix(1000, 0)
+	k.state().backoff.now = func() time.Time { return now }
+
+	// The server responds without any keys, so only the requested key is
+	// remembered as not found and other keys are still fetched.
+	bogus := PublicKeyLookupRequest{"empty.server", "ed25519:bogus"}
+	other := PublicKeyLookupRequest{"empty.server", "ed25519:other"}
+	for _, req := range []PublicKeyLookupRequest{bogus, bogus, other} {
+		k.fetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 1493142432964})
+	}
+	if fetcher.requested[bogus] != 1 || fetcher.requested[other] != 1 {
+		t.Fatalf("wanted 1 request for each key, got %d and %d", fetcher.requested[bogus], fetcher.requested[other])
+	}
+	if backoffs := k.KeyFetchBackoffs(); len(backoffs) != 0 {
+		t.Fatalf("wanted no backoffs, got %#v", backoffs)
+	}
+	if notFound := k.NotFoundKeys(); len(notFound) != 2 || !notFound[bogus].Equal(now.Add(5*time.Second)) {
+		t.Fatalf("unexpected not found keys: %#v", notFound)
+	}
+}
+
+func TestKeyFetchBackoffPrunesExpiredEntries(t *testing.T) {
+	fetcher := &countingKeyFetcher{requested: map[PublicKeyLookupRequest]int{}}
+	k := NewKeyRing(
+		[]KeyFetcher{fetcher}, &testKeyDatabase{},
+		WithKeyFetchBackoff(10*time.Second, 30*time.Second),
+		WithNotFoundKeyTTL(5*time.Second),
+	)
+	now := time.Unix(1000, 0)
+	backoff := k.state().backoff
+	backoff.now = func() time.Time { return now }
+
+	unreachable := PublicKeyLookupRequest{"unreachable.server", "ed25519:a"}
+	missing := PublicKeyLookupRequest{"reachable.server", "ed25519:missing"}
+	for _, req := range []PublicKeyLookupRequest{unreachable, missing} {
+		k.fetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 1493142432964})
+	}
+	if len(backoff.servers) != 1 || len(backoff.notFound) != 1 {
+		t.Fatalf("wanted a backoff and a not found key, got %#v and %#v", backoff.servers, backoff.notFound)
+	}
+
+	// Recording the results for another server prunes the expired entries.
+	now = now.Add(2 * time.Minute)
+	other := PublicKeyLookupRequest{"reachable.server", "ed25519:a"}
+	k.fetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{other: 1493142432964})
+	if len(backoff.servers) != 0 || len(backoff.notFound) != 0 {
+		t.Fatalf("wanted expired entries pruned, got %#v and %#v", backoff.servers, backoff.notFound)
+	}
+}
@@ -0,0 +1,116 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyFetchStats counts the keys that a KeyRing has asked its KeyFetchers for.
+type KeyFetchStats struct {
+	// The number of keys that were requested from the KeyFetchers.
+	Requested uint64
+	// The number of keys that weren't requested from the KeyFetchers because
+	// a concurrent VerifyJSONs call was already fetching them.
+	Coalesced uint64
+}
+
+// keyFetchCoalescer tracks the keys that are currently being fetched so
+// that concurrent VerifyJSONs calls share a single fetch for each key.
+type keyFetchCoalescer struct {
+	// These are first so that they are 64-bit aligned for atomic access.
+	requested uint64
+	coalesced uint64
+	mutex     sync.Mutex
+	inFlight  map[PublicKeyLookupRequest]*inFlightKeyFetch
+}
+
+// An inFlightKeyFetch is a fetch for a single key, which asked for a copy
+// valid until at least atTS. The result and ok fields must only be read after
+// done is closed.
+type inFlightKeyFetch struct {
+	atTS   Timestamp
+	done   chan struct{}
+	result PublicKeyLookupResult
+	ok     bool
+}
+
+func newKeyFetchCoalescer() *keyFetchCoalescer {
+	return &keyFetchCoalescer{
+		inFlight: map[PublicKeyLookupRequest]*inFlightKeyFetch{},
+	}
+}
+
+// claim returns the requests that the caller must now fetch because nobody
+// else is fetching them, and the fetches to wait on for all of the requests,
+// including the claimed ones. A fetch is only shared if it asked for a copy of
+// the key that is valid for at least as long as the request needs, since
+// otherwise it might not be valid for long enough. The caller must call
+// complete with the keys it claimed once it has fetched them.
+func (c *keyFetchCoalescer) claim(
+	requests map[PublicKeyLookupRequest]Timestamp,
+) (claimed map[PublicKeyLookupRequest]Timestamp, waiting map[PublicKeyLookupRequest]*inFlightKeyFetch) {
+	claimed = map[PublicKeyLookupRequest]Timestamp{}
+	waiting = map[PublicKeyLookupRequest]*inFlightKeyFetch{}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for req, ts := range requests {
+		fetch, ok := c.inFlight[req]
+		if !ok || fetch.atTS < ts {
+			// Later requests for the key share this fetch rather than the
+			// one it replaces, which still completes for those waiting on it.
+			fetch = &inFlightKeyFetch{atTS: ts, done: make(chan struct{})}
+			c.inFlight[req] = fetch
+			claimed[req] = ts
+		}
+		waiting[req] = fetch
+	}
+	atomic.AddUint64(&c.requested, uint64(len(claimed)))
+	atomic.AddUint64(&c.coalesced, uint64(len(waiting)-len(claimed)))
+	return
+}
+
+// complete publishes the results for the claimed keys to anyone waiting on
+// them. Claimed keys that aren't in the results are reported as not found.
+// The waiting fetches are the ones returned by claim.
+func (c *keyFetchCoalescer) complete(
+	claimed map[PublicKeyLookupRequest]Timestamp,
+	waiting map[PublicKeyLookupRequest]*inFlightKeyFetch,
+	results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for req := range claimed {
+		fetch := waiting[req]
+		if c.inFlight[req] == fetch {
+			delete(c.inFlight, req)
+		}
+		fetch.result, fetch.ok = results[req]
+		close(fetch.done)
+	}
+}
+
+// wait waits for keys that are being fetched by someone else and adds the
+// ones that were found to the results. Gives up if the context is done.
+func (c *keyFetchCoalescer) wait(
+	ctx context.Context, waiting map[PublicKeyLookupRequest]*inFlightKeyFetch,
+	results map[PublicKeyLookupRequest]PublicKeyLookupResult,
+) {
+	for req, fetch := range waiting {
+		select {
+		case <-fetch.done:
+			if fetch.ok {
+				results[req] = fetch.result
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *keyFetchCoalescer) stats() KeyFetchStats {
+	return KeyFetchStats{
+		Requested: atomic.LoadUint64(&c.requested),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
+	}
+}
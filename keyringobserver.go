@@ -0,0 +1,223 @@
+package gomatrixserverlib
+
+import (
+	"sync"
+	"time"
+)
+
+// A VerifyFailureReason is why a KeyRing rejected a signed JSON message.
+type VerifyFailureReason string
+
+const (
+	// VerifyFailureMalformed means the key IDs couldn't be read from the message.
+	VerifyFailureMalformed VerifyFailureReason = "malformed"
+	// VerifyFailureNoSupportedSignature means the message wasn't signed by
+	// the server with a supported algorithm.
+	VerifyFailureNoSupportedSignature VerifyFailureReason = "no_supported_signature"
+	// VerifyFailureKeyNotFound means none of the keys that signed the message
+	// could be found.
+	VerifyFailureKeyNotFound VerifyFailureReason = "key_not_found"
+	// VerifyFailureKeyNotValid means the key wasn't valid at the time the
+	// message needed it to be.
+	VerifyFailureKeyNotValid VerifyFailureReason = "key_not_valid"
+	// VerifyFailureBadSignature means the signature didn't match the key.
+	VerifyFailureBadSignature VerifyFailureReason = "bad_signature"
+)
+
+// A KeyRingObserver is told what a KeyRing is doing, e.g. to export metrics.
+// Implementations must be safe for concurrent use and shouldn't block.
+type KeyRingObserver interface {
+	// OnKeyCacheLookup is called after looking up keys in the KeyDatabase
+	// with the number of keys that could be used as they were and the number
+	// that had to be fetched.
+	OnKeyCacheLookup(hits, misses int)
+	// OnKeyFetch is called after asking a KeyFetcher for keys.
+	OnKeyFetch(fetcherName string, latency time.Duration, requested, fetched int, err error)
+	// OnKeyFetchFailure is called when none of the KeyFetchers returned any
+	// keys for a server.
+	OnKeyFetchFailure(serverName ServerName)
+	// OnVerifyFailure is called for each message that failed verification.
+	OnVerifyFailure(serverName ServerName, reason VerifyFailureReason)
+	// OnKeysStored is called with the number of keys fetched by the
+	// KeyFetchers that were written to the KeyDatabase.
+	OnKeysStored(count int)
+	// OnKeyCount is called with the number of keys in the KeyDatabase after
+	// keys are written to it, if the KeyDatabase has a Len method that
+	// returns it, like MemoryKeyDatabase and FileKeyDatabase do.
+	OnKeyCount(count int)
+}
+
+// WithKeyRingObserver sets the observer that a KeyRing reports to.
+func WithKeyRingObserver(observer KeyRingObserver) KeyRingOption {
+	return func(k *KeyRing) {
+		k.state().observer = observer
+	}
+}
+
+// NoopKeyRingObserver is a KeyRingObserver which does nothing. It is used
+// when a KeyRing doesn't have an observer.
+type NoopKeyRingObserver struct{}
+
+// OnKeyCacheLookup implements KeyRingObserver
+func (NoopKeyRingObserver) OnKeyCacheLookup(hits, misses int) {}
+
+// OnKeyFetch implements KeyRingObserver
+func (NoopKeyRingObserver) OnKeyFetch(fetcherName string, latency time.Duration, requested, fetched int, err error) {
+}
+
+// OnKeyFetchFailure implements KeyRingObserver
+func (NoopKeyRingObserver) OnKeyFetchFailure(serverName ServerName) {}
+
+// OnVerifyFailure implements KeyRingObserver
+func (NoopKeyRingObserver) OnVerifyFailure(serverName ServerName, reason VerifyFailureReason) {}
+
+// OnKeysStored implements KeyRingObserver
+func (NoopKeyRingObserver) OnKeysStored(count int) {}
+
+// OnKeyCount implements KeyRingObserver
+func (NoopKeyRingObserver) OnKeyCount(count int) {}
+
+// KeyFetcherStats are the aggregated calls to a single KeyFetcher.
+type KeyFetcherStats struct {
+	Calls         uint64
+	Errors        uint64
+	KeysRequested uint64
+	KeysFetched   uint64
+	TotalLatency  time.Duration
+	MaxLatency    time.Duration
+}
+
+// KeyRingStats are the aggregated observations of a MemoryKeyRingObserver.
+type KeyRingStats struct {
+	CacheHits   uint64
+	CacheMisses uint64
+	// By FetcherName.
+	Fetchers       map[string]KeyFetcherStats
+	ServerFailures map[ServerName]uint64
+	VerifyFailures map[VerifyFailureReason]uint64
+	KeysStored     uint64
+	// The number of keys in the KeyDatabase when it was last counted.
+	KeyCount int
+}
+
+// MemoryKeyRingObserver is a KeyRingObserver which adds up what it is told
+// so that it can be queried, e.g. by tests or an admin endpoint.
+// The zero value is ready to use.
+type MemoryKeyRingObserver struct {
+	mutex sync.Mutex
+	stats KeyRingStats
+}
+
+// OnKeyCacheLookup implements KeyRingObserver
+func (o *MemoryKeyRingObserver) OnKeyCacheLookup(hits, misses int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.stats.CacheHits += uint64(hits)
+	o.stats.CacheMisses += uint64(misses)
+}
+
+// OnKeyFetch implements KeyRingObserver
+func (o *MemoryKeyRingObserver) OnKeyFetch(fetcherName string, latency time.Duration, requested, fetched int, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.stats.Fetchers == nil {
+		o.stats.Fetchers = map[string]KeyFetcherStats{}
+	}
+	stats := o.stats.Fetchers[fetcherName]
+	stats.Calls++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.KeysRequested += uint64(requested)
+	stats.KeysFetched += uint64(fetched)
+	stats.TotalLatency += latency
+	if latency > stats.MaxLatency {
+		stats.MaxLatency = latency
+	}
+	o.stats.Fetchers[fetcherName] = stats
+}
+
+// OnKeyFetchFailure implements KeyRingObserver
+func (o *MemoryKeyRingObserver) OnKeyFetchFailure(serverName ServerName) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.stats.ServerFailures == nil {
+		o.stats.ServerFailures = map[ServerName]uint64{}
+	}
+	o.stats.ServerFailures[serverName]++
+}
+
+// OnVerifyFailure implements KeyRingObserver
+func (o *MemoryKeyRingObserver) OnVerifyFailure(serverName ServerName, reason VerifyFailureReason) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.stats.VerifyFailures == nil {
+		o.stats.VerifyFailures = map[VerifyFailureReason]uint64{}
+	}
+	o.stats.VerifyFailures[reason]++
+}
+
+// OnKeysStored implements KeyRingObserver
+func (o *MemoryKeyRingObserver) OnKeysStored(count int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.stats.KeysStored += uint64(count)
+}
+
+// OnKeyCount implements KeyRingObserver
+func (o *MemoryKeyRingObserver) OnKeyCount(count int) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.stats.KeyCount = count
+}
+
+// Stats returns a copy of the aggregated observations.
+func (o *MemoryKeyRingObserver) Stats() KeyRingStats {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	stats := o.stats
+	stats.Fetchers = map[string]KeyFetcherStats{}
+	for name, s := range o.stats.Fetchers {
+		stats.Fetchers[name] = s
+	}
+	stats.ServerFailures = map[ServerName]uint64{}
+	for serverName, n := range o.stats.ServerFailures {
+		stats.ServerFailures[serverName] = n
+	}
+	stats.VerifyFailures = map[VerifyFailureReason]uint64{}
+	for reason, n := range o.stats.VerifyFailures {
+		stats.VerifyFailures[reason] = n
+	}
+	return stats
+}
+
+// observe returns the observer for the KeyRing.
+func (k KeyRing) observe() KeyRingObserver {
+	if k.state().observer == nil {
+		return NoopKeyRingObserver{}
+	}
+	return k.state().observer
+}
+
+// observeKeysStored tells the observer that keys were stored in the
+// KeyDatabase, and how many keys it now has if it can count them.
+func (k KeyRing) observeKeysStored(count int) {
+	observer := k.observe()
+	observer.OnKeysStored(count)
+	if counter, ok := k.KeyDatabase.(interface{ Len() int }); ok {
+		observer.OnKeyCount(counter.Len())
+	}
+}
+
+// observeVerifyFailures tells the observer about the messages that failed
+// verification.
+func (k KeyRing) observeVerifyFailures(
+	requests []VerifyJSONRequest, results []VerifyJSONResult, reasons []VerifyFailureReason,
+) {
+	observer := k.observe()
+	for i := range results {
+		if results[i].Error != nil {
+			observer.OnVerifyFailure(requests[i].ServerName, reasons[i])
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyRingObserver(t *testing.T) {
+	now := time.Now()
+	message, _, _, db := setupRefreshTest(t, AsTimestamp(now.Add(24*time.Hour)))
+	tampered := []byte(strings.Replace(string(message), "hello", "goodbye", 1))
+	unknown := []byte(`{"signatures": {"unknown.server": {"ed25519:1": "signature_here"}}}`)
+	fetcher := &recordingKeyFetcher{err: ServerKeyFetchErrors{"unknown.server": errors.New("connection refused")}}
+	observer := &MemoryKeyRingObserver{}
+	k := NewKeyRing([]KeyFetcher{fetcher}, db, WithKeyRingObserver(observer), WithKeyRefreshWindow(0))
+
+	var requests []VerifyJSONRequest
+	for _, req := range []struct {
+		serverName ServerName
+		message    []byte
+	}{
+		{"remote.server", message},
+		{"remote.server", tampered},
+		{"unknown.server", unknown},
+		{"remote.server", []byte("not JSON")},
+	} {
+		requests = append(requests, VerifyJSONRequest{ServerName: req.serverName, Message: req.message, AtTS: AsTimestamp(now)})
+	}
+	results, err := k.VerifyJSONs(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Fatalf("the valid message failed verification: %s", results[0].Error)
+	}
+
+	stats := observer.Stats()
+	fetcherStats := stats.Fetchers["recordingKeyFetcher"]
+	stats.Fetchers = nil
+	want := KeyRingStats{
+		CacheHits:      1,
+		CacheMisses:    1,
+		ServerFailures: map[ServerName]uint64{"unknown.server": 1},
+		VerifyFailures: map[VerifyFailureReason]uint64{
+			VerifyFailureBadSignature: 1,
+			VerifyFailureKeyNotFound:  1,
+			VerifyFailureMalformed:    1,
+		},
+		// The key for remote.server came from the database rather than a
+		// fetcher, so it isn't counted as stored.
+		KeysStored: 0,
+		KeyCount:   1,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("wanted %#v, got %#v", want, stats)
+	}
+	if fetcherStats.Calls != 1 || fetcherStats.Errors != 1 || fetcherStats.KeysRequested != 1 || fetcherStats.KeysFetched != 0 {
+		t.Errorf("unexpected fetcher stats: %#v", fetcherStats)
+	}
+}
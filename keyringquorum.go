@@ -0,0 +1,215 @@
+package gomatrixserverlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/util"
+)
+
+// A KeyDisagreement is reported by a QuorumKeyFetcher when its fetchers
+// return different keys for the same key ID.
+type KeyDisagreement struct {
+	Request PublicKeyLookupRequest
+	// The result returned by each fetcher that returned one, by FetcherName.
+	Results map[string]PublicKeyLookupResult
+	// Whether enough of the fetchers agreed for a key to be returned anyway.
+	Accepted bool
+}
+
+// A QuorumKeyFetcher fetches keys from several KeyFetchers concurrently,
+// usually PerspectiveKeyFetchers for different notary servers, and only
+// returns a key when enough of them return the same key. This protects
+// against a single notary server being compromised.
+type QuorumKeyFetcher struct {
+	// The fetchers to ask for keys. Their FetcherNames must be distinct.
+	Fetchers []KeyFetcher
+	// The number of fetchers that must return the same key bytes for a key
+	// to be returned. If zero then a majority of the fetchers is required.
+	// The key is returned with the longest validity that this many of the
+	// fetchers agree on. Must not be more than the number of fetchers.
+	Quorum int
+	// Optional. Called for each key that the fetchers disagree about.
+	OnDisagreement func(ctx context.Context, disagreement KeyDisagreement)
+}
+
+// FetcherName implements KeyFetcher
+func (q *QuorumKeyFetcher) FetcherName() string {
+	return fmt.Sprintf("quorum of %d out of %d fetchers", q.quorum(), len(q.Fetchers))
+}
+
+func (q *QuorumKeyFetcher) quorum() int {
+	if q.Quorum > 0 {
+		return q.Quorum
+	}
+	return len(q.Fetchers)/2 + 1
+}
+
+// validate returns an error if the QuorumKeyFetcher is misconfigured.
+func (q *QuorumKeyFetcher) validate() error {
+	if q.Quorum > len(q.Fetchers) {
+		return fmt.Errorf("gomatrixserverlib: quorum of %d is more than the %d fetchers", q.Quorum, len(q.Fetchers))
+	}
+	names := make(map[string]bool, len(q.Fetchers))
+	for _, fetcher := range q.Fetchers {
+		name := fetcher.FetcherName()
+		if names[name] {
+			return fmt.Errorf("gomatrixserverlib: more than one fetcher is named %q", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// FetchKeys implements KeyFetcher
+// Returns an error if all of the fetchers failed, or a ServerKeyFetchErrors
+// along with the keys that were fetched if none of the fetchers could reach
+// some of the servers.
+func (q *QuorumKeyFetcher) FetchKeys(
+	ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp,
+) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	type fetcherResults struct {
+		name    string
+		results map[PublicKeyLookupRequest]PublicKeyLookupResult
+		err     error
+	}
+	responses := make([]fetcherResults, len(q.Fetchers))
+	var wg sync.WaitGroup
+	for i, fetcher := range q.Fetchers {
+		wg.Add(1)
+		go func(i int, fetcher KeyFetcher) {
+			defer wg.Done()
+			// Each fetcher gets its own copy of the requests in case it
+			// modifies them.
+			copied := make(map[PublicKeyLookupRequest]Timestamp, len(requests))
+			for req, ts := range requests {
+				copied[req] = ts
+			}
+			results, err := fetcher.FetchKeys(ctx, copied)
+			responses[i] = fetcherResults{fetcher.FetcherName(), results, err}
+		}(i, fetcher)
+	}
+	wg.Wait()
+
+	// Collect the results for each key from each fetcher. A fetcher that
+	// only failed to reach some of the servers still counts towards the
+	// quorum for the keys that it did return.
+	byRequest := map[PublicKeyLookupRequest]map[string]PublicKeyLookupResult{}
+	var lastErr error
+	failed := 0
+	serverFailures := map[ServerName]int{}
+	serverErrs := ServerKeyFetchErrors{}
+	for _, response := range responses {
+		var responseServerErrs ServerKeyFetchErrors
+		if errors.As(response.err, &responseServerErrs) {
+			util.GetLogger(ctx).WithError(response.err).WithField("fetcher", response.name).
+				Warn("Failed to request keys from some servers for quorum")
+			for serverName, err := range responseServerErrs {
+				serverFailures[serverName]++
+				serverErrs[serverName] = err
+			}
+		} else if response.err != nil {
+			util.GetLogger(ctx).WithError(response.err).WithField("fetcher", response.name).
+				Warn("Failed to request keys from fetcher for quorum")
+			lastErr = response.err
+			failed++
+			continue
+		}
+		for req, res := range response.results {
+			if byRequest[req] == nil {
+				byRequest[req] = map[string]PublicKeyLookupResult{}
+			}
+			byRequest[req][response.name] = res
+		}
+	}
+	if failed > 0 && failed == len(q.Fetchers) {
+		return nil, fmt.Errorf("gomatrixserverlib: all %d fetchers failed: %w", failed, lastErr)
+	}
+
+	results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+	for req, byFetcher := range byRequest {
+		res, agreed, disagreed := quorumResult(byFetcher, q.quorum())
+		accepted := agreed >= q.quorum()
+		if accepted {
+			results[req] = res
+		}
+		if disagreed && q.OnDisagreement != nil {
+			q.OnDisagreement(ctx, KeyDisagreement{
+				Request:  req,
+				Results:  byFetcher,
+				Accepted: accepted,
+			})
+		}
+	}
+
+	// Only report the servers that none of the fetchers could reach.
+	unreached := ServerKeyFetchErrors{}
+	for serverName, failures := range serverFailures {
+		if failures+failed == len(q.Fetchers) {
+			unreached[serverName] = serverErrs[serverName]
+		}
+	}
+	if len(unreached) > 0 {
+		return results, unreached
+	}
+	return results, nil
+}
+
+// quorumResult finds the key bytes returned by the most fetchers and returns
+// a result with those bytes, how many fetchers returned them, and whether any
+// fetcher returned different bytes. The notaries may have cached copies of
+// different ages, so the result is the one with the longest validity that at
+// least quorum of the fetchers returned. If different bytes were returned by
+// the same number of fetchers then none of them win and the count is zero.
+func quorumResult(byFetcher map[string]PublicKeyLookupResult, quorum int) (
+	best PublicKeyLookupResult, agreed int, disagreed bool,
+) {
+	var groups [][]PublicKeyLookupResult
+	for _, res := range byFetcher {
+		found := false
+		for i, g := range groups {
+			if bytes.Equal(g[0].Key, res.Key) {
+				groups[i] = append(g, res)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, []PublicKeyLookupResult{res})
+		}
+	}
+	var bestGroup []PublicKeyLookupResult
+	tied := false
+	for _, g := range groups {
+		switch {
+		case len(g) > agreed:
+			bestGroup, agreed, tied = g, len(g), false
+		case len(g) == agreed:
+			tied = true
+		}
+	}
+	if tied {
+		return PublicKeyLookupResult{}, 0, true
+	}
+	// Sort the results so that those valid for longest come first.
+	validUntil := func(res PublicKeyLookupResult) Timestamp {
+		if res.ExpiredTS != PublicKeyNotExpired {
+			return res.ExpiredTS
+		}
+		return res.ValidUntilTS
+	}
+	sort.Slice(bestGroup, func(i, j int) bool {
+		return validUntil(bestGroup[i]) > validUntil(bestGroup[j])
+	})
+	if quorum > agreed {
+		quorum = agreed
+	}
+	return bestGroup[quorum-1], agreed, len(groups) > 1
+}
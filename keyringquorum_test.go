@@ -0,0 +1,92 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// fixedKeyFetcher is a KeyFetcher which returns the same keys every time.
+type fixedKeyFetcher struct {
+	name string
+	keys map[PublicKeyLookupRequest]PublicKeyLookupResult
+	err  error
+}
+
+func (f *fixedKeyFetcher) FetchKeys(ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	return f.keys, f.err
+}
+
+func (f *fixedKeyFetcher) FetcherName() string {
+	return f.name
+}
+
+func TestQuorumKeyFetcher(t *testing.T) {
+	req := PublicKeyLookupRequest{ServerName: "origin.server", KeyID: "ed25519:1"}
+	notary := func(name, key string, validUntil Timestamp) KeyFetcher {
+		return &fixedKeyFetcher{name: name, keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{
+			req: {VerifyKey: VerifyKey{Key: Base64Bytes(key)}, ValidUntilTS: validUntil},
+		}}
+	}
+	failing := func(name string) KeyFetcher {
+		return &fixedKeyFetcher{name: name, err: fmt.Errorf("unreachable")}
+	}
+	// Returns the key but couldn't reach another server.
+	partial := func(name, key string, validUntil Timestamp) KeyFetcher {
+		fetcher := notary(name, key, validUntil).(*fixedKeyFetcher)
+		fetcher.err = ServerKeyFetchErrors{"other.server": fmt.Errorf("unreachable")}
+		return fetcher
+	}
+
+	tests := []struct {
+		name         string
+		fetchers     []KeyFetcher
+		quorum       int
+		wantKey      string
+		wantValid    Timestamp
+		wantReported bool
+		wantErr      bool
+	}{
+		{"unanimous", []KeyFetcher{notary("a", "good", 1000), notary("b", "good", 2000), notary("c", "good", 1000)}, 0, "good", 1000, false, false},
+		{"agreed validity", []KeyFetcher{notary("a", "good", 3000), notary("b", "good", 1000), notary("c", "good", 2000)}, 0, "good", 2000, false, false},
+		{"majority", []KeyFetcher{notary("a", "good", 1000), notary("b", "evil", 1000), notary("c", "good", 1000)}, 0, "good", 1000, true, false},
+		{"no quorum", []KeyFetcher{notary("a", "good", 1000), notary("b", "evil", 1000), failing("c")}, 0, "", 0, true, false},
+		{"tie", []KeyFetcher{notary("a", "good", 1000), notary("b", "evil", 1000)}, 1, "", 0, true, false},
+		{"explicit quorum", []KeyFetcher{notary("a", "good", 1000), failing("b"), failing("c")}, 1, "good", 1000, false, false},
+		{"partial failure", []KeyFetcher{partial("a", "good", 1000), partial("b", "good", 1000), failing("c")}, 0, "good", 1000, false, true},
+		{"all failed", []KeyFetcher{failing("a"), failing("b")}, 0, "", 0, false, true},
+		{"duplicate names", []KeyFetcher{notary("a", "good", 1000), notary("a", "good", 1000)}, 0, "", 0, false, true},
+		{"quorum too large", []KeyFetcher{notary("a", "good", 1000), notary("b", "good", 1000)}, 3, "", 0, false, true},
+	}
+	for _, test := range tests {
+		var reported []KeyDisagreement
+		q := &QuorumKeyFetcher{
+			Fetchers: test.fetchers,
+			Quorum:   test.quorum,
+			OnDisagreement: func(ctx context.Context, disagreement KeyDisagreement) {
+				reported = append(reported, disagreement)
+			},
+		}
+		results, err := q.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 0})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wanted error %v, got %v", test.name, test.wantErr, err)
+			continue
+		}
+		if serverErrs, ok := err.(ServerKeyFetchErrors); ok && (len(serverErrs) != 1 || serverErrs["other.server"] == nil) {
+			t.Errorf("%s: wanted only other.server to be unreached, got %v", test.name, serverErrs)
+		}
+		res, ok := results[req]
+		if test.wantKey == "" && ok {
+			t.Errorf("%s: wanted no key, got %#v", test.name, res)
+		}
+		if test.wantKey != "" && (string(res.Key) != test.wantKey || res.ValidUntilTS != test.wantValid) {
+			t.Errorf("%s: wanted key %q valid until %d, got %#v", test.name, test.wantKey, test.wantValid, res)
+		}
+		if (len(reported) > 0) != test.wantReported {
+			t.Errorf("%s: wanted disagreement reported %v, got %#v", test.name, test.wantReported, reported)
+		}
+		if len(reported) > 0 && reported[0].Accepted != ok {
+			t.Errorf("%s: the disagreement says accepted is %v but the key was returned %v", test.name, reported[0].Accepted, ok)
+		}
+	}
+}
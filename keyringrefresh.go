@@ -0,0 +1,166 @@
+package gomatrixserverlib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// WithKeyRefreshWindow sets how close to the end of its validity a cached key
+// has to be before a KeyRing fetches a fresher copy of it in the background.
+// The cached key is still used in the meantime so that verifying JSON doesn't
+// have to wait for the fetch. Defaults to an hour. Zero disables background
+// refreshes.
+func WithKeyRefreshWindow(window time.Duration) KeyRingOption {
+	return func(k *KeyRing) {
+		k.state().refresh.window = window
+	}
+}
+
+// WithMaxKeyRefreshes sets how many background refreshes a KeyRing runs at
+// once. Keys that become due for a refresh while that many are running are
+// refreshed by a later VerifyJSONs call instead. Defaults to 4.
+func WithMaxKeyRefreshes(max int) KeyRingOption {
+	return func(k *KeyRing) {
+		k.state().refresh.max = max
+	}
+}
+
+// WithMinKeyRefreshInterval sets how long a KeyRing waits after refreshing a
+// cached key in the background before refreshing it again, in case the
+// fresher copy is still about to expire. Defaults to 10 minutes.
+func WithMinKeyRefreshInterval(interval time.Duration) KeyRingOption {
+	return func(k *KeyRing) {
+		k.state().refresh.interval = interval
+	}
+}
+
+// keyRefresher tracks the keys that are being refreshed in the background.
+type keyRefresher struct {
+	mutex       sync.Mutex
+	window      time.Duration
+	interval    time.Duration
+	max         int
+	running     int
+	closed      bool
+	now         func() time.Time
+	refreshing  map[PublicKeyLookupRequest]struct{}
+	lastRefresh map[PublicKeyLookupRequest]time.Time
+	lastPrune   time.Time
+	wg          sync.WaitGroup
+}
+
+func newKeyRefresher() *keyRefresher {
+	return &keyRefresher{
+		window:      time.Hour,
+		interval:    10 * time.Minute,
+		max:         4,
+		now:         time.Now,
+		refreshing:  map[PublicKeyLookupRequest]struct{}{},
+		lastRefresh: map[PublicKeyLookupRequest]time.Time{},
+	}
+}
+
+// due returns true if the cached key should be refreshed.
+func (r *keyRefresher) due(res PublicKeyLookupResult, now time.Time) bool {
+	if r.window <= 0 || res.ExpiredTS != PublicKeyNotExpired {
+		return false
+	}
+	return res.ValidUntilTS < AsTimestamp(now.Add(r.window))
+}
+
+// claim returns the requests that aren't already being refreshed and weren't
+// refreshed within the minimum interval, and marks them as being refreshed.
+// Returns no requests if too many refreshes are already running or the
+// refresher has been closed. The caller must call done with the requests once
+// it has refreshed them.
+func (r *keyRefresher) claim(
+	requests map[PublicKeyLookupRequest]Timestamp,
+) map[PublicKeyLookupRequest]Timestamp {
+	now := r.now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	claimed := map[PublicKeyLookupRequest]Timestamp{}
+	if r.closed || r.running >= r.max {
+		return claimed
+	}
+	r.prune(now)
+	for req, ts := range requests {
+		if _, ok := r.refreshing[req]; ok {
+			continue
+		}
+		if last, ok := r.lastRefresh[req]; ok && now.Sub(last) < r.interval {
+			continue
+		}
+		r.refreshing[req] = struct{}{}
+		r.lastRefresh[req] = now
+		claimed[req] = ts
+	}
+	if len(claimed) > 0 {
+		r.running++
+		r.wg.Add(1)
+	}
+	return claimed
+}
+
+// prune forgets about the keys that were last refreshed longer ago than the
+// minimum interval, at most once every interval so that the cost is spread
+// over many calls. The caller must hold the mutex.
+func (r *keyRefresher) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < r.interval {
+		return
+	}
+	r.lastPrune = now
+	for req, last := range r.lastRefresh {
+		if now.Sub(last) >= r.interval {
+			delete(r.lastRefresh, req)
+		}
+	}
+}
+
+func (r *keyRefresher) done(requests map[PublicKeyLookupRequest]Timestamp) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for req := range requests {
+		delete(r.refreshing, req)
+	}
+	r.running--
+	r.wg.Done()
+}
+
+// close stops any more refreshes from starting and waits for the running
+// ones to finish.
+func (r *keyRefresher) close() {
+	r.mutex.Lock()
+	r.closed = true
+	r.mutex.Unlock()
+	r.wg.Wait()
+}
+
+// refreshKeys fetches fresher copies of the keys in the background and stores
+// them in the KeyDatabase. The timestamps are the minimum validity to ask for.
+func (k KeyRing) refreshKeys(requests map[PublicKeyLookupRequest]Timestamp) {
+	state := k.state()
+	requests = state.refresh.claim(requests)
+	if len(requests) == 0 {
+		return
+	}
+	go func() {
+		defer state.refresh.done(requests)
+		// The request that noticed the keys were expiring may be long gone
+		// by the time this finishes, so don't use its context.
+		ctx := state.ctx
+		logger := util.GetLogger(ctx).WithField("num_key_requests", len(requests))
+		logger.Info("Refreshing keys that are about to expire")
+		keys := k.fetchKeys(ctx, requests)
+		if len(keys) == 0 {
+			return
+		}
+		if err := k.KeyDatabase.StoreKeys(ctx, keys); err != nil {
+			logger.WithError(err).Warn("Failed to store refreshed keys")
+			return
+		}
+		k.observeKeysStored(len(keys))
+	}()
+}
@@ -0,0 +1,206 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// recordingKeyFetcher is a KeyFetcher which records the requests made to it
+// and returns a fixed set of keys and error.
+type recordingKeyFetcher struct {
+	requests []map[PublicKeyLookupRequest]Timestamp
+	keys     map[PublicKeyLookupRequest]PublicKeyLookupResult
+	err      error
+}
+
+func (f *recordingKeyFetcher) FetchKeys(ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	// Copy the requests since the KeyRing modifies them afterwards.
+	copied := map[PublicKeyLookupRequest]Timestamp{}
+	for req, ts := range requests {
+		copied[req] = ts
+	}
+	f.requests = append(f.requests, copied)
+	return f.keys, f.err
+}
+
+func (f *recordingKeyFetcher) FetcherName() string {
+	return "recordingKeyFetcher"
+}
+
+// setupRefreshTest returns a signed message from remote.server and a
+// database containing the key it was signed with, valid until validUntil.
+func setupRefreshTest(t *testing.T, validUntil Timestamp) ([]byte, PublicKeyLookupRequest, PublicKeyLookupResult, *MemoryKeyDatabase) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := SignJSON("remote.server", "ed25519:1", privateKey, []byte(`{"content":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := PublicKeyLookupRequest{ServerName: "remote.server", KeyID: "ed25519:1"}
+	res := PublicKeyLookupResult{
+		VerifyKey:    VerifyKey{Key: Base64Bytes(publicKey)},
+		ValidUntilTS: validUntil,
+		ExpiredTS:    PublicKeyNotExpired,
+	}
+	db := NewMemoryKeyDatabase(0)
+	if err = db.StoreKeys(context.Background(), map[PublicKeyLookupRequest]PublicKeyLookupResult{req: res}); err != nil {
+		t.Fatal(err)
+	}
+	return message, req, res, db
+}
+
+func TestVerifyJSONsRefreshesExpiringKeys(t *testing.T) {
+	now := time.Now()
+	message, req, res, db := setupRefreshTest(t, AsTimestamp(now.Add(10*time.Minute)))
+	refreshed := res
+	refreshed.ValidUntilTS = AsTimestamp(now.Add(24 * time.Hour))
+	fetcher := &recordingKeyFetcher{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{req: refreshed}}
+	k := NewKeyRing([]KeyFetcher{fetcher}, db, WithKeyRefreshWindow(time.Hour))
+
+	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
+		ServerName:             "remote.server",
+		Message:                message,
+		AtTS:                   AsTimestamp(now),
+		StrictValidityChecking: true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Fatalf("the cached key should still have been used: %s", results[0].Error)
+	}
+	k.state().refresh.wg.Wait()
+
+	if len(fetcher.requests) != 1 {
+		t.Fatalf("wanted one background refresh, got %d", len(fetcher.requests))
+	}
+	if ts := fetcher.requests[0][req]; ts < AsTimestamp(now.Add(time.Hour)) {
+		t.Errorf("wanted the refresh to ask for a key valid for at least the refresh window, got %d", ts)
+	}
+	stored, _ := db.FetchKeys(context.Background(), map[PublicKeyLookupRequest]Timestamp{req: 0})
+	if stored[req].ValidUntilTS != refreshed.ValidUntilTS {
+		t.Errorf("the refreshed key wasn't stored: %#v", stored[req])
+	}
+}
+
+func TestVerifyJSONsRefetchesKeysWithInsufficientValidity(t *testing.T) {
+	now := time.Now()
+	message, req, res, db := setupRefreshTest(t, AsTimestamp(now.Add(time.Hour)))
+	refreshed := res
+	refreshed.ValidUntilTS = AsTimestamp(now.Add(24 * time.Hour))
+	fetcher := &recordingKeyFetcher{keys: map[PublicKeyLookupRequest]PublicKeyLookupResult{req: refreshed}}
+	k := NewKeyRing([]KeyFetcher{fetcher}, db, WithKeyRefreshWindow(0))
+
+	atTS := AsTimestamp(now.Add(2 * time.Hour))
+	results, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
+		ServerName:             "remote.server",
+		Message:                message,
+		AtTS:                   atTS,
+		StrictValidityChecking: true,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Fatalf("the fresher key should have been used: %s", results[0].Error)
+	}
+	if len(fetcher.requests) != 1 || fetcher.requests[0][req] != atTS {
+		t.Fatalf("wanted one request for a key valid until %d, got %v", atTS, fetcher.requests)
+	}
+}
+
+// cancelledKeyFetcher is a KeyFetcher which doesn't return until its context
+// is done.
+type cancelledKeyFetcher struct {
+	started chan struct{}
+}
+
+func (f *cancelledKeyFetcher) FetchKeys(ctx context.Context, requests map[PublicKeyLookupRequest]Timestamp) (map[PublicKeyLookupRequest]PublicKeyLookupResult, error) {
+	f.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *cancelledKeyFetcher) FetcherName() string {
+	return "cancelledKeyFetcher"
+}
+
+func TestKeyRingCloseCancelsRefreshes(t *testing.T) {
+	now := time.Now()
+	message, _, _, db := setupRefreshTest(t, AsTimestamp(now.Add(10*time.Minute)))
+	fetcher := &cancelledKeyFetcher{started: make(chan struct{}, 2)}
+	k := NewKeyRing([]KeyFetcher{fetcher}, db, WithKeyRefreshWindow(time.Hour))
+	verify := func() {
+		if _, err := k.VerifyJSONs(context.Background(), []VerifyJSONRequest{{
+			ServerName: "remote.server",
+			Message:    message,
+			AtTS:       AsTimestamp(now),
+		}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verify()
+	<-fetcher.started
+	closed := make(chan struct{})
+	go func() {
+		k.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close didn't cancel the refresh")
+	}
+
+	// No more refreshes are started once the KeyRing is closed.
+	verify()
+	if len(fetcher.started) != 0 {
+		t.Fatal("a refresh was started after Close")
+	}
+}
+
+func TestKeyRefresherLimitsRefreshes(t *testing.T) {
+	r := newKeyRefresher()
+	r.max = 1
+	a := map[PublicKeyLookupRequest]Timestamp{{ServerName: "a.server", KeyID: "ed25519:1"}: 0}
+	b := map[PublicKeyLookupRequest]Timestamp{{ServerName: "b.server", KeyID: "ed25519:1"}: 0}
+	if claimed := r.claim(a); len(claimed) != 1 {
+		t.Fatalf("wanted to claim the first refresh, got %v", claimed)
+	}
+	if claimed := r.claim(b); len(claimed) != 0 {
+		t.Fatalf("wanted no more refreshes while one is running, got %v", claimed)
+	}
+	r.done(a)
+	if claimed := r.claim(b); len(claimed) != 1 {
+		t.Fatalf("wanted to claim a refresh once the first one finished, got %v", claimed)
+	}
+	r.done(b)
+}
+
+func TestKeyRefresherLimitsRefreshesOfTheSameKey(t *testing.T) {
+	r := newKeyRefresher()
+	r.interval = time.Minute
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	a := map[PublicKeyLookupRequest]Timestamp{{ServerName: "a.server", KeyID: "ed25519:1"}: 0}
+	if claimed := r.claim(a); len(claimed) != 1 {
+		t.Fatalf("wanted to claim the first refresh, got %v", claimed)
+	}
+	r.done(a)
+	now = now.Add(30 * time.Second)
+	if claimed := r.claim(a); len(claimed) != 0 {
+		t.Fatalf("wanted no refresh within the minimum interval, got %v", claimed)
+	}
+	now = now.Add(time.Minute)
+	if claimed := r.claim(a); len(claimed) != 1 {
+		t.Fatalf("wanted to claim a refresh after the minimum interval, got %v", claimed)
+	}
+	r.done(a)
+}
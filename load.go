@@ -11,6 +11,9 @@ type EventLoadResult struct {
 	Event    *HeaderedEvent
 	Error    error
 	SoftFail bool
+	// The ID of the event, which is set even if Error is, unless the event
+	// couldn't be parsed.
+	EventID string
 }
 
 // EventsLoader loads untrusted events and verifies them.
@@ -83,7 +86,8 @@ func (l *EventsLoader) LoadAndVerify(ctx context.Context, rawEvents []json.RawMe
 		if eventErr := failures[i]; eventErr != nil {
 			if results[i].Error == nil { // could have failed earlier
 				results[i] = EventLoadResult{
-					Error: eventErr,
+					Error:   eventErr,
+					EventID: events[i].EventID(),
 				}
 				continue
 			}
@@ -93,7 +97,8 @@ func (l *EventsLoader) LoadAndVerify(ctx context.Context, rawEvents []json.RawMe
 		if err := VerifyEventAuthChain(ctx, h, l.provider); err != nil {
 			if results[i].Error == nil { // could have failed earlier
 				results[i] = EventLoadResult{
-					Error: err,
+					Error:   err,
+					EventID: events[i].EventID(),
 				}
 				continue
 			}
@@ -103,13 +108,15 @@ func (l *EventsLoader) LoadAndVerify(ctx context.Context, rawEvents []json.RawMe
 		if err := VerifyAuthRulesAtState(ctx, l.stateProvider, h, true); err != nil {
 			if results[i].Error == nil { // could have failed earlier
 				results[i] = EventLoadResult{
-					Error: err,
+					Error:   err,
+					EventID: events[i].EventID(),
 				}
 				continue
 			}
 		}
 		results[i] = EventLoadResult{
-			Event: h,
+			Event:   h,
+			EventID: h.EventID(),
 		}
 	}
 
@@ -0,0 +1,354 @@
+package gomatrixserverlib
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// The path prefix of the GET form of the notary query API.
+const notaryQueryPathPrefix = "/_matrix/key/v2/query/"
+
+// A PublicKeyNotaryLookupResponse is the response from a notary server to a
+// PublicKeyNotaryLookupRequest.
+type PublicKeyNotaryLookupResponse struct {
+	ServerKeys []ServerKeys `json:"server_keys"`
+}
+
+// MaxNotaryQueryServerNames is the most servers that a NotaryServer will
+// fetch keys for in a single query.
+const MaxNotaryQueryServerNames = 100
+
+const (
+	// The number of servers whose keys a NotaryServer caches by default.
+	defaultNotaryCacheSize = 1000
+	// The number of servers whose keys a single query fetches at once.
+	notaryQueryWorkers = 8
+	// How long a NotaryServer waits before trying to fetch the keys of a
+	// server again after failing to.
+	notaryFailureTTL = time.Minute
+)
+
+// A NotaryServer answers requests to /_matrix/key/v2/query so that other
+// servers can use this server as a trusted key server. It is the counterpart
+// of PerspectiveKeyFetcher.
+//
+// The keys of each server are fetched directly from that server and cached.
+// The responses keep the server's own signature and are countersigned by this
+// server.
+type NotaryServer struct {
+	// The name of this server.
+	ServerName ServerName
+	// The key to countersign responses with.
+	Signer Signer
+	// The client to fetch keys from other servers with.
+	Client KeyClient
+	// Optional. If set then keys fetched by the notary are added to the
+	// KeyRing's database, and servers that the KeyRing is backing off from
+	// aren't contacted.
+	KeyRing *KeyRing
+	// Optional. The number of servers whose keys are cached, after which
+	// the least recently used are forgotten. Defaults to 1000.
+	CacheSize int
+
+	cache notaryCache
+}
+
+// NewNotaryServer creates a NotaryServer for the given server.
+func NewNotaryServer(serverName ServerName, signer Signer, client KeyClient, keyRing *KeyRing) *NotaryServer {
+	return &NotaryServer{
+		ServerName: serverName,
+		Signer:     signer,
+		Client:     client,
+		KeyRing:    keyRing,
+	}
+}
+
+// QueryKeys returns the keys for the requested servers, countersigned by this
+// server. If the cached keys for a server don't include the requested key IDs
+// or aren't valid until the minimum_valid_until_ts then they are fetched from
+// the server again. Servers whose keys couldn't be fetched are left out.
+// Returns an error if more than MaxNotaryQueryServerNames servers were
+// requested or if the response couldn't be signed.
+func (n *NotaryServer) QueryKeys(
+	ctx context.Context, request PublicKeyNotaryLookupRequest, now time.Time,
+) (PublicKeyNotaryLookupResponse, error) {
+	if len(request.ServerKeys) > MaxNotaryQueryServerNames {
+		return PublicKeyNotaryLookupResponse{}, fmt.Errorf(
+			"gomatrixserverlib: notary query for %d servers, which is more than %d",
+			len(request.ServerKeys), MaxNotaryQueryServerNames,
+		)
+	}
+	response := PublicKeyNotaryLookupResponse{ServerKeys: []ServerKeys{}}
+
+	// Look up the keys for a few servers at a time.
+	type notaryJob struct {
+		serverName ServerName
+		criteria   map[KeyID]PublicKeyNotaryQueryCriteria
+		keys       *ServerKeys
+	}
+	found := make([]*ServerKeys, 0, len(request.ServerKeys))
+	pending := make(chan notaryJob, len(request.ServerKeys))
+	for serverName, criteria := range request.ServerKeys {
+		keys := &ServerKeys{}
+		found = append(found, keys)
+		pending <- notaryJob{serverName, criteria, keys}
+	}
+	close(pending)
+	numWorkers := notaryQueryWorkers
+	if len(found) < numWorkers {
+		numWorkers = len(found)
+	}
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range pending {
+				if result, ok := n.lookup(ctx, job.serverName, job.criteria, now); ok {
+					*job.keys = result
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, keys := range found {
+		if keys.Raw == nil {
+			continue
+		}
+		signed, err := SignJSONWithSigner(string(n.ServerName), n.Signer, keys.Raw)
+		if err != nil {
+			return PublicKeyNotaryLookupResponse{}, err
+		}
+		var countersigned ServerKeys
+		if err = json.Unmarshal(signed, &countersigned); err != nil {
+			return PublicKeyNotaryLookupResponse{}, err
+		}
+		response.ServerKeys = append(response.ServerKeys, countersigned)
+	}
+	return response, nil
+}
+
+// lookup returns the keys for the server, fetching them if the cached keys
+// don't meet the criteria. Returns false if we don't have any keys for the
+// server.
+func (n *NotaryServer) lookup(
+	ctx context.Context, serverName ServerName,
+	criteria map[KeyID]PublicKeyNotaryQueryCriteria, now time.Time,
+) (ServerKeys, bool) {
+	cached, ok := n.cache.get(serverName)
+	if ok && cached.keys.Raw != nil && notaryKeysMeetCriteria(cached.keys, criteria, now) {
+		return cached.keys, true
+	}
+	if ok && now.Before(cached.retryAfter) {
+		return cached.keys, cached.keys.Raw != nil
+	}
+
+	fetched, err := n.fetch(ctx, serverName, now)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("server_name", serverName).
+			Warn("Notary failed to fetch keys for server")
+		// Don't try again for a while, but keep any keys we already had.
+		cached.retryAfter = now.Add(notaryFailureTTL)
+		n.cache.put(serverName, cached, n.cacheSize())
+		return cached.keys, cached.keys.Raw != nil
+	}
+	return n.cache.put(serverName, notaryCacheEntry{keys: fetched}, n.cacheSize()).keys, true
+}
+
+func (n *NotaryServer) cacheSize() int {
+	if n.CacheSize > 0 {
+		return n.CacheSize
+	}
+	return defaultNotaryCacheSize
+}
+
+// notaryKeysMeetCriteria returns true if the keys include every requested key
+// ID and are valid for long enough.
+func notaryKeysMeetCriteria(keys ServerKeys, criteria map[KeyID]PublicKeyNotaryQueryCriteria, now time.Time) bool {
+	if keys.ValidUntilTS <= AsTimestamp(now) {
+		return false
+	}
+	for keyID, c := range criteria {
+		_, current := keys.VerifyKeys[keyID]
+		_, old := keys.OldVerifyKeys[keyID]
+		if keyID != "" && !current && !old {
+			return false
+		}
+		if keys.ValidUntilTS < c.MinimumValidUntilTS {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch fetches the keys directly from the server and checks them.
+func (n *NotaryServer) fetch(ctx context.Context, serverName ServerName, now time.Time) (ServerKeys, error) {
+	if n.KeyRing != nil {
+		if backoff, ok := n.KeyRing.KeyFetchBackoff(serverName); ok {
+			return ServerKeys{}, fmt.Errorf(
+				"gomatrixserverlib: backing off from fetching keys for %q until %s", serverName, backoff.RetryAfter,
+			)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+	keys, err := n.Client.GetServerKeys(ctx, serverName)
+	if err != nil {
+		return ServerKeys{}, err
+	}
+	if checks, _ := CheckKeys(serverName, now, keys); !checks.AllChecksOK {
+		return ServerKeys{}, fmt.Errorf("gomatrixserverlib: key response from %q failed checks", serverName)
+	}
+
+	if n.KeyRing != nil {
+		results := map[PublicKeyLookupRequest]PublicKeyLookupResult{}
+		mapServerKeysToPublicKeyLookupResult(keys, results)
+		if err = n.KeyRing.KeyDatabase.StoreKeys(ctx, results); err != nil {
+			util.GetLogger(ctx).WithError(err).Warn("Notary failed to store keys")
+		}
+	}
+	return keys, nil
+}
+
+// A notaryCacheEntry is the keys that a NotaryServer has for a server.
+type notaryCacheEntry struct {
+	keys ServerKeys
+	// If the last fetch failed then when to fetch the keys again.
+	retryAfter time.Time
+}
+
+// notaryCache is a least recently used cache of the keys for each server.
+// The zero value is ready to use.
+type notaryCache struct {
+	mutex   sync.Mutex
+	entries map[ServerName]*list.Element
+	order   list.List // of *notaryCacheItem, most recently used first
+}
+
+type notaryCacheItem struct {
+	serverName ServerName
+	entry      notaryCacheEntry
+}
+
+func (c *notaryCache) get(serverName ServerName) (notaryCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[serverName]
+	if !ok {
+		return notaryCacheEntry{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*notaryCacheItem).entry, true
+}
+
+// put stores the entry for the server and forgets the least recently used
+// servers if there are more than size. If the entry is for keys that are
+// older than the ones already cached then those are kept instead, since
+// another query may have fetched a fresher copy in the meantime. Returns the
+// entry that is now cached.
+func (c *notaryCache) put(serverName ServerName, entry notaryCacheEntry, size int) notaryCacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[serverName]; ok {
+		item := element.Value.(*notaryCacheItem)
+		if entry.keys.ValidUntilTS >= item.entry.keys.ValidUntilTS {
+			item.entry = entry
+		}
+		c.order.MoveToFront(element)
+		return item.entry
+	}
+	if c.entries == nil {
+		c.entries = map[ServerName]*list.Element{}
+	}
+	c.entries[serverName] = c.order.PushFront(&notaryCacheItem{serverName, entry})
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*notaryCacheItem).serverName)
+	}
+	return entry
+}
+
+// OnQueryRequest handles both a POST to /_matrix/key/v2/query and a GET to
+// /_matrix/key/v2/query/{serverName}/{keyID}, where the key ID is optional
+// and the minimum_valid_until_ts can be given as a query parameter.
+// https://matrix.org/docs/spec/server_server/r0.1.3#query-keys-through-another-server
+func (n *NotaryServer) OnQueryRequest(req *http.Request, now time.Time) util.JSONResponse {
+	var request PublicKeyNotaryLookupRequest
+	switch req.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.MatrixErrorResponse(400, "M_BAD_JSON", "The request body could not be decoded into valid JSON. "+err.Error())
+		}
+		if request.ServerKeys == nil {
+			return util.MatrixErrorResponse(400, "M_BAD_JSON", "Missing server_keys")
+		}
+		if len(request.ServerKeys) > MaxNotaryQueryServerNames {
+			return util.MatrixErrorResponse(
+				400, "M_TOO_LARGE", fmt.Sprintf("Keys can be queried for at most %d servers at once", MaxNotaryQueryServerNames),
+			)
+		}
+	case http.MethodGet:
+		var errRes *util.JSONResponse
+		if request, errRes = parseNotaryQueryPath(req); errRes != nil {
+			return *errRes
+		}
+	default:
+		return util.MatrixErrorResponse(405, "M_UNRECOGNIZED", "Method not allowed")
+	}
+
+	response, err := n.QueryKeys(req.Context(), request, now)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to sign notary response")
+		return util.MessageResponse(500, "Internal Server Error")
+	}
+	return util.JSONResponse{Code: 200, JSON: response}
+}
+
+// parseNotaryQueryPath turns a GET request for
+// /_matrix/key/v2/query/{serverName}/{keyID} into a PublicKeyNotaryLookupRequest.
+func parseNotaryQueryPath(req *http.Request) (PublicKeyNotaryLookupRequest, *util.JSONResponse) {
+	var request PublicKeyNotaryLookupRequest
+	index := strings.Index(req.URL.Path, notaryQueryPathPrefix)
+	if index < 0 {
+		res := util.MatrixErrorResponse(404, "M_UNRECOGNIZED", "Unrecognized request")
+		return request, &res
+	}
+	parts := strings.SplitN(req.URL.Path[index+len(notaryQueryPathPrefix):], "/", 2)
+	serverName := ServerName(parts[0])
+	if serverName == "" {
+		res := util.MatrixErrorResponse(400, "M_INVALID_PARAM", "Missing server name")
+		return request, &res
+	}
+
+	var criteria PublicKeyNotaryQueryCriteria
+	if ts := req.URL.Query().Get("minimum_valid_until_ts"); ts != "" {
+		parsed, err := strconv.ParseUint(ts, 10, 64)
+		if err != nil {
+			res := util.MatrixErrorResponse(400, "M_INVALID_PARAM", "Invalid minimum_valid_until_ts")
+			return request, &res
+		}
+		criteria.MinimumValidUntilTS = Timestamp(parsed)
+	}
+
+	keys := map[KeyID]PublicKeyNotaryQueryCriteria{}
+	if len(parts) == 2 && parts[1] != "" {
+		keys[KeyID(parts[1])] = criteria
+	} else if criteria.MinimumValidUntilTS != 0 {
+		// Without a key ID the criteria apply to the keys as a whole.
+		keys[""] = criteria
+	}
+	request.ServerKeys = map[ServerName]map[KeyID]PublicKeyNotaryQueryCriteria{serverName: keys}
+	return request, nil
+}
@@ -0,0 +1,203 @@
+package gomatrixserverlib_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+// originKeyClient is a KeyClient which serves the keys of origin.server and
+// forwards notary queries to a NotaryServer.
+type originKeyClient struct {
+	privateKey ed25519.PrivateKey
+	validUntil gomatrixserverlib.Timestamp
+	fetches    int
+	notary     *gomatrixserverlib.NotaryServer
+	now        time.Time
+}
+
+func (c *originKeyClient) GetServerKeys(
+	ctx context.Context, matrixServer gomatrixserverlib.ServerName,
+) (gomatrixserverlib.ServerKeys, error) {
+	var keys gomatrixserverlib.ServerKeys
+	if matrixServer != "origin.server" {
+		return keys, fmt.Errorf("unknown server %q", matrixServer)
+	}
+	c.fetches++
+	unsigned, err := json.Marshal(gomatrixserverlib.ServerKeyFields{
+		ServerName: "origin.server",
+		VerifyKeys: map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+			"ed25519:1": {Key: gomatrixserverlib.Base64Bytes(c.privateKey.Public().(ed25519.PublicKey))},
+		},
+		ValidUntilTS: c.validUntil,
+	})
+	if err != nil {
+		return keys, err
+	}
+	signed, err := gomatrixserverlib.SignJSON("origin.server", "ed25519:1", c.privateKey, unsigned)
+	if err != nil {
+		return keys, err
+	}
+	err = json.Unmarshal(signed, &keys)
+	return keys, err
+}
+
+func (c *originKeyClient) LookupServerKeys(
+	ctx context.Context, matrixServer gomatrixserverlib.ServerName,
+	keyRequests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) ([]gomatrixserverlib.ServerKeys, error) {
+	request := gomatrixserverlib.PublicKeyNotaryLookupRequest{
+		ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.PublicKeyNotaryQueryCriteria{},
+	}
+	for req, ts := range keyRequests {
+		request.ServerKeys[req.ServerName] = map[gomatrixserverlib.KeyID]gomatrixserverlib.PublicKeyNotaryQueryCriteria{
+			req.KeyID: {MinimumValidUntilTS: ts},
+		}
+	}
+	response, err := c.notary.QueryKeys(ctx, request, c.now)
+	return response.ServerKeys, err
+}
+
+func setupNotary(t *testing.T, now time.Time) (*originKeyClient, ed25519.PublicKey) {
+	_, originKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notaryPublicKey, notaryKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &originKeyClient{
+		privateKey: originKey,
+		validUntil: gomatrixserverlib.AsTimestamp(now.Add(time.Hour)),
+		now:        now,
+	}
+	client.notary = gomatrixserverlib.NewNotaryServer(
+		"notary.server", gomatrixserverlib.NewEd25519Signer("ed25519:notary", notaryKey), client, nil,
+	)
+	return client, notaryPublicKey
+}
+
+func TestNotaryServerWithPerspectiveKeyFetcher(t *testing.T) {
+	now := time.Now()
+	client, notaryPublicKey := setupNotary(t, now)
+	fetcher := &gomatrixserverlib.PerspectiveKeyFetcher{
+		PerspectiveServerName: "notary.server",
+		PerspectiveServerKeys: map[gomatrixserverlib.KeyID]ed25519.PublicKey{"ed25519:notary": notaryPublicKey},
+		Client:                client,
+	}
+	req := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "origin.server", KeyID: "ed25519:1"}
+	fetch := func(minimumValidUntil gomatrixserverlib.Timestamp) {
+		results, err := fetcher.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: minimumValidUntil,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := results[req]; !ok {
+			t.Fatalf("wanted a key for %v, got %v", req, results)
+		}
+	}
+
+	fetch(gomatrixserverlib.AsTimestamp(now))
+	fetch(gomatrixserverlib.AsTimestamp(now.Add(30 * time.Minute)))
+	if client.fetches != 1 {
+		t.Fatalf("wanted the cached keys to be used, got %d fetches", client.fetches)
+	}
+
+	// Asking for keys valid beyond the cached copy fetches them again.
+	client.validUntil = gomatrixserverlib.AsTimestamp(now.Add(24 * time.Hour))
+	fetch(gomatrixserverlib.AsTimestamp(now.Add(2 * time.Hour)))
+	if client.fetches != 2 {
+		t.Fatalf("wanted the keys to be fetched again, got %d fetches", client.fetches)
+	}
+}
+
+func TestNotaryServerGetRequest(t *testing.T) {
+	now := time.Now()
+	client, notaryPublicKey := setupNotary(t, now)
+
+	req := httptest.NewRequest("GET", "/_matrix/key/v2/query/origin.server/ed25519:1", nil)
+	res := client.notary.OnQueryRequest(req, now)
+	if res.Code != 200 {
+		t.Fatalf("wanted 200, got %d: %#v", res.Code, res.JSON)
+	}
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response gomatrixserverlib.PublicKeyNotaryLookupResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.ServerKeys) != 1 {
+		t.Fatalf("wanted keys for one server, got %s", body)
+	}
+	keys := response.ServerKeys[0]
+	if checks, _ := gomatrixserverlib.CheckKeys("origin.server", now, keys); !checks.AllChecksOK {
+		t.Errorf("the origin's signature wasn't kept: %#v", checks)
+	}
+	if err = gomatrixserverlib.VerifyJSON("notary.server", "ed25519:notary", notaryPublicKey, keys.Raw); err != nil {
+		t.Errorf("the keys weren't countersigned by the notary: %s", err)
+	}
+
+	// An unknown server is left out of the response.
+	req = httptest.NewRequest("GET", "/_matrix/key/v2/query/unknown.server?minimum_valid_until_ts=1000", nil)
+	if res = client.notary.OnQueryRequest(req, now); res.Code != 200 {
+		t.Fatalf("wanted 200, got %d: %#v", res.Code, res.JSON)
+	}
+	if response := res.JSON.(gomatrixserverlib.PublicKeyNotaryLookupResponse); len(response.ServerKeys) != 0 {
+		t.Errorf("wanted no keys for an unknown server, got %#v", response)
+	}
+
+	req = httptest.NewRequest("GET", "/_matrix/key/v2/query/origin.server?minimum_valid_until_ts=soon", nil)
+	if res = client.notary.OnQueryRequest(req, now); res.Code != 400 {
+		t.Errorf("wanted 400 for a bad minimum_valid_until_ts, got %d", res.Code)
+	}
+}
+
+func TestNotaryServerLimits(t *testing.T) {
+	now := time.Now()
+	client, _ := setupNotary(t, now)
+	client.notary.CacheSize = 1
+	query := func(serverNames ...gomatrixserverlib.ServerName) int {
+		request := gomatrixserverlib.PublicKeyNotaryLookupRequest{
+			ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.PublicKeyNotaryQueryCriteria{},
+		}
+		for _, serverName := range serverNames {
+			request.ServerKeys[serverName] = map[gomatrixserverlib.KeyID]gomatrixserverlib.PublicKeyNotaryQueryCriteria{}
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/_matrix/key/v2/query", bytes.NewReader(body))
+		return client.notary.OnQueryRequest(req, now).Code
+	}
+
+	// Only the most recently used servers are cached.
+	for _, serverName := range []gomatrixserverlib.ServerName{"origin.server", "origin.server", "unknown.server", "origin.server"} {
+		if code := query(serverName); code != 200 {
+			t.Fatalf("wanted 200, got %d", code)
+		}
+	}
+	if client.fetches != 2 {
+		t.Errorf("wanted the keys to be fetched again once they were forgotten, got %d fetches", client.fetches)
+	}
+
+	var serverNames []gomatrixserverlib.ServerName
+	for i := 0; i <= gomatrixserverlib.MaxNotaryQueryServerNames; i++ {
+		serverNames = append(serverNames, gomatrixserverlib.ServerName(fmt.Sprintf("server%d.example", i)))
+	}
+	if code := query(serverNames...); code != 400 {
+		t.Errorf("wanted 400 for too many servers, got %d", code)
+	}
+}
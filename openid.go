@@ -0,0 +1,209 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+// The default lifetime of an OpenID access token, as used by Synapse.
+const defaultOpenIDTokenLifetime = time.Hour
+
+// An OpenIDToken is the response to a client requesting an OpenID access
+// token which can be used to identify them to a third party such as an
+// integration manager.
+// https://matrix.org/docs/spec/client_server/r0.6.0#post-matrix-client-r0-user-userid-openid-request-token
+type OpenIDToken struct {
+	AccessToken      string     `json:"access_token"`
+	TokenType        string     `json:"token_type"`
+	MatrixServerName ServerName `json:"matrix_server_name"`
+	// The number of seconds before the access token expires.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// ErrOpenIDTokenNotFound is returned by an OpenIDTokenStore when it doesn't
+// know about the requested token.
+var ErrOpenIDTokenNotFound = fmt.Errorf("gomatrixserverlib: OpenID token not found")
+
+// An OpenIDTokenStore persists issued OpenID access tokens.
+// Implementations must be safe for concurrent use.
+type OpenIDTokenStore interface {
+	// StoreOpenIDToken stores a token issued to the given user which is
+	// valid until the given time.
+	StoreOpenIDToken(ctx context.Context, token, userID string, expiresAt Timestamp) error
+	// LookupOpenIDToken returns the user the token was issued to and the
+	// time that it expires. Returns ErrOpenIDTokenNotFound if there is no
+	// such token.
+	LookupOpenIDToken(ctx context.Context, token string) (userID string, expiresAt Timestamp, err error)
+}
+
+// An OpenIDTokenIssuer issues opaque OpenID access tokens for users on a
+// server and validates them on requests to /_matrix/federation/v1/openid/userinfo.
+// It is the counterpart of Client.LookupUserInfo.
+type OpenIDTokenIssuer struct {
+	// The name of the server that is issuing the tokens.
+	ServerName ServerName
+	// Where the issued tokens are kept.
+	Store OpenIDTokenStore
+	// How long issued tokens are valid for.
+	Lifetime time.Duration
+}
+
+// NewOpenIDTokenIssuer creates an OpenIDTokenIssuer for the given server.
+// If the lifetime is zero then a default of one hour is used.
+func NewOpenIDTokenIssuer(
+	serverName ServerName, store OpenIDTokenStore, lifetime time.Duration,
+) *OpenIDTokenIssuer {
+	if lifetime == 0 {
+		lifetime = defaultOpenIDTokenLifetime
+	}
+	return &OpenIDTokenIssuer{
+		ServerName: serverName,
+		Store:      store,
+		Lifetime:   lifetime,
+	}
+}
+
+// IssueToken issues a new OpenID access token for the given user.
+// Returns an error if the user doesn't belong to this server or if the
+// token couldn't be stored.
+func (i *OpenIDTokenIssuer) IssueToken(
+	ctx context.Context, userID string, now time.Time,
+) (OpenIDToken, error) {
+	_, domain, err := SplitID('@', userID)
+	if err != nil {
+		return OpenIDToken{}, err
+	}
+	if domain != i.ServerName {
+		return OpenIDToken{}, fmt.Errorf(
+			"gomatrixserverlib: user %q does not belong to server %q", userID, i.ServerName,
+		)
+	}
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return OpenIDToken{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	expiresAt := AsTimestamp(now.Add(i.Lifetime))
+	if err = i.Store.StoreOpenIDToken(ctx, token, userID, expiresAt); err != nil {
+		return OpenIDToken{}, err
+	}
+
+	return OpenIDToken{
+		AccessToken:      token,
+		TokenType:        "Bearer",
+		MatrixServerName: i.ServerName,
+		ExpiresIn:        int64(i.Lifetime / time.Second),
+	}, nil
+}
+
+// ValidateToken checks that the OpenID access token was issued by this
+// server and hasn't expired, and returns the user it identifies.
+// Returns ErrOpenIDTokenNotFound if the token is unknown or has expired.
+func (i *OpenIDTokenIssuer) ValidateToken(
+	ctx context.Context, token string, now time.Time,
+) (UserInfo, error) {
+	if token == "" {
+		return UserInfo{}, ErrOpenIDTokenNotFound
+	}
+	userID, expiresAt, err := i.Store.LookupOpenIDToken(ctx, token)
+	if err != nil {
+		return UserInfo{}, err
+	}
+	if AsTimestamp(now) >= expiresAt {
+		return UserInfo{}, ErrOpenIDTokenNotFound
+	}
+	return UserInfo{Sub: userID}, nil
+}
+
+// OnUserInfoRequest handles an incoming request to
+// GET /_matrix/federation/v1/openid/userinfo?access_token=...
+// The request isn't signed so it doesn't need to go through VerifyHTTPRequest.
+// Returns the UserInfo for the token, or a 401 M_UNKNOWN_TOKEN error if the
+// token is unknown or has expired.
+func (i *OpenIDTokenIssuer) OnUserInfoRequest(req *http.Request, now time.Time) util.JSONResponse {
+	if req.Method != http.MethodGet {
+		return util.MatrixErrorResponse(405, "M_UNRECOGNIZED", "Method not allowed")
+	}
+	token := req.URL.Query().Get("access_token")
+	if token == "" {
+		return util.MatrixErrorResponse(401, "M_UNKNOWN_TOKEN", "Access Token missing")
+	}
+
+	info, err := i.ValidateToken(req.Context(), token, now)
+	if err == ErrOpenIDTokenNotFound {
+		return util.MatrixErrorResponse(401, "M_UNKNOWN_TOKEN", "Access Token unknown or expired")
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("Failed to look up OpenID token")
+		return util.MessageResponse(500, "Internal Server Error")
+	}
+
+	return util.JSONResponse{Code: 200, JSON: info}
+}
+
+// The number of tokens a MemoryOpenIDTokenStore must have before it sweeps
+// the expired ones.
+const minOpenIDTokenSweepSize = 64
+
+// MemoryOpenIDTokenStore is an in-memory implementation of OpenIDTokenStore.
+// Expired tokens are removed when they are looked up, and swept whenever the
+// number of tokens stored has doubled since the last sweep, so that the cost
+// of sweeping is spread over the tokens stored. The zero value is ready to
+// use.
+type MemoryOpenIDTokenStore struct {
+	mutex     sync.Mutex
+	tokens    map[string]memoryOpenIDToken
+	nextSweep int
+}
+
+type memoryOpenIDToken struct {
+	userID    string
+	expiresAt Timestamp
+}
+
+// StoreOpenIDToken implements OpenIDTokenStore
+func (s *MemoryOpenIDTokenStore) StoreOpenIDToken(
+	ctx context.Context, token, userID string, expiresAt Timestamp,
+) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tokens == nil {
+		s.tokens = make(map[string]memoryOpenIDToken)
+	}
+	s.tokens[token] = memoryOpenIDToken{userID, expiresAt}
+	if len(s.tokens) >= s.nextSweep {
+		now := AsTimestamp(time.Now())
+		for t, entry := range s.tokens {
+			if now >= entry.expiresAt {
+				delete(s.tokens, t)
+			}
+		}
+		s.nextSweep = 2*len(s.tokens) + minOpenIDTokenSweepSize
+	}
+	return nil
+}
+
+// LookupOpenIDToken implements OpenIDTokenStore
+func (s *MemoryOpenIDTokenStore) LookupOpenIDToken(
+	ctx context.Context, token string,
+) (string, Timestamp, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.tokens[token]
+	if !ok {
+		return "", 0, ErrOpenIDTokenNotFound
+	}
+	if AsTimestamp(time.Now()) >= entry.expiresAt {
+		delete(s.tokens, token)
+	}
+	return entry.userID, entry.expiresAt, nil
+}
@@ -0,0 +1,113 @@
+package gomatrixserverlib_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestOpenIDTokenRoundTrip(t *testing.T) {
+	serverName := gomatrixserverlib.ServerName("openid.server.name")
+	issuer := gomatrixserverlib.NewOpenIDTokenIssuer(
+		serverName, &gomatrixserverlib.MemoryOpenIDTokenStore{}, 0,
+	)
+
+	token, err := issuer.IssueToken(context.Background(), "@alice:openid.server.name", time.Now())
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err)
+	}
+	if token.MatrixServerName != serverName || token.TokenType != "Bearer" || token.ExpiresIn != 3600 {
+		t.Fatalf("unexpected token: %+v", token)
+	}
+
+	// Serve the userinfo endpoint from the issuer and check that
+	// Client.LookupUserInfo understands the response.
+	client := gomatrixserverlib.NewClient(gomatrixserverlib.WithTransport(
+		&roundTripper{
+			fn: func(req *http.Request) (*http.Response, error) {
+				res := issuer.OnUserInfoRequest(req, time.Now())
+				body, err := json.Marshal(res.JSON)
+				if err != nil {
+					return nil, err
+				}
+				return &http.Response{
+					StatusCode: res.Code,
+					Body:       ioutil.NopCloser(bytes.NewReader(body)),
+				}, nil
+			},
+		},
+	))
+	info, err := client.LookupUserInfo(context.Background(), serverName, token.AccessToken)
+	if err != nil {
+		t.Fatalf("failed to look up user info: %s", err)
+	}
+	if info.Sub != "@alice:openid.server.name" {
+		t.Errorf("unexpected sub: %q", info.Sub)
+	}
+
+	if _, err = client.LookupUserInfo(context.Background(), serverName, "not-a-token"); err == nil {
+		t.Error("expected an error for an unknown token")
+	}
+}
+
+func TestOpenIDTokenExpiry(t *testing.T) {
+	issuer := gomatrixserverlib.NewOpenIDTokenIssuer(
+		"openid.server.name", &gomatrixserverlib.MemoryOpenIDTokenStore{}, time.Minute,
+	)
+	now := time.Now()
+	token, err := issuer.IssueToken(context.Background(), "@bob:openid.server.name", now)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err)
+	}
+
+	if _, err = issuer.ValidateToken(context.Background(), token.AccessToken, now.Add(time.Second)); err != nil {
+		t.Errorf("token should still be valid: %s", err)
+	}
+	_, err = issuer.ValidateToken(context.Background(), token.AccessToken, now.Add(2*time.Minute))
+	if err != gomatrixserverlib.ErrOpenIDTokenNotFound {
+		t.Errorf("expected ErrOpenIDTokenNotFound for expired token, got %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/_matrix/federation/v1/openid/userinfo?access_token="+token.AccessToken, nil)
+	if res := issuer.OnUserInfoRequest(req, now.Add(2*time.Minute)); res.Code != 401 {
+		t.Errorf("expected 401 for expired token, got %d", res.Code)
+	}
+}
+
+func TestOpenIDTokenForeignUser(t *testing.T) {
+	issuer := gomatrixserverlib.NewOpenIDTokenIssuer(
+		"openid.server.name", &gomatrixserverlib.MemoryOpenIDTokenStore{}, 0,
+	)
+	if _, err := issuer.IssueToken(context.Background(), "@mallory:other.server.name", time.Now()); err == nil {
+		t.Error("expected an error issuing a token for a user on another server")
+	}
+}
+
+func TestMemoryOpenIDTokenStoreSweepsExpiredTokens(t *testing.T) {
+	ctx := context.Background()
+	store := &gomatrixserverlib.MemoryOpenIDTokenStore{}
+	now := time.Now()
+	if err := store.StoreOpenIDToken(ctx, "valid", "@bob:openid.server.name", gomatrixserverlib.AsTimestamp(now.Add(time.Hour))); err != nil {
+		t.Fatalf("failed to store token: %s", err)
+	}
+	for i := 0; i < 200; i++ {
+		token := "expired" + strconv.Itoa(i)
+		if err := store.StoreOpenIDToken(ctx, token, "@bob:openid.server.name", gomatrixserverlib.AsTimestamp(now.Add(-time.Hour))); err != nil {
+			t.Fatalf("failed to store token: %s", err)
+		}
+	}
+	if _, _, err := store.LookupOpenIDToken(ctx, "expired0"); err != gomatrixserverlib.ErrOpenIDTokenNotFound {
+		t.Errorf("expected expired token to have been swept, got %v", err)
+	}
+	if _, _, err := store.LookupOpenIDToken(ctx, "valid"); err != nil {
+		t.Errorf("expected valid token to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package gomatrixserverlib
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Below this many items the cost of starting goroutines outweighs the
+// benefit of spreading the work across the CPU cores.
+const parallelMinItems = 16
+
+// parallelFor calls fn for each index from 0 to n-1, spread across the CPU
+// cores. fn must be safe to call concurrently for different indexes.
+func parallelFor(n int, fn func(i int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	if n < parallelMinItems || workers < 2 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
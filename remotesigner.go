@@ -0,0 +1,320 @@
+package gomatrixserverlib
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The default timeout for a request to a remote signer.
+const remoteSignerTimeout = 10 * time.Second
+
+// The longest requests that ServeSigner reads before and after a connection
+// has authenticated. Authenticated requests can be large since federation
+// requests are signed along with their content.
+const (
+	remoteSignerMaxAuthLineSize = 4096
+	remoteSignerMaxLineSize     = 64 * 1024 * 1024
+)
+
+var errRemoteSignerLineTooLong = errors.New("gomatrixserverlib: remote signer request is too long")
+
+// The remote signer protocol is newline-delimited JSON over a stream
+// connection such as a UNIX socket. Each request is answered by exactly one
+// response, in order. The first request on a connection must be an "auth"
+// request with the shared secret, otherwise the connection is closed.
+type remoteSignerRequest struct {
+	// One of "auth", "describe" or "sign".
+	Method  string      `json:"method"`
+	Secret  Base64Bytes `json:"secret,omitempty"`
+	Message Base64Bytes `json:"message,omitempty"`
+}
+
+type remoteSignerResponse struct {
+	KeyID     KeyID       `json:"key_id,omitempty"`
+	PublicKey Base64Bytes `json:"public_key,omitempty"`
+	Signature Base64Bytes `json:"signature,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// A RemoteSigner is a Signer that asks a separate process to sign messages,
+// so that the server's private key doesn't need to be loaded into this one.
+// The other process should call ServeSigner. The signing process's key can
+// change, e.g. if it uses a KeyManager: each signature is labelled with the
+// key that made it, and KeyID and PublicKey ask for the current key.
+type RemoteSigner struct {
+	network string
+	address string
+	secret  []byte
+	timeout time.Duration
+	mutex   sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	// The key most recently reported by the signing process.
+	keyID     KeyID
+	publicKey ed25519.PublicKey
+}
+
+// NewRemoteSigner connects to a signing process listening on the given
+// network address (e.g. "unix", "/run/matrix/signer.sock"), authenticates
+// with the secret shared with it, and fetches the ID and public key of its
+// key.
+// Returns an error if the signing process couldn't be reached or rejected
+// the secret.
+func NewRemoteSigner(network, address string, secret []byte) (*RemoteSigner, error) {
+	s := &RemoteSigner{
+		network: network,
+		address: address,
+		secret:  secret,
+		timeout: remoteSignerTimeout,
+	}
+	if err := s.describe(); err != nil {
+		s.Close() // nolint: errcheck
+		return nil, err
+	}
+	return s, nil
+}
+
+// describe asks the signing process for its current key and remembers it.
+func (s *RemoteSigner) describe() error {
+	res, err := s.do(remoteSignerRequest{Method: "describe"})
+	if err != nil {
+		return err
+	}
+	if res.KeyID == "" || len(res.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("gomatrixserverlib: remote signer returned a bad key")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keyID = res.KeyID
+	s.publicKey = ed25519.PublicKey(res.PublicKey)
+	return nil
+}
+
+// current returns the key most recently reported by the signing process.
+func (s *RemoteSigner) current() (KeyID, ed25519.PublicKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keyID, s.publicKey
+}
+
+// KeyID implements Signer. It asks the signing process for its current key,
+// returning the last key that it reported if it can't be reached.
+func (s *RemoteSigner) KeyID() KeyID {
+	s.describe() // nolint: errcheck
+	keyID, _ := s.current()
+	return keyID
+}
+
+// PublicKey implements Signer. It asks the signing process for its current
+// key, returning the last key that it reported if it can't be reached.
+func (s *RemoteSigner) PublicKey() ed25519.PublicKey {
+	s.describe() // nolint: errcheck
+	_, publicKey := s.current()
+	return publicKey
+}
+
+// Sign implements Signer
+func (s *RemoteSigner) Sign(message []byte) (KeyID, []byte, error) {
+	res, err := s.do(remoteSignerRequest{Method: "sign", Message: message})
+	if err != nil {
+		return "", nil, err
+	}
+	if res.KeyID == "" || len(res.Signature) != ed25519.SignatureSize {
+		return "", nil, fmt.Errorf("gomatrixserverlib: remote signer returned a bad signature")
+	}
+	return res.KeyID, res.Signature, nil
+}
+
+// Close closes the connection to the signing process. The connection is
+// reopened if the RemoteSigner is used again.
+func (s *RemoteSigner) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closeLocked()
+}
+
+func (s *RemoteSigner) closeLocked() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	s.reader = nil
+	return err
+}
+
+// do sends a request to the signing process and waits for the response,
+// (re)connecting and authenticating if needed. Requests are serialised over a
+// single connection.
+func (s *RemoteSigner) do(req remoteSignerRequest) (*remoteSignerResponse, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		if err := s.connectLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := s.roundTrip(req)
+	if err != nil {
+		// The connection is in an unknown state so start afresh next time.
+		s.closeLocked() // nolint: errcheck
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("gomatrixserverlib: remote signer: %s", res.Error)
+	}
+	return res, nil
+}
+
+// connectLocked connects and authenticates to the signing process. The caller
+// must hold the mutex.
+func (s *RemoteSigner) connectLocked() error {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+	res, err := s.roundTrip(remoteSignerRequest{Method: "auth", Secret: s.secret})
+	if err == nil && res.Error != "" {
+		err = fmt.Errorf("gomatrixserverlib: remote signer: %s", res.Error)
+	}
+	if err != nil {
+		s.closeLocked() // nolint: errcheck
+		return err
+	}
+	return nil
+}
+
+func (s *RemoteSigner) roundTrip(req remoteSignerRequest) (*remoteSignerResponse, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.conn.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var res remoteSignerResponse
+	if err = json.Unmarshal(line, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ServeSigner answers requests from RemoteSigners on the listener using the
+// given Signer, until the listener is closed.
+// Anything that can sign arbitrary messages with the server's key can
+// impersonate the server, so RemoteSigners must authenticate with the given
+// secret before anything is signed, and connections that don't are closed.
+// The secret is sent as is, so the listener should still only be reachable
+// by trusted processes, e.g. a UNIX socket with restrictive permissions
+// rather than a TCP port.
+// Returns an error if the secret is empty, or the error from accepting a
+// connection.
+func ServeSigner(listener net.Listener, signer Signer, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("gomatrixserverlib: a secret is required to serve a signer")
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSignerConn(conn, signer, secret)
+	}
+}
+
+func serveSignerConn(conn net.Conn, signer Signer, secret []byte) {
+	defer conn.Close() // nolint: errcheck
+	reader := bufio.NewReader(conn)
+	authenticated := false
+	// Connections that haven't authenticated can only send a short request,
+	// and must send it promptly, so that they can't tie up memory or
+	// goroutines.
+	if err := conn.SetReadDeadline(time.Now().Add(remoteSignerTimeout)); err != nil {
+		return
+	}
+	for {
+		maxLineSize := remoteSignerMaxAuthLineSize
+		if authenticated {
+			maxLineSize = remoteSignerMaxLineSize
+		}
+		line, err := readSignerLine(reader, maxLineSize)
+		if err != nil {
+			return
+		}
+		var req remoteSignerRequest
+		var res remoteSignerResponse
+		if err = json.Unmarshal(line, &req); err != nil {
+			res.Error = "invalid request"
+		} else if req.Method == "auth" {
+			authenticated = subtle.ConstantTimeCompare(req.Secret, secret) == 1
+			if !authenticated {
+				res.Error = "authentication failed"
+			} else if err = conn.SetReadDeadline(time.Time{}); err != nil {
+				return
+			}
+		} else if !authenticated {
+			res.Error = "not authenticated"
+		} else {
+			switch req.Method {
+			case "describe":
+				res.KeyID = signer.KeyID()
+				res.PublicKey = Base64Bytes(signer.PublicKey())
+			case "sign":
+				var keyID KeyID
+				var signature []byte
+				if keyID, signature, err = signer.Sign(req.Message); err != nil {
+					res.Error = err.Error()
+				} else {
+					res.KeyID, res.Signature = keyID, signature
+				}
+			default:
+				res.Error = fmt.Sprintf("unknown method %q", req.Method)
+			}
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write(append(data, '\n')); err != nil {
+			return
+		}
+		if !authenticated {
+			return
+		}
+	}
+}
+
+// readSignerLine reads a newline-terminated line, returning an error if it
+// is longer than maxSize bytes.
+func readSignerLine(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxSize {
+			return nil, errRemoteSignerLineTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
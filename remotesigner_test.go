@@ -0,0 +1,237 @@
+package gomatrixserverlib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+type failingSigner struct {
+	Signer
+}
+
+func (s failingSigner) Sign(message []byte) (KeyID, []byte, error) {
+	return "", nil, errors.New("keystore is locked")
+}
+
+var testRemoteSignerSecret = []byte("correct horse battery staple")
+
+// startTestSigner serves the signer on a local socket and returns a
+// RemoteSigner connected to it.
+func startTestSigner(t *testing.T, signer Signer) (*RemoteSigner, net.Listener) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeSigner(listener, signer, testRemoteSignerSecret) // nolint: errcheck
+	remote, err := NewRemoteSigner("tcp", listener.Addr().String(), testRemoteSignerSecret)
+	if err != nil {
+		listener.Close() // nolint: errcheck
+		t.Fatal(err)
+	}
+	return remote, listener
+}
+
+func TestRemoteSigner(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := NewEd25519Signer("ed25519:remote", privateKey)
+	remote, listener := startTestSigner(t, local)
+	defer listener.Close() // nolint: errcheck
+	defer remote.Close()   // nolint: errcheck
+
+	if remote.KeyID() != local.KeyID() {
+		t.Errorf("wrong key ID: want %q, got %q", local.KeyID(), remote.KeyID())
+	}
+	if !bytes.Equal(remote.PublicKey(), local.PublicKey()) {
+		t.Errorf("wrong public key")
+	}
+
+	// Signing JSON remotely should give the same result as signing it locally
+	// since ed25519 signatures are deterministic.
+	message := []byte(`{"content":{"hello":"world"},"origin":"remote.server"}`)
+	want, err := SignJSON("remote.server", "ed25519:remote", privateKey, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := SignJSONWithSigner("remote.server", remote, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("remote signature differs:\nwant %s\n got %s", want, got)
+	}
+
+	// The connection should be reopened after it is closed.
+	if err = remote.Close(); err != nil {
+		t.Fatal(err)
+	}
+	request := NewFederationRequest("GET", "other.server", "/_matrix/federation/v1/version")
+	if err = request.SignWithSigner("remote.server", remote); err != nil {
+		t.Fatal(err)
+	}
+	httpReq, err := request.HTTPRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if httpReq.Header.Get("Authorization") == "" {
+		t.Error("expected an Authorization header on the signed request")
+	}
+}
+
+func TestRemoteSignerBuildEvent(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, listener := startTestSigner(t, NewEd25519Signer("ed25519:remote", privateKey))
+	defer listener.Close() // nolint: errcheck
+	defer remote.Close()   // nolint: errcheck
+
+	stateKey := ""
+	eb := EventBuilder{
+		Sender:   "@alice:remote.server",
+		RoomID:   "!room:remote.server",
+		Type:     "m.room.create",
+		StateKey: &stateKey,
+	}
+	if err = eb.SetContent(map[string]string{"creator": "@alice:remote.server"}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	want, err := eb.Build(now, "remote.server", "ed25519:remote", privateKey, RoomVersionV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := eb.BuildWithSigner(now, "remote.server", remote, RoomVersionV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.JSON(), got.JSON()) {
+		t.Errorf("remotely signed event differs:\nwant %s\n got %s", want.JSON(), got.JSON())
+	}
+	if err = verifyEventSignature("remote.server", "ed25519:remote", remote.PublicKey(), got.JSON(), RoomVersionV6); err != nil {
+		t.Errorf("failed to verify remotely signed event: %s", err)
+	}
+}
+
+func TestRemoteSignerError(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, listener := startTestSigner(t, failingSigner{NewEd25519Signer("ed25519:remote", privateKey)})
+	defer listener.Close() // nolint: errcheck
+	defer remote.Close()   // nolint: errcheck
+
+	if _, err = SignJSONWithSigner("remote.server", remote, []byte(`{}`)); err == nil {
+		t.Error("expected an error from the remote signer")
+	}
+}
+
+func TestRemoteSignerRequiresSecret(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() // nolint: errcheck
+	if err = ServeSigner(listener, NewEd25519Signer("ed25519:remote", privateKey), nil); err == nil {
+		t.Fatalf("expected an error serving without a secret")
+	}
+	go ServeSigner(listener, NewEd25519Signer("ed25519:remote", privateKey), testRemoteSignerSecret) // nolint: errcheck
+
+	if _, err = NewRemoteSigner("tcp", listener.Addr().String(), []byte("wrong")); err == nil {
+		t.Errorf("expected an error connecting with the wrong secret")
+	}
+
+	// Requests without authenticating first are refused.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint: errcheck
+	if _, err = conn.Write([]byte(`{"method":"sign","message":"aGVsbG8"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(line, []byte("not authenticated")) || bytes.Contains(line, []byte("signature")) {
+		t.Errorf("expected the request to be refused, got %s", line)
+	}
+}
+
+func TestRemoteSignerFollowsRotation(t *testing.T) {
+	manager, err := NewKeyManager(context.Background(), "remote.server", &MemorySigningKeyStore{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, listener := startTestSigner(t, manager.Signer())
+	defer listener.Close() // nolint: errcheck
+	defer remote.Close()   // nolint: errcheck
+	firstKeyID := remote.KeyID()
+
+	rotated, err := manager.Rotate(context.Background(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.KeyID == firstKeyID {
+		t.Fatalf("rotation kept key ID %q", firstKeyID)
+	}
+	signed, err := SignJSONWithSigner("remote.server", remote, []byte(`{"hello":"world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := rotated.PrivateKey.Public().(ed25519.PublicKey)
+	if err = VerifyJSON("remote.server", rotated.KeyID, publicKey, signed); err != nil {
+		t.Errorf("signature isn't labelled with the new key: %v", err)
+	}
+	if remote.KeyID() != rotated.KeyID || !bytes.Equal(remote.PublicKey(), publicKey) {
+		t.Errorf("want the new key %q, got %q", rotated.KeyID, remote.KeyID())
+	}
+}
+
+func TestServeSignerLimitsUnauthenticatedRequests(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() // nolint: errcheck
+	go ServeSigner(listener, NewEd25519Signer("ed25519:remote", privateKey), testRemoteSignerSecret) // nolint: errcheck
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close() // nolint: errcheck
+	// A request that never ends is cut off rather than buffered.
+	if _, err = conn.Write(bytes.Repeat([]byte("a"), 2*remoteSignerMaxAuthLineSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err == nil {
+		t.Errorf("expected the connection to be closed, got %s", line)
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("expected the connection to be closed, but it was left open")
+	}
+}
@@ -72,6 +72,11 @@ func (r *FederationRequest) Content() []byte {
 	return []byte(r.fields.Content)
 }
 
+// Destination returns the server that the request is for.
+func (r *FederationRequest) Destination() ServerName {
+	return r.fields.Destination
+}
+
 // Origin returns the server that the request originated on.
 func (r *FederationRequest) Origin() ServerName {
 	return r.fields.Origin
@@ -87,24 +92,38 @@ func (r *FederationRequest) RequestURI() string {
 // Updates the request with the signature in place.
 // Returns an error if there was a problem signing the request.
 func (r *FederationRequest) Sign(serverName ServerName, keyID KeyID, privateKey ed25519.PrivateKey) error {
+	return r.SignWithSigner(serverName, NewEd25519Signer(keyID, privateKey))
+}
+
+// SignWithSigner signs the matrix request using the Signer.
+// Updates the request with the signature in place.
+// Returns an error if there was a problem signing the request.
+func (r *FederationRequest) SignWithSigner(serverName ServerName, signer Signer) error {
 	if r.fields.Origin != "" && r.fields.Origin != serverName {
 		return fmt.Errorf("gomatrixserverlib: the request is already signed by a different server")
 	}
 	r.fields.Origin = serverName
 	// The request fields are already in the form required by the specification
-	// So we can just serialise the request fields using the default marshaller
-	data, err := json.Marshal(r.fields)
+	// So we can encode them directly as canonical JSON, leaving out any existing
+	// signatures as they aren't covered by the signature.
+	unsigned := r.fields
+	unsigned.Signatures = nil
+	canonical, err := MarshalCanonicalJSON(unsigned)
 	if err != nil {
 		return err
 	}
-	signedData, err := SignJSON(string(serverName), keyID, privateKey, data)
+	keyID, signature, err := signer.Sign(canonical)
 	if err != nil {
 		return err
 	}
-	// Now we can deserialise the signed request back into the request structure
-	// to set the Signatures field, (This will clobber the other fields but they
-	// will all round-trip through an encode/decode.)
-	return json.Unmarshal(signedData, &r.fields)
+	if r.fields.Signatures == nil {
+		r.fields.Signatures = map[ServerName]map[KeyID]string{}
+	}
+	if r.fields.Signatures[serverName] == nil {
+		r.fields.Signatures[serverName] = map[KeyID]string{}
+	}
+	r.fields.Signatures[serverName][keyID] = Base64Bytes(signature).Encode()
+	return nil
 }
 
 // HTTPRequest constructs an net/http.Request for this matrix request.
@@ -141,11 +160,15 @@ func (r *FederationRequest) HTTPRequest() (*http.Request, error) {
 		if !isSafeInHTTPQuotedString(string(r.fields.Origin)) {
 			return nil, fmt.Errorf("gomatrixserverlib: Request Origin isn't safe to include in an HTTP header")
 		}
+		if !isSafeInHTTPQuotedString(string(r.fields.Destination)) {
+			return nil, fmt.Errorf("gomatrixserverlib: Request Destination isn't safe to include in an HTTP header")
+		}
 		if !isSafeInHTTPQuotedString(string(keyID)) {
 			return nil, fmt.Errorf("gomatrixserverlib: Request key ID isn't safe to include in an HTTP header")
 		}
 		httpReq.Header.Add("Authorization", fmt.Sprintf(
-			"X-Matrix origin=\"%s\",key=\"%s\",sig=\"%s\"", r.fields.Origin, keyID, sig,
+			"X-Matrix origin=\"%s\",destination=\"%s\",key=\"%s\",sig=\"%s\"",
+			r.fields.Origin, r.fields.Destination, keyID, sig,
 		))
 	}
 
@@ -193,15 +216,40 @@ func isSafeInHTTPQuotedString(text string) bool { // nolint: gocyclo
 // the request that have been authenticated: the method, the request path,
 // the query parameters, and the JSON content. In particular the version of
 // HTTP and the headers aren't protected by the signature.
+// Requests whose X-Matrix authorization header names a destination other than
+// the given one are rejected with a 401 error.
 func VerifyHTTPRequest(
 	req *http.Request, now time.Time, destination ServerName, keys JSONVerifier,
+) (*FederationRequest, util.JSONResponse) {
+	return VerifyHTTPRequestForServerNames(req, now, []ServerName{destination}, keys)
+}
+
+// VerifyHTTPRequestForServerNames is like VerifyHTTPRequest, but for a server
+// hosting several server names. The request is verified for the destination
+// named in its X-Matrix authorization header, which must be one of the
+// serverNames. Requests without a destination in the header, which older
+// servers send, are verified for the first of the serverNames.
+// The destination can be accessed using FederationRequest.Destination()
+func VerifyHTTPRequestForServerNames(
+	req *http.Request, now time.Time, serverNames []ServerName, keys JSONVerifier,
 ) (*FederationRequest, util.JSONResponse) {
 	request, err := readHTTPRequest(req)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Print("Error parsing HTTP headers")
 		return nil, util.MessageResponse(400, "Bad Request")
 	}
-	request.fields.Destination = destination
+	if request.fields.Destination == "" {
+		if len(serverNames) == 0 {
+			message := "Missing destination in \"Authorization: X-Matrix ...\" HTTP header"
+			util.GetLogger(req.Context()).Print(message)
+			return nil, util.MessageResponse(401, message)
+		}
+		request.fields.Destination = serverNames[0]
+	} else if !isServerNameIn(request.fields.Destination, serverNames) {
+		message := "Request is for a server name that isn't hosted here"
+		util.GetLogger(req.Context()).WithField("destination", request.fields.Destination).Print(message)
+		return nil, util.MessageResponse(401, message)
+	}
 
 	// The request fields are already in the form required by the specification
 	// So we can just serialise the request fields using the default marshaller
@@ -243,6 +291,15 @@ func VerifyHTTPRequest(
 	return request, util.JSONResponse{Code: 200, JSON: struct{}{}}
 }
 
+func isServerNameIn(serverName ServerName, serverNames []ServerName) bool {
+	for _, s := range serverNames {
+		if s == serverName {
+			return true
+		}
+	}
+	return false
+}
+
 // Returns an error if there was a problem reading the content of the request
 func readHTTPRequest(req *http.Request) (*FederationRequest, error) { // nolint: gocyclo
 	var result FederationRequest
@@ -271,7 +328,7 @@ func readHTTPRequest(req *http.Request) (*FederationRequest, error) { // nolint:
 	}
 
 	for _, authorization := range req.Header["Authorization"] {
-		scheme, origin, key, sig := parseAuthorization(authorization)
+		scheme, origin, destination, key, sig := parseAuthorization(authorization)
 		if scheme != "X-Matrix" {
 			// Ignore unknown types of Authorization.
 			continue
@@ -282,6 +339,12 @@ func readHTTPRequest(req *http.Request) (*FederationRequest, error) { // nolint:
 		if result.fields.Origin != "" && result.fields.Origin != origin {
 			return nil, fmt.Errorf("gomatrixserverlib: different origins in X-Matrix authorization headers")
 		}
+		if destination != "" {
+			if result.fields.Destination != "" && result.fields.Destination != destination {
+				return nil, fmt.Errorf("gomatrixserverlib: different destinations in X-Matrix authorization headers")
+			}
+			result.fields.Destination = destination
+		}
 		result.fields.Origin = origin
 		if result.fields.Signatures == nil {
 			result.fields.Signatures = map[ServerName]map[KeyID]string{origin: {key: sig}}
@@ -293,7 +356,7 @@ func readHTTPRequest(req *http.Request) (*FederationRequest, error) { // nolint:
 	return &result, nil
 }
 
-func parseAuthorization(header string) (scheme string, origin ServerName, key KeyID, sig string) {
+func parseAuthorization(header string) (scheme string, origin, destination ServerName, key KeyID, sig string) {
 	parts := strings.SplitN(header, " ", 2)
 	scheme = parts[0]
 	if scheme != "X-Matrix" {
@@ -312,6 +375,9 @@ func parseAuthorization(header string) (scheme string, origin ServerName, key Ke
 		if name == "origin" {
 			origin = ServerName(value)
 		}
+		if name == "destination" {
+			destination = ServerName(value)
+		}
 		if name == "key" {
 			key = KeyID(value)
 		}
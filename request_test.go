@@ -36,6 +36,32 @@ const examplePutRequest = "PUT /_matrix/federation/v1/send/1493385816575/ HTTP/1
 	"\r\n" +
 	examplePutContent
 
+// These are the requests above with the destination that is now included in
+// the X-Matrix authorization header. Adding the destination doesn't change
+// the signatures, since it was already covered by them.
+const exampleGetRequestWithDestination = "GET /_matrix/federation/v1/query/directory?room_alias=%23test%3Alocalhost%3A44033 HTTP/1.1\r\n" +
+	"Host: localhost:44033\r\n" +
+	"Authorization: X-Matrix" +
+	" origin=\"localhost:8800\"" +
+	",destination=\"localhost:44033\"" +
+	",key=\"ed25519:a_Obwu\"" +
+	",sig=\"7vt4vP/w8zYB3Zg77nuTPwie3TxEy2OHZQMsSa4nsXZzL4/qw+DguXbyMy3BF77XvSJmBt+Gw+fU6T4HId7fBg\"" +
+	"\r\n" +
+	"\r\n"
+
+const examplePutRequestWithDestination = "PUT /_matrix/federation/v1/send/1493385816575/ HTTP/1.1\r\n" +
+	"Host: localhost:44033\r\n" +
+	"Content-Length: 321\r\n" +
+	"Authorization: X-Matrix" +
+	" origin=\"localhost:8800\"" +
+	",destination=\"localhost:44033\"" +
+	",key=\"ed25519:a_Obwu\"" +
+	",sig=\"+hmW6UjEXx7vMt2+MXO/EImSfdEYdBsZEOmpiz3evYktAgGNpGuNMBYXIA969WGubmceREKA/r1phasUFHBpDg\"" +
+	"\r\n" +
+	"Content-Type: application/json\r\n" +
+	"\r\n" +
+	examplePutContent
+
 const examplePutContent = `{"edus":[{"content":{"device_id":"YHRUBZNPFS",` +
 	`"keys":{"device_id":"YHRUBZNPFS","device_keys":{},"user_id":` +
 	`"@ANON-22:localhost:8800"},"prev_id":[],"stream_id":30,"user_id":` +
@@ -64,7 +90,7 @@ func TestSignGetRequest(t *testing.T) {
 	}
 
 	got := buf.String()
-	want := exampleGetRequest
+	want := exampleGetRequestWithDestination
 	if want != got {
 		t.Errorf("Wanted %q got %q", want, got)
 	}
@@ -76,7 +102,7 @@ func TestVerifyGetRequest(t *testing.T) {
 		t.Fatal(err)
 	}
 	request, jsonResp := VerifyHTTPRequest(
-		hr, time.Unix(1493142432, 96400), "localhost:44033", KeyRing{nil, &testKeyDatabase{}},
+		hr, time.Unix(1493142432, 96400), "localhost:44033", KeyRing{nil, &testKeyDatabase{}, nil},
 	)
 	if request == nil {
 		t.Fatalf("Wanted non-nil request got nil. (request was %#v, response was %#v)", hr, jsonResp)
@@ -123,7 +149,7 @@ func TestSignPutRequest(t *testing.T) {
 	}
 
 	got := buf.String()
-	want := examplePutRequest
+	want := examplePutRequestWithDestination
 	if want != got {
 		t.Errorf("Wanted %q got %q", want, got)
 	}
@@ -135,7 +161,7 @@ func TestVerifyPutRequest(t *testing.T) {
 		t.Fatal(err)
 	}
 	request, jsonResp := VerifyHTTPRequest(
-		hr, time.Unix(1493142432, 96400), "localhost:44033", KeyRing{nil, &testKeyDatabase{}},
+		hr, time.Unix(1493142432, 96400), "localhost:44033", KeyRing{nil, &testKeyDatabase{}, nil},
 	)
 	if request == nil {
 		t.Fatalf("Wanted non-nil request got nil. (request was %#v, response was %#v)", hr, jsonResp)
@@ -173,3 +199,38 @@ func mustLoadPrivateKey(seed string) ed25519.PrivateKey {
 	}
 	return privateKey
 }
+
+func TestVerifyRequestWithDestination(t *testing.T) {
+	for _, example := range []string{exampleGetRequestWithDestination, examplePutRequestWithDestination} {
+		hr, err := http.ReadRequest(bufio.NewReader(bytes.NewReader([]byte(example))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, jsonResp := VerifyHTTPRequestForServerNames(
+			hr, time.Unix(1493142432, 96400), []ServerName{"other", "localhost:44033"},
+			KeyRing{nil, &testKeyDatabase{}, nil},
+		)
+		if request == nil {
+			t.Fatalf("Wanted non-nil request got nil. (request was %#v, response was %#v)", hr, jsonResp)
+		}
+		if request.Destination() != "localhost:44033" {
+			t.Errorf("Wanted request.Destination() to be \"localhost:44033\" got %q", request.Destination())
+		}
+	}
+}
+
+func TestVerifyRequestForOtherDestination(t *testing.T) {
+	hr, err := http.ReadRequest(bufio.NewReader(bytes.NewReader([]byte(exampleGetRequestWithDestination))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, jsonResp := VerifyHTTPRequest(
+		hr, time.Unix(1493142432, 96400), "other", KeyRing{nil, &testKeyDatabase{}, nil},
+	)
+	if request != nil {
+		t.Fatalf("Wanted nil request for another destination")
+	}
+	if jsonResp.Code != 401 {
+		t.Errorf("Wanted 401 got %d", jsonResp.Code)
+	}
+}
@@ -16,8 +16,12 @@
 package gomatrixserverlib
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/http"
+	"sort"
 	"strconv"
 )
 
@@ -27,6 +31,44 @@ type ResolutionResult struct {
 	Destination   string     // The hostname and port to send federation requests to.
 	Host          ServerName // The value of the Host headers.
 	TLSServerName string     // The TLS server name to request a certificate for.
+	// The priority and weight of the SRV record that the result came from,
+	// or 0 if it didn't come from an SRV record. Results are ordered by
+	// priority, and by a weighted random order within each priority.
+	Priority uint16
+	Weight   uint16
+}
+
+// An SRVResolver looks up DNS SRV records. It is implemented by *net.Resolver.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+}
+
+// A Resolver resolves server names into the addresses to send federation
+// requests to, using the server name resolution algorithm described at
+// https://matrix.org/docs/spec/server_server/r0.1.1.html#resolving-server-names
+// The zero value is ready to use, and uses net.DefaultResolver and
+// http.DefaultClient.
+type Resolver struct {
+	// DNS is used to look up SRV records. If nil then net.DefaultResolver is
+	// used.
+	DNS SRVResolver
+	// HTTPClient is used to fetch .well-known files. If nil then
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+}
+
+func (r *Resolver) dns() SRVResolver {
+	if r.DNS == nil {
+		return net.DefaultResolver
+	}
+	return r.DNS
+}
+
+func (r *Resolver) httpClient() *http.Client {
+	if r.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return r.HTTPClient
 }
 
 // ResolveServer implements the server name resolution algorithm described at
@@ -34,14 +76,24 @@ type ResolutionResult struct {
 // Returns a slice of ResolutionResult that can be used to send a federation
 // request to the server using a given server name.
 // Returns an error if the server name isn't valid.
+// It uses the default Resolver, see Resolver.ResolveServer.
 func ResolveServer(serverName ServerName) (results []ResolutionResult, err error) {
-	return resolveServer(serverName, true)
+	return (&Resolver{}).ResolveServer(context.Background(), serverName)
+}
+
+// ResolveServer implements the server name resolution algorithm described at
+// https://matrix.org/docs/spec/server_server/r0.1.1.html#resolving-server-names
+// Returns a slice of ResolutionResult that can be used to send a federation
+// request to the server using a given server name.
+// Returns an error if the server name isn't valid, or if the context is done.
+func (r *Resolver) ResolveServer(ctx context.Context, serverName ServerName) (results []ResolutionResult, err error) {
+	return r.resolveServer(ctx, serverName, true)
 }
 
 // resolveServer does the same thing as ResolveServer, except it also requires
 // the checkWellKnown parameter, which indicates whether a .well-known file
 // should be looked up.
-func resolveServer(serverName ServerName, checkWellKnown bool) (results []ResolutionResult, err error) {
+func (r *Resolver) resolveServer(ctx context.Context, serverName ServerName, checkWellKnown bool) (results []ResolutionResult, err error) {
 	host, port, valid := ParseAndValidateServerName(serverName)
 	if !valid {
 		err = fmt.Errorf("Invalid server name")
@@ -91,21 +143,29 @@ func resolveServer(serverName ServerName, checkWellKnown bool) (results []Resolu
 	if checkWellKnown {
 		// 3. If the hostname is not an IP literal
 		var result *WellKnownResult
-		result, err = LookupWellKnown(serverName)
+		result, err = r.LookupWellKnown(ctx, serverName)
 		if err == nil {
 			// We don't want to check .well-known on the result
-			return resolveServer(result.NewAddress, false)
+			return r.resolveServer(ctx, result.NewAddress, false)
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
 	}
 
-	return handleNoWellKnown(serverName), nil
+	return r.handleNoWellKnown(ctx, serverName)
 }
 
 // handleNoWellKnown implements steps 4 and 5 of the resolution algorithm (as
 // well as 3.3 and 3.4)
-func handleNoWellKnown(serverName ServerName) (results []ResolutionResult) {
+func (r *Resolver) handleNoWellKnown(ctx context.Context, serverName ServerName) (results []ResolutionResult, err error) {
 	// 4. If the /.well-known request resulted in an error response
-	_, records, err := net.LookupSRV("matrix", "tcp", string(serverName))
+	// The _matrix-fed._tcp record is preferred, falling back to the
+	// deprecated _matrix._tcp record if there isn't one.
+	_, records, err := r.dns().LookupSRV(ctx, "matrix-fed", "tcp", string(serverName))
+	if (err != nil || len(records) == 0) && ctx.Err() == nil {
+		_, records, err = r.dns().LookupSRV(ctx, "matrix", "tcp", string(serverName))
+	}
 	if err == nil && len(records) > 0 {
 		for _, rec := range records {
 			// If the domain is a FQDN, remove the trailing dot at the end. This
@@ -121,10 +181,15 @@ func handleNoWellKnown(serverName ServerName) (results []ResolutionResult) {
 				Destination:   fmt.Sprintf("%s:%d", target, rec.Port),
 				Host:          serverName,
 				TLSServerName: string(serverName),
+				Priority:      rec.Priority,
+				Weight:        rec.Weight,
 			})
 		}
 
-		return
+		return orderResolutionResults(results), nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
 	// 5. If the /.well-known request returned an error response, and the SRV
@@ -137,5 +202,57 @@ func handleNoWellKnown(serverName ServerName) (results []ResolutionResult) {
 		},
 	}
 
-	return
+	return results, nil
+}
+
+// orderResolutionResults returns the results in the order described by RFC
+// 2782 for the SRV records that they came from: by ascending priority, and
+// within each priority by a weighted random selection, so that results with
+// larger weights are more likely to be tried first. The order is random, so
+// it should be worked out again for each request.
+func orderResolutionResults(results []ResolutionResult) []ResolutionResult {
+	ordered := make([]ResolutionResult, len(results))
+	copy(ordered, results)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+		orderResolutionResultsByWeight(ordered[start:end])
+		start = end
+	}
+	return ordered
+}
+
+// orderResolutionResultsByWeight orders results with the same priority using
+// the weighted random selection described in RFC 2782.
+func orderResolutionResultsByWeight(results []ResolutionResult) {
+	// Results with a weight of 0 go first, which gives them a very small
+	// chance of being selected before the others.
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Weight == 0 && results[j].Weight != 0
+	})
+	for i := range results {
+		sum := 0
+		for _, result := range results[i:] {
+			sum += int(result.Weight)
+		}
+		// Select the first result whose running sum of weights is at least a
+		// random number between 0 and the sum of the weights, and move it to
+		// the front of the results that haven't been selected yet.
+		n := rand.Intn(sum + 1)
+		running := 0
+		for j := i; j < len(results); j++ {
+			running += int(results[j].Weight)
+			if running >= n {
+				selected := results[j]
+				copy(results[i+1:j+1], results[i:j])
+				results[i] = selected
+				break
+			}
+		}
+	}
 }
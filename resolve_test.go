@@ -3,8 +3,11 @@ package gomatrixserverlib
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -307,3 +310,163 @@ func (h *dnsHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		panic(err)
 	}
 }
+
+// fakeSRVResolver is an SRVResolver which answers from a map of
+// "_service._proto.name" to the records for it.
+type fakeSRVResolver map[string][]*net.SRV
+
+func (r fakeSRVResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := "_" + service + "._" + proto + "." + name
+	records, ok := r[target]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: target}
+	}
+	return target, records, nil
+}
+
+// fakeWellKnownTransport is an http.RoundTripper which serves .well-known
+// files from a map of host to file contents.
+type fakeWellKnownTransport map[string]string
+
+func (t fakeWellKnownTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	body, ok := t[req.URL.Host]
+	if !ok || req.URL.Path != "/.well-known/matrix/server" {
+		return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestResolverWithLocalStandIns(t *testing.T) {
+	resolver := &Resolver{
+		DNS: fakeSRVResolver{
+			"_matrix._tcp.matrix.example.com": {{Target: "matrix.otherexample.com.", Port: 4242}},
+		},
+		HTTPClient: &http.Client{Transport: fakeWellKnownTransport{
+			"example.com": `{"m.server": "matrix.example.com"}`,
+		}},
+	}
+
+	tests := []struct {
+		serverName ServerName
+		want       ResolutionResult
+	}{
+		{"example.com", ResolutionResult{Destination: "matrix.otherexample.com:4242", Host: "matrix.example.com", TLSServerName: "matrix.example.com"}},
+		{"matrix.example.com", ResolutionResult{Destination: "matrix.otherexample.com:4242", Host: "matrix.example.com", TLSServerName: "matrix.example.com"}},
+		{"other.example.com", ResolutionResult{Destination: "other.example.com:8448", Host: "other.example.com", TLSServerName: "other.example.com"}},
+	}
+	for _, test := range tests {
+		res, err := resolver.ResolveServer(context.Background(), test.serverName)
+		if err != nil {
+			t.Fatalf("%s: ResolveServer failed: %v", test.serverName, err)
+		}
+		if len(res) != 1 || res[0] != test.want {
+			t.Errorf("%s: want %+v, got %+v", test.serverName, test.want, res)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := resolver.ResolveServer(ctx, "example.com"); err != context.Canceled {
+		t.Errorf("want context.Canceled for a cancelled context, got %v", err)
+	}
+}
+
+func TestResolverPrefersMatrixFedSRV(t *testing.T) {
+	resolver := &Resolver{
+		DNS: fakeSRVResolver{
+			"_matrix-fed._tcp.example.com": {{Target: "fed.example.com.", Port: 443}},
+			"_matrix._tcp.example.com":     {{Target: "legacy.example.com.", Port: 8448}},
+		},
+		HTTPClient: &http.Client{Transport: fakeWellKnownTransport{}},
+	}
+	res, err := resolver.ResolveServer(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("ResolveServer failed: %v", err)
+	}
+	if len(res) != 1 || res[0].Destination != "fed.example.com:443" {
+		t.Errorf("want the _matrix-fed._tcp record, got %+v", res)
+	}
+}
+
+func TestResolverOrdersSRVRecords(t *testing.T) {
+	resolver := &Resolver{
+		DNS: fakeSRVResolver{
+			"_matrix._tcp.example.com": {
+				{Target: "backup.example.com.", Port: 1, Priority: 20, Weight: 100},
+				{Target: "light.example.com.", Port: 1, Priority: 10, Weight: 1},
+				{Target: "heavy.example.com.", Port: 1, Priority: 10, Weight: 1000},
+			},
+		},
+		HTTPClient: &http.Client{Transport: fakeWellKnownTransport{}},
+	}
+	heavyFirst := 0
+	for i := 0; i < 100; i++ {
+		res, err := resolver.ResolveServer(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("ResolveServer failed: %v", err)
+		}
+		if len(res) != 3 {
+			t.Fatalf("want 3 results, got %+v", res)
+		}
+		if res[0].Priority != 10 || res[1].Priority != 10 || res[2].Priority != 20 {
+			t.Fatalf("results aren't ordered by priority: %+v", res)
+		}
+		if res[0].Destination == "heavy.example.com:1" {
+			heavyFirst++
+		}
+	}
+	// The heavy record should come first all but about 0.1% of the time.
+	if heavyFirst < 90 {
+		t.Errorf("want the heavier record first most of the time, got it first %d times out of 100", heavyFirst)
+	}
+}
+
+// hostRecordingTransport is an http.RoundTripper which records the host of
+// each request that it is asked to send.
+type hostRecordingTransport struct {
+	hosts []string
+}
+
+func (t *hostRecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.hosts = append(t.hosts, req.URL.Host)
+	return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+}
+
+func TestFederationTripperReordersCachedResults(t *testing.T) {
+	resolver := &Resolver{
+		DNS: fakeSRVResolver{
+			"_matrix._tcp.example.com": {
+				{Target: "a.example.com.", Port: 1, Priority: 10, Weight: 10},
+				{Target: "b.example.com.", Port: 1, Priority: 10, Weight: 10},
+			},
+		},
+		HTTPClient: &http.Client{Transport: fakeWellKnownTransport{}},
+	}
+	tripper := newFederationTripper(false, nil, true, resolver)
+	transport := &hostRecordingTransport{}
+	tripper.transports["example.com"] = transport
+
+	for i := 0; i < 100; i++ {
+		req, err := http.NewRequest("GET", "matrix://example.com/_matrix/federation/v1/version", nil)
+		if err != nil {
+			t.Fatalf("NewRequest failed: %v", err)
+		}
+		res, err := tripper.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+		res.Body.Close() // nolint: errcheck
+	}
+	counts := map[string]int{}
+	for _, host := range transport.hosts {
+		counts[host]++
+	}
+	// Each target should be tried first about half of the time, even though
+	// the resolution was cached after the first request.
+	if counts["a.example.com:1"] < 10 || counts["b.example.com:1"] < 10 {
+		t.Errorf("want requests spread over both targets, got %v", counts)
+	}
+}
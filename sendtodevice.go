@@ -14,3 +14,8 @@ type ToDeviceMessage struct {
 	MessageID string                                `json:"message_id"`
 	Messages  map[string]map[string]json.RawMessage `json:"messages"`
 }
+
+// CheckOrigin implements EDUContent
+func (m *ToDeviceMessage) CheckOrigin(origin ServerName) error {
+	return checkUserOrigin(m.Sender, origin)
+}
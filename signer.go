@@ -0,0 +1,84 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// A Signer signs messages with an ed25519 key on behalf of a server.
+// It allows the private key to be kept outside of the process, for example
+// in a separate signing process (see RemoteSigner) or a software keystore.
+// Implementations must be safe for concurrent use.
+type Signer interface {
+	// KeyID returns the ID of the key, e.g. "ed25519:auto".
+	KeyID() KeyID
+	// PublicKey returns the public half of the key.
+	PublicKey() ed25519.PublicKey
+	// Sign returns the ed25519 signature of the message and the ID of the
+	// key that made it. The key ID is returned with the signature, rather
+	// than read separately with KeyID, so that a signer whose key can change
+	// never labels a signature with the wrong key.
+	Sign(message []byte) (KeyID, []byte, error)
+}
+
+// An Ed25519Signer is a Signer which holds the private key in process.
+type Ed25519Signer struct {
+	keyID      KeyID
+	privateKey ed25519.PrivateKey
+}
+
+// NewEd25519Signer creates a Signer for an in-process ed25519 private key.
+func NewEd25519Signer(keyID KeyID, privateKey ed25519.PrivateKey) *Ed25519Signer {
+	return &Ed25519Signer{
+		keyID:      keyID,
+		privateKey: privateKey,
+	}
+}
+
+// KeyID implements Signer
+func (s *Ed25519Signer) KeyID() KeyID {
+	return s.keyID
+}
+
+// PublicKey implements Signer
+func (s *Ed25519Signer) PublicKey() ed25519.PublicKey {
+	return s.privateKey.Public().(ed25519.PublicKey)
+}
+
+// Sign implements Signer
+func (s *Ed25519Signer) Sign(message []byte) (KeyID, []byte, error) {
+	return s.keyID, ed25519.Sign(s.privateKey, message), nil
+}
+
+// A SignerProvider returns the Signer for each server name hosted by a
+// process, allowing one process to host several server names.
+// Implementations must be safe for concurrent use.
+type SignerProvider interface {
+	// SignerForServerName returns the Signer for the server name, or an
+	// UnknownServerNameError if the server name isn't hosted.
+	SignerForServerName(ctx context.Context, serverName ServerName) (Signer, error)
+}
+
+// UnknownServerNameError is returned by a SignerProvider for server names
+// that it doesn't have a Signer for.
+type UnknownServerNameError struct {
+	ServerName ServerName
+}
+
+func (e UnknownServerNameError) Error() string {
+	return fmt.Sprintf("gomatrixserverlib: server name %q isn't hosted here", e.ServerName)
+}
+
+// A StaticSignerProvider is a SignerProvider for a fixed set of server names.
+type StaticSignerProvider map[ServerName]Signer
+
+// SignerForServerName implements SignerProvider
+func (p StaticSignerProvider) SignerForServerName(ctx context.Context, serverName ServerName) (Signer, error) {
+	signer, ok := p[serverName]
+	if !ok {
+		return nil, UnknownServerNameError{serverName}
+	}
+	return signer, nil
+}
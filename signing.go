@@ -31,6 +31,12 @@ type KeyID string
 // SignJSON signs a JSON object returning a copy signed with the given key.
 // https://matrix.org/docs/spec/server_server/unstable.html#signing-json
 func SignJSON(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, message []byte) ([]byte, error) {
+	return SignJSONWithSigner(signingName, NewEd25519Signer(keyID, privateKey), message)
+}
+
+// SignJSONWithSigner signs a JSON object returning a copy signed by the Signer.
+// https://matrix.org/docs/spec/server_server/unstable.html#signing-json
+func SignJSONWithSigner(signingName string, signer Signer, message []byte) ([]byte, error) {
 	// Unpack the top-level key of the JSON object without unpacking the contents of the keys.
 	// This allows us to add and remove the top-level keys from the JSON object.
 	// It also ensures that the JSON is actually a valid JSON object.
@@ -58,18 +64,17 @@ func SignJSON(signingName string, keyID KeyID, privateKey ed25519.PrivateKey, me
 
 	// Encode the JSON object without the "signatures" key or
 	// the "unsigned" key in the canonical format.
-	unsorted, err := json.Marshal(object)
+	canonical, err := MarshalCanonicalJSON(object)
 	if err != nil {
 		return nil, err
 	}
-	canonical, err := CanonicalJSON(unsorted)
+
+	// Sign the canonical JSON with the ed25519 key.
+	keyID, signature, err := signer.Sign(canonical)
 	if err != nil {
 		return nil, err
 	}
 
-	// Sign the canonical JSON with the ed25519 key.
-	signature := Base64Bytes(ed25519.Sign(privateKey, canonical))
-
 	// Add the signature to the "signature" key.
 	signaturesForEntity := signatures[signingName]
 	if signaturesForEntity != nil {
@@ -109,28 +114,40 @@ func ListKeyIDs(signingName string, message []byte) ([]KeyID, error) {
 
 // VerifyJSON checks that the entity has signed the message using a particular key.
 func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, message []byte) error {
+	prepared, err := prepareJSONForVerification(message)
+	if err != nil {
+		return err
+	}
+	return prepared.verify(signingName, keyID, publicKey)
+}
+
+// A preparedJSON is a signed JSON message that has been decoded so that its
+// signatures can be checked without decoding it again for each one.
+type preparedJSON struct {
+	signatures map[string]map[KeyID]Base64Bytes
+	// The message in the canonical format without the "unsigned" and
+	// "signatures" keys, or the error from encoding it.
+	canonical    []byte
+	canonicalErr error
+}
+
+// prepareJSONForVerification decodes a signed JSON message.
+func prepareJSONForVerification(message []byte) (*preparedJSON, error) {
 	// Unpack the top-level key of the JSON object without unpacking the contents of the keys.
 	// This allows us to add and remove the top-level keys from the JSON object.
 	// It also ensures that the JSON is actually a valid JSON object.
 	var object map[string]*json.RawMessage
-	var signatures map[string]map[KeyID]Base64Bytes
+	var prepared preparedJSON
 	if err := json.Unmarshal(message, &object); err != nil {
-		return err
+		return nil, err
 	}
 
-	// Check that there is a signature from the entity that we are expecting a signature from.
+	// Check that there are signatures.
 	if object["signatures"] == nil {
-		return fmt.Errorf("No signatures")
-	}
-	if err := json.Unmarshal(*object["signatures"], &signatures); err != nil {
-		return err
+		return nil, fmt.Errorf("No signatures")
 	}
-	signature, ok := signatures[signingName][keyID]
-	if !ok {
-		return fmt.Errorf("No signature from %q with ID %q", signingName, keyID)
-	}
-	if len(signature) != ed25519.SignatureSize {
-		return fmt.Errorf("Bad signature length from %q with ID %q", signingName, keyID)
+	if err := json.Unmarshal(*object["signatures"], &prepared.signatures); err != nil {
+		return nil, err
 	}
 
 	// The "unsigned" key and "signatures" keys aren't covered by the signature so remove them.
@@ -138,17 +155,26 @@ func VerifyJSON(signingName string, keyID KeyID, publicKey ed25519.PublicKey, me
 	delete(object, "signatures")
 
 	// Encode the JSON without the "unsigned" and "signatures" keys in the canonical format.
-	unsorted, err := json.Marshal(object)
-	if err != nil {
-		return err
+	prepared.canonical, prepared.canonicalErr = MarshalCanonicalJSON(object)
+	return &prepared, nil
+}
+
+// verify checks that the entity has signed the message using a particular key.
+func (p *preparedJSON) verify(signingName string, keyID KeyID, publicKey ed25519.PublicKey) error {
+	// Check that there is a signature from the entity that we are expecting a signature from.
+	signature, ok := p.signatures[signingName][keyID]
+	if !ok {
+		return fmt.Errorf("No signature from %q with ID %q", signingName, keyID)
 	}
-	canonical, err := CanonicalJSON(unsorted)
-	if err != nil {
-		return err
+	if len(signature) != ed25519.SignatureSize {
+		return fmt.Errorf("Bad signature length from %q with ID %q", signingName, keyID)
+	}
+	if p.canonicalErr != nil {
+		return p.canonicalErr
 	}
 
 	// Verify the ed25519 signature.
-	if !ed25519.Verify(publicKey, canonical, signature) {
+	if !ed25519.Verify(publicKey, p.canonical, signature) {
 		return fmt.Errorf("Bad signature from %q with ID %q", signingName, keyID)
 	}
 
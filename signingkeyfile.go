@@ -0,0 +1,184 @@
+package gomatrixserverlib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// The PEM block type used for signing keys by Dendrite.
+const signingKeyPEMType = "MATRIX PRIVATE KEY"
+
+// The PEM header holding the key ID of a signing key.
+const signingKeyPEMKeyIDHeader = "Key-ID"
+
+// ReadSigningKeys reads signing keys in the format used by Synapse, which has
+// one "ed25519 <version> <base64 seed>" line per key. Blank lines are ignored.
+// The seed may use either the standard or URL-safe base64 alphabet, with or
+// without padding. Returns no keys if there aren't any.
+func ReadSigningKeys(r io.Reader) ([]SigningKey, error) {
+	var keys []SigningKey
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("gomatrixserverlib: signing key line %d: expected 3 fields, got %d", line, len(fields))
+		}
+		if fields[0] != "ed25519" {
+			return nil, fmt.Errorf("gomatrixserverlib: signing key line %d: unsupported algorithm %q", line, fields[0])
+		}
+		privateKey, err := decodeSigningKeySeed(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib: signing key line %d: %w", line, err)
+		}
+		keys = append(keys, SigningKey{
+			KeyID:      KeyID("ed25519:" + fields[1]),
+			PrivateKey: privateKey,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// WriteSigningKeys writes signing keys in the format read by ReadSigningKeys,
+// with the seed in unpadded standard base64 as Synapse writes it.
+func WriteSigningKeys(w io.Writer, keys []SigningKey) error {
+	for _, key := range keys {
+		version, err := signingKeyVersion(key)
+		if err != nil {
+			return err
+		}
+		seed := Base64Bytes(key.PrivateKey.Seed())
+		if _, err = fmt.Fprintf(w, "ed25519 %s %s\n", version, seed.Encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSigningKeysPEM reads signing keys in the PEM format used by Dendrite,
+// where each "MATRIX PRIVATE KEY" block holds a seed and has a Key-ID header.
+// Blocks of other types are ignored. Returns no keys if there aren't any, as
+// ReadSigningKeys does.
+func ReadSigningKeysPEM(data []byte) ([]SigningKey, error) {
+	var keys []SigningKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != signingKeyPEMType {
+			continue
+		}
+		keyID := KeyID(block.Headers[signingKeyPEMKeyIDHeader])
+		if !strings.HasPrefix(string(keyID), "ed25519:") {
+			return nil, fmt.Errorf("gomatrixserverlib: PEM signing key has unsupported key ID %q", keyID)
+		}
+		if len(block.Bytes) != ed25519.SeedSize {
+			return nil, fmt.Errorf("gomatrixserverlib: PEM signing key %q: expected a %d byte seed, got %d bytes", keyID, ed25519.SeedSize, len(block.Bytes))
+		}
+		keys = append(keys, SigningKey{
+			KeyID:      keyID,
+			PrivateKey: ed25519.NewKeyFromSeed(block.Bytes),
+		})
+	}
+	return keys, nil
+}
+
+// EncodeSigningKeysPEM encodes signing keys in the format read by
+// ReadSigningKeysPEM.
+func EncodeSigningKeysPEM(keys []SigningKey) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, key := range keys {
+		if _, err := signingKeyVersion(key); err != nil {
+			return nil, err
+		}
+		err := pem.Encode(&buffer, &pem.Block{
+			Type:    signingKeyPEMType,
+			Headers: map[string]string{signingKeyPEMKeyIDHeader: string(key.KeyID)},
+			Bytes:   key.PrivateKey.Seed(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// LoadSigningKeyFile reads the signing keys from a file in either of the
+// formats read by ReadSigningKeys and ReadSigningKeysPEM.
+func LoadSigningKeyFile(path string) ([]SigningKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		return ReadSigningKeysPEM(data)
+	}
+	return ReadSigningKeys(bytes.NewReader(data))
+}
+
+// SaveSigningKeyFile writes the signing keys to a file that only the current
+// user can read, in the format written by WriteSigningKeys, or in PEM format
+// if pemFormat is true. The file is replaced atomically.
+func SaveSigningKeyFile(path string, keys []SigningKey, pemFormat bool) error {
+	var data []byte
+	var err error
+	if pemFormat {
+		data, err = EncodeSigningKeysPEM(keys)
+	} else {
+		var buffer bytes.Buffer
+		err = WriteSigningKeys(&buffer, keys)
+		data = buffer.Bytes()
+	}
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+	return nil
+}
+
+// decodeSigningKeySeed decodes a base64 seed into a private key.
+func decodeSigningKeySeed(encoded string) (ed25519.PrivateKey, error) {
+	var seed Base64Bytes
+	if err := seed.Decode(strings.TrimRight(encoded, "=")); err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("expected a %d byte seed, got %d bytes", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signingKeyVersion returns the version part of an ed25519 key ID.
+func signingKeyVersion(key SigningKey) (string, error) {
+	version := strings.TrimPrefix(string(key.KeyID), "ed25519:")
+	if version == string(key.KeyID) || version == "" || strings.ContainsAny(version, " \t\r\n") {
+		return "", fmt.Errorf("gomatrixserverlib: unsupported signing key ID %q", key.KeyID)
+	}
+	if len(key.PrivateKey) != ed25519.PrivateKeySize {
+		return "", fmt.Errorf("gomatrixserverlib: signing key %q has the wrong length", key.KeyID)
+	}
+	return version, nil
+}
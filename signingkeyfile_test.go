@@ -0,0 +1,100 @@
+package gomatrixserverlib_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestReadSigningKeys(t *testing.T) {
+	input := strings.Join([]string{
+		"ed25519 a_Obwu QJvXAPj0D9MUb1exkD8pIWmCvT1xajlsB8jRYz/G5HE",
+		"",
+		// The same seed in URL-safe base64 with padding.
+		"ed25519 other QJvXAPj0D9MUb1exkD8pIWmCvT1xajlsB8jRYz_G5HE=",
+	}, "\n")
+	keys, err := gomatrixserverlib.ReadSigningKeys(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].KeyID != "ed25519:a_Obwu" || keys[1].KeyID != "ed25519:other" {
+		t.Fatalf("unexpected keys: %#v", keys)
+	}
+	if !bytes.Equal(keys[0].PrivateKey, keys[1].PrivateKey) {
+		t.Errorf("the same seed decoded to different keys")
+	}
+
+	var output bytes.Buffer
+	if err = gomatrixserverlib.WriteSigningKeys(&output, keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ed25519 a_Obwu QJvXAPj0D9MUb1exkD8pIWmCvT1xajlsB8jRYz/G5HE\n"; output.String() != want {
+		t.Errorf("wanted %q, got %q", want, output.String())
+	}
+
+	for _, bad := range []string{
+		"ed25519 a_Obwu",
+		"curve25519 a_Obwu QJvXAPj0D9MUb1exkD8pIWmCvT1xajlsB8jRYz/G5HE",
+		"ed25519 a_Obwu QJvXAPj0D9MUb1exkD8pIWmC",
+		"ed25519 a_Obwu not*base64",
+	} {
+		if _, err = gomatrixserverlib.ReadSigningKeys(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected an error reading %q", bad)
+		}
+	}
+}
+
+func TestReadSigningKeysWithoutKeys(t *testing.T) {
+	keys, err := gomatrixserverlib.ReadSigningKeys(strings.NewReader("\n"))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("ReadSigningKeys: wanted no keys and no error, got %#v, %v", keys, err)
+	}
+	keys, err = gomatrixserverlib.ReadSigningKeysPEM([]byte("-----BEGIN OTHER-----\n-----END OTHER-----\n"))
+	if err != nil || len(keys) != 0 {
+		t.Errorf("ReadSigningKeysPEM: wanted no keys and no error, got %#v, %v", keys, err)
+	}
+}
+
+func TestSigningKeyFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signingkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	var keys []gomatrixserverlib.SigningKey
+	for i := 0; i < 2; i++ {
+		key, err := gomatrixserverlib.GenerateSigningKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	for _, pemFormat := range []bool{false, true} {
+		path := filepath.Join(dir, "signing.key")
+		if err = gomatrixserverlib.SaveSigningKeyFile(path, keys, pemFormat); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("wanted the key file to be private, got mode %s", info.Mode())
+		}
+		loaded, err := gomatrixserverlib.LoadSigningKeyFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded, keys) {
+			t.Errorf("pem=%v: the loaded keys don't match: %#v", pemFormat, loaded)
+		}
+	}
+}
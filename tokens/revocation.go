@@ -0,0 +1,160 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokens
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// nonceLength is the number of random bytes in a token nonce.
+const nonceLength = 16
+
+// revocationPruneInterval is how often a MemoryRevocationStore forgets about
+// the nonces of tokens that have expired.
+const revocationPruneInterval = time.Minute
+
+// ErrTokenRevoked is returned by ValidateToken when the token has been
+// revoked, or when a single-use token has already been used.
+var ErrTokenRevoked = errors.New("Provided token has been revoked")
+
+// A RevocationStore keeps track of issued token nonces and which of them
+// have been revoked. Implementations must be safe for concurrent use.
+type RevocationStore interface {
+	// TokenIssued records that a token carrying the given nonce was issued
+	// to the given user, so that it can later be revoked by RevokeUser.
+	// The token is no longer valid after it expires, so the store can
+	// forget about it then.
+	TokenIssued(userID, nonce string, expires time.Time) error
+	// IsRevoked returns true if the token issued to the given user carrying
+	// the given nonce has been revoked.
+	IsRevoked(userID, nonce string) (bool, error)
+	// RevokeToken revokes the single token carrying the given nonce.
+	// Returns false if the token had already been revoked. This must be
+	// atomic, as it is used to enforce single-use tokens.
+	RevokeToken(nonce string) (bool, error)
+	// RevokeUser revokes every token issued to the given user so far.
+	// Tokens issued afterwards are unaffected.
+	RevokeUser(userID string) error
+}
+
+// MemoryRevocationStore is an in-memory implementation of RevocationStore.
+// The zero value is ready to use. Revocations are lost when the process
+// exits, so this is mostly useful for tests and single-process servers.
+// Tokens are forgotten about once they have expired.
+type MemoryRevocationStore struct {
+	mutex     sync.Mutex
+	expiries  map[string]time.Time           // nonce -> expiry of the token
+	issued    map[string]map[string]struct{} // user ID -> set of nonces
+	revoked   map[string]struct{}            // set of nonces
+	lastPrune time.Time
+}
+
+// TokenIssued implements RevocationStore
+func (s *MemoryRevocationStore) TokenIssued(userID, nonce string, expires time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.prune(time.Now())
+	if s.expiries == nil {
+		s.expiries = make(map[string]time.Time)
+	}
+	if s.issued == nil {
+		s.issued = make(map[string]map[string]struct{})
+	}
+	if s.issued[userID] == nil {
+		s.issued[userID] = make(map[string]struct{})
+	}
+	s.expiries[nonce] = expires
+	s.issued[userID][nonce] = struct{}{}
+	return nil
+}
+
+// IsRevoked implements RevocationStore
+func (s *MemoryRevocationStore) IsRevoked(userID, nonce string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, revoked := s.revoked[nonce]
+	return revoked, nil
+}
+
+// RevokeToken implements RevocationStore
+func (s *MemoryRevocationStore) RevokeToken(nonce string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.revoke(nonce), nil
+}
+
+// RevokeUser implements RevocationStore
+func (s *MemoryRevocationStore) RevokeUser(userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for nonce := range s.issued[userID] {
+		s.revoke(nonce)
+	}
+	delete(s.issued, userID)
+	return nil
+}
+
+// prune forgets about the tokens that have expired, at most once every
+// revocationPruneInterval so that the cost is spread over many calls.
+// Revoked tokens that weren't issued by this store are never forgotten, since
+// their expiry isn't known. The caller must hold the mutex.
+func (s *MemoryRevocationStore) prune(now time.Time) {
+	if now.Sub(s.lastPrune) < revocationPruneInterval {
+		return
+	}
+	s.lastPrune = now
+	for nonce, expires := range s.expiries {
+		if now.Before(expires) {
+			continue
+		}
+		delete(s.expiries, nonce)
+		delete(s.revoked, nonce)
+	}
+	for userID, nonces := range s.issued {
+		for nonce := range nonces {
+			if _, ok := s.expiries[nonce]; !ok {
+				delete(nonces, nonce)
+			}
+		}
+		if len(nonces) == 0 {
+			delete(s.issued, userID)
+		}
+	}
+}
+
+// revoke marks the nonce as revoked. The caller must hold the mutex.
+// Returns false if the nonce was already revoked.
+func (s *MemoryRevocationStore) revoke(nonce string) bool {
+	s.prune(time.Now())
+	if s.revoked == nil {
+		s.revoked = make(map[string]struct{})
+	}
+	if _, ok := s.revoked[nonce]; ok {
+		return false
+	}
+	s.revoked[nonce] = struct{}{}
+	return true
+}
+
+// generateNonce returns a random URL-safe string for use in a nonce caveat.
+func generateNonce() (string, error) {
+	b := make([]byte, nonceLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
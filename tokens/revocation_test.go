@@ -0,0 +1,141 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tokens
+
+import (
+	"testing"
+	"time"
+)
+
+func revocableTokenOp() TokenOptions {
+	op := validTokenOp
+	op.Revocations = &MemoryRevocationStore{}
+	return op
+}
+
+func TestRevokeToken(t *testing.T) {
+	op := revocableTokenOp()
+	token, err := GenerateLoginToken(op)
+	if err != nil {
+		t.Fatalf("Unexpected error from token generation: %v", err)
+	}
+	other, err := GenerateLoginToken(op)
+	if err != nil {
+		t.Fatalf("Unexpected error from token generation: %v", err)
+	}
+	if err = ValidateToken(op, token); err != nil {
+		t.Fatalf("Token validation failed before revocation: %v", err)
+	}
+
+	mac, err := deSerializeMacaroon(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caveats, err := mac.VerifySignature(op.ServerPrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := verifyCaveats(caveats, op.UserID)
+	if err != nil || nonce == "" {
+		t.Fatalf("Expected a nonce caveat, got %q, %v", nonce, err)
+	}
+
+	if _, err = op.Revocations.RevokeToken(nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidateToken(op, token); err != ErrTokenRevoked {
+		t.Errorf("Expected ErrTokenRevoked for revoked token, got %v", err)
+	}
+	if err = ValidateToken(op, other); err != nil {
+		t.Errorf("Revoking one token should not affect another: %v", err)
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	op := revocableTokenOp()
+	first, err := GenerateLoginToken(op)
+	if err != nil {
+		t.Fatalf("Unexpected error from token generation: %v", err)
+	}
+	second, err := GenerateLoginToken(op)
+	if err != nil {
+		t.Fatalf("Unexpected error from token generation: %v", err)
+	}
+
+	if err = op.Revocations.RevokeUser(op.UserID); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{first, second} {
+		if err = ValidateToken(op, token); err != ErrTokenRevoked {
+			t.Errorf("Expected ErrTokenRevoked after revoking user, got %v", err)
+		}
+	}
+
+	third, err := GenerateLoginToken(op)
+	if err != nil {
+		t.Fatalf("Unexpected error from token generation: %v", err)
+	}
+	if err = ValidateToken(op, third); err != nil {
+		t.Errorf("Tokens issued after revoking user should be valid: %v", err)
+	}
+}
+
+func TestSingleUseToken(t *testing.T) {
+	op := revocableTokenOp()
+	op.SingleUse = true
+	token, err := GenerateLoginToken(op)
+	if err != nil {
+		t.Fatalf("Unexpected error from token generation: %v", err)
+	}
+	if err = ValidateToken(op, token); err != nil {
+		t.Errorf("First use of single-use token failed: %v", err)
+	}
+	if err = ValidateToken(op, token); err != ErrTokenRevoked {
+		t.Errorf("Expected ErrTokenRevoked on second use, got %v", err)
+	}
+
+	op.Revocations = nil
+	if _, err = GenerateLoginToken(op); err == nil {
+		t.Error("Single-use token generation should fail without a revocation store")
+	}
+}
+
+func TestRevocationStorePrunesExpiredTokens(t *testing.T) {
+	s := &MemoryRevocationStore{}
+	now := time.Now()
+	if err := s.TokenIssued("@alice:localhost", "expired", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.TokenIssued("@alice:localhost", "valid", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for _, nonce := range []string{"expired", "valid"} {
+		if _, err := s.RevokeToken(nonce); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.mutex.Lock()
+	s.prune(now.Add(2 * revocationPruneInterval))
+	_, expiredRevoked := s.revoked["expired"]
+	_, validRevoked := s.revoked["valid"]
+	issued := len(s.issued["@alice:localhost"])
+	s.mutex.Unlock()
+
+	if expiredRevoked || !validRevoked {
+		t.Errorf("Expected only the expired token to be pruned, got expired=%v valid=%v", expiredRevoked, validRevoked)
+	}
+	if issued != 1 {
+		t.Errorf("Expected 1 issued token to be left, got %d", issued)
+	}
+}
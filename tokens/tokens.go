@@ -31,6 +31,8 @@ const (
 	TimePrefix = "time < "
 	// Gen is a common caveat for every token
 	Gen = "gen = 1"
+	// NoncePrefix is a common prefix for every nonce caveat
+	NoncePrefix = "nonce = "
 )
 
 // TokenOptions represent parameters of Token
@@ -41,6 +43,13 @@ type TokenOptions struct {
 	// The valid period of the token in seconds since its generation.
 	// Only used in GenerateLoginToken; 0 is treated as defaultDuration.
 	Duration int
+	// Revocations, if not nil, records issued tokens in GenerateLoginToken
+	// and is consulted by ValidateToken to reject revoked tokens.
+	Revocations RevocationStore `yaml:"-"`
+	// SingleUse makes ValidateToken revoke the token once it has been
+	// successfully validated, as required for "m.login.token".
+	// Requires Revocations to be set.
+	SingleUse bool `yaml:"-"`
 }
 
 // GenerateLoginToken generates a short term login token to be used as
@@ -58,17 +67,32 @@ func GenerateLoginToken(op TokenOptions) (string, error) {
 	if op.Duration == 0 {
 		op.Duration = defaultDuration
 	}
-	now := time.Now().Second()
-	expiryCaveat := TimePrefix + strconv.Itoa(now+op.Duration)
+	now := time.Now().Unix()
+	expiryCaveat := TimePrefix + strconv.FormatInt(now+int64(op.Duration), 10)
 	err = mac.AddFirstPartyCaveat([]byte(expiryCaveat))
 	if err != nil {
 		return "", macaroonError(err)
 	}
 
+	nonce, err := generateNonce()
+	if err != nil {
+		return "", macaroonError(err)
+	}
+	err = mac.AddFirstPartyCaveat([]byte(NoncePrefix + nonce))
+	if err != nil {
+		return "", macaroonError(err)
+	}
+
 	urlSafeEncode, err := serializeMacaroon(*mac)
 	if err != nil {
 		return "", macaroonError(err)
 	}
+
+	if op.Revocations != nil {
+		if err = op.Revocations.TokenIssued(op.UserID, nonce, time.Unix(now+int64(op.Duration), 0)); err != nil {
+			return "", err
+		}
+	}
 	return urlSafeEncode, nil
 }
 
@@ -77,6 +101,9 @@ func isValidTokenOptions(op TokenOptions) bool {
 	if op.ServerPrivateKey == nil || op.ServerName == "" || op.UserID == "" {
 		return false
 	}
+	if op.SingleUse && op.Revocations == nil {
+		return false
+	}
 	return true
 }
 
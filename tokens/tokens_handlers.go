@@ -45,23 +45,64 @@ func ValidateToken(op TokenOptions, token string) error {
 		return errors.New("Provided token was not issued by this server")
 	}
 
-	err = verifyCaveats(caveats, op.UserID)
+	nonce, err := verifyCaveats(caveats, op.UserID)
 	if err != nil {
 		return errors.New("Provided token not authorized")
 	}
+
+	return checkRevocation(op, nonce)
+}
+
+// checkRevocation consults op.Revocations, if any, for the token with the
+// given nonce. If op.SingleUse is set then the token is revoked as well.
+// Returns ErrTokenRevoked if the token may no longer be used.
+func checkRevocation(op TokenOptions, nonce string) error {
+	if op.Revocations == nil {
+		if op.SingleUse {
+			return errors.New("Single-use tokens require a revocation store")
+		}
+		return nil
+	}
+	if nonce == "" {
+		// Tokens without a nonce can't be individually revoked, so they
+		// can't be used where revocation is required.
+		if op.SingleUse {
+			return errors.New("Provided token has no nonce")
+		}
+		return nil
+	}
+
+	revoked, err := op.Revocations.IsRevoked(op.UserID, nonce)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrTokenRevoked
+	}
+
+	if op.SingleUse {
+		fresh, err := op.Revocations.RevokeToken(nonce)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrTokenRevoked
+		}
+	}
 	return nil
 }
 
 // verifyCaveats verifies caveats associated with a login token macaroon.
-// which are "gen = 1", "user_id = ...", "time < ..."
-// Returns nil on successful verification, else returns an error.
-func verifyCaveats(caveats []string, userID string) error {
+// which are "gen = 1", "user_id = ...", "time < ..." and optionally "nonce = ...".
+// Returns the nonce, or "" if there was none, on successful verification,
+// else returns an error.
+func verifyCaveats(caveats []string, userID string) (nonce string, err error) {
 	// variable verified represents a bitmap
 	// last 4 bits are Uvvv where,
 	// U: unknownCaveat
 	// v: caveat to be verified
 	var verified uint8
-	now := time.Now().Second()
+	now := time.Now().Unix()
 
 LoopCaveat:
 	for _, caveat := range caveats {
@@ -76,6 +117,8 @@ LoopCaveat:
 			if verifyExpiry(caveat[len(TimePrefix):], now) {
 				verified |= 4
 			}
+		case strings.HasPrefix(caveat, NoncePrefix) && nonce == "":
+			nonce = caveat[len(NoncePrefix):]
 		default:
 			verified |= 8
 			break LoopCaveat
@@ -84,16 +127,16 @@ LoopCaveat:
 	// Check that all three caveats are verified and no extra caveats
 	// i.e. Uvvv == 0111
 	if verified == 7 {
-		return nil
+		return nonce, nil
 	} else if verified >= 8 {
-		return errors.New("Unknown caveat present")
+		return "", errors.New("Unknown caveat present")
 	}
 
-	return errors.New("Required caveats not present")
+	return "", errors.New("Required caveats not present")
 }
 
-func verifyExpiry(t string, now int) bool {
-	expiry, err := strconv.Atoi(t)
+func verifyExpiry(t string, now int64) bool {
+	expiry, err := strconv.ParseInt(t, 10, 64)
 
 	if err != nil {
 		return false
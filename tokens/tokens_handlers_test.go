@@ -13,7 +13,9 @@
 package tokens
 
 import (
+	"strconv"
 	"testing"
+	"time"
 )
 
 var (
@@ -90,3 +92,21 @@ func TestGetUserFromToken(t *testing.T) {
 		t.Error("UserID from Token doesn't match, got: ", name, " expected: ", validTokenOp.UserID)
 	}
 }
+
+func TestExpiryIsUnixTime(t *testing.T) {
+	now := time.Now().Unix()
+	caveats := func(expiry int64) []string {
+		return []string{Gen, UserPrefix + "@alice:localhost", TimePrefix + strconv.FormatInt(expiry, 10)}
+	}
+	// An expiry in the first minute of 1970 was valid when the time was
+	// compared with the second of the current minute.
+	if _, err := verifyCaveats(caveats(59), "@alice:localhost"); err == nil {
+		t.Error("Token validation should fail for a token that expired in 1970")
+	}
+	if _, err := verifyCaveats(caveats(now-1), "@alice:localhost"); err == nil {
+		t.Error("Token validation should fail for a token that expired a second ago")
+	}
+	if _, err := verifyCaveats(caveats(now+60), "@alice:localhost"); err != nil {
+		t.Errorf("Token validation failed for a token that expires in a minute: %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// The number of processed transactions that a TransactionProcessor
+// remembers the responses to, so that it can reply to retries.
+const recentTransactionsLimit = 1000
+
+// A PDUHandler handles an event received in a transaction from origin, once
+// it has passed the checks performed by an EventsLoader. If it returns an
+// error then the event's PDUResult reports that it couldn't be handled, but
+// the error itself is only logged so that internal errors aren't leaked to
+// other servers.
+type PDUHandler func(ctx context.Context, origin ServerName, event *HeaderedEvent) error
+
+// An EDUHandler handles an EDU received in a transaction from origin. EDUs
+// whose type has a registered content type are only handled if
+// EDU.ParseContent succeeds, so that EDUs spoofing users from other servers
+// are dropped. content is the result of EDU.ParseContent, e.g. a
+// *TypingContent for an m.typing EDU, or nil if the EDU's type doesn't have a
+// registered content type.
+type EDUHandler func(ctx context.Context, origin ServerName, edu EDU, content EDUContent)
+
+// A RoomVersionLookup returns the version of a room, or an error if the room
+// isn't known.
+type RoomVersionLookup func(ctx context.Context, roomID string) (RoomVersion, error)
+
+// A TransactionProcessor processes the transactions received by
+// PUT /_matrix/federation/v1/send/{txnID}. Each PDU is checked with an
+// EventsLoader for its room's version and passed to a PDUHandler, and each EDU
+// is passed to the EDUHandler registered for its type.
+// https://matrix.org/docs/spec/server_server/r0.1.4#put-matrix-federation-v1-send-txnid
+//
+// Retries of a transaction, i.e. transactions with the same origin and
+// transaction ID, get the response to the original transaction without being
+// processed again.
+type TransactionProcessor struct {
+	keyRing           JSONVerifier
+	roomVersion       RoomVersionLookup
+	stateProvider     StateProvider
+	authChainProvider AuthChainProvider
+	handlePDU         PDUHandler
+	eduMutex          sync.RWMutex
+	eduHandlers       map[string]EDUHandler
+	mutex             sync.Mutex
+	recent            map[transactionKey]*processedTransaction
+	recentOrder       []transactionKey
+}
+
+type transactionKey struct {
+	origin ServerName
+	txnID  TransactionID
+}
+
+// processedTransaction is a transaction being or having been processed.
+// done is closed once res and err are set.
+type processedTransaction struct {
+	done chan struct{}
+	res  RespSend
+	err  error
+}
+
+// NewTransactionProcessor makes a TransactionProcessor which checks PDUs with
+// an EventsLoader using the keyRing and providers, and passes the events that
+// pass the checks to handlePDU.
+func NewTransactionProcessor(
+	keyRing JSONVerifier, roomVersion RoomVersionLookup,
+	stateProvider StateProvider, authChainProvider AuthChainProvider,
+	handlePDU PDUHandler,
+) *TransactionProcessor {
+	return &TransactionProcessor{
+		keyRing:           keyRing,
+		roomVersion:       roomVersion,
+		stateProvider:     stateProvider,
+		authChainProvider: authChainProvider,
+		handlePDU:         handlePDU,
+		eduHandlers:       map[string]EDUHandler{},
+		recent:            map[transactionKey]*processedTransaction{},
+	}
+}
+
+// RegisterEDUHandler sets the handler for EDUs of the given type. EDUs of
+// types without a handler are ignored.
+func (p *TransactionProcessor) RegisterEDUHandler(eduType string, handler EDUHandler) {
+	p.eduMutex.Lock()
+	defer p.eduMutex.Unlock()
+	p.eduHandlers[eduType] = handler
+}
+
+// OnSendRequest handles a PUT /_matrix/federation/v1/send/{txnID} which has
+// been verified with VerifyHTTPRequest.
+func (p *TransactionProcessor) OnSendRequest(
+	ctx context.Context, req *FederationRequest, txnID TransactionID,
+) util.JSONResponse {
+	var txn Transaction
+	if err := json.Unmarshal(req.Content(), &txn); err != nil {
+		return util.MatrixErrorResponse(400, "M_BAD_JSON", "The request body could not be decoded into valid JSON. "+err.Error())
+	}
+	if err := checkTransactionLimits(txn); err != nil {
+		return util.MatrixErrorResponse(400, "M_BAD_JSON", err.Error())
+	}
+	// The origin and transaction ID in the body aren't authenticated.
+	txn.Origin = req.Origin()
+	txn.TransactionID = txnID
+
+	res, err := p.ProcessTransaction(ctx, txn)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).WithFields(logrus.Fields{
+			"origin": txn.Origin,
+			"txn_id": txnID,
+		}).Error("Failed to process transaction")
+		return util.MessageResponse(500, "Internal Server Error")
+	}
+	return util.JSONResponse{Code: 200, JSON: res}
+}
+
+// ProcessTransaction processes the transaction, which must have come from
+// txn.Origin, and returns the result of processing each PDU. If the PDUs for
+// a room can't be checked, e.g. because the keys needed to check them
+// couldn't be fetched, then each of them gets an error in its PDUResult and
+// the other rooms are still processed, so that a retry doesn't pass the
+// events that were already handled to the PDUHandler again. An error means
+// that the transaction couldn't be processed at all.
+func (p *TransactionProcessor) ProcessTransaction(ctx context.Context, txn Transaction) (RespSend, error) {
+	if err := checkTransactionLimits(txn); err != nil {
+		return RespSend{}, err
+	}
+
+	key := transactionKey{txn.Origin, txn.TransactionID}
+	p.mutex.Lock()
+	processed, ok := p.recent[key]
+	if !ok {
+		processed = &processedTransaction{done: make(chan struct{})}
+		p.recent[key] = processed
+	}
+	p.mutex.Unlock()
+	if ok {
+		// This is a retry of a transaction that we have processed or are
+		// still processing.
+		select {
+		case <-processed.done:
+			return processed.res, processed.err
+		case <-ctx.Done():
+			return RespSend{}, ctx.Err()
+		}
+	}
+
+	processed.res, processed.err = p.processTransaction(ctx, txn)
+	p.mutex.Lock()
+	if processed.err != nil {
+		// Let the origin retry it.
+		delete(p.recent, key)
+	} else {
+		p.recentOrder = append(p.recentOrder, key)
+		if len(p.recentOrder) > recentTransactionsLimit {
+			delete(p.recent, p.recentOrder[0])
+			p.recentOrder = p.recentOrder[1:]
+		}
+	}
+	p.mutex.Unlock()
+	close(processed.done)
+	return processed.res, processed.err
+}
+
+func (p *TransactionProcessor) processTransaction(ctx context.Context, txn Transaction) (RespSend, error) {
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"origin": txn.Origin,
+		"txn_id": txn.TransactionID,
+	})
+	res := RespSend{PDUs: map[string]PDUResult{}}
+
+	// Group the PDUs by room, keeping the rooms in the order that they
+	// first appear in the transaction.
+	var roomIDs []string
+	pdusByRoom := map[string][]json.RawMessage{}
+	for _, pdu := range txn.PDUs {
+		roomID := gjson.GetBytes(pdu, "room_id").Str
+		if roomID == "" {
+			// We can't tell which room version to parse it with, so we can't
+			// work out its event ID to report an error for it.
+			logger.Warn("Dropping PDU without a room ID")
+			continue
+		}
+		if _, ok := pdusByRoom[roomID]; !ok {
+			roomIDs = append(roomIDs, roomID)
+		}
+		pdusByRoom[roomID] = append(pdusByRoom[roomID], pdu)
+	}
+
+	for _, roomID := range roomIDs {
+		p.processRoomPDUs(ctx, txn.Origin, roomID, pdusByRoom[roomID], res.PDUs)
+	}
+
+	p.eduMutex.RLock()
+	defer p.eduMutex.RUnlock()
+	for _, edu := range txn.EDUs {
+		handler, ok := p.eduHandlers[edu.Type]
+		if !ok {
+			logger.WithField("edu_type", edu.Type).Debug("Ignoring EDU without a handler")
+			continue
+		}
+		content, err := edu.ParseContent(txn.Origin)
+		if err != nil {
+			if _, unknown := err.(UnknownEDUTypeError); !unknown {
+				logger.WithError(err).WithField("edu_type", edu.Type).Warn("Dropping invalid EDU")
+				continue
+			}
+		}
+		handler(ctx, txn.Origin, edu, content)
+	}
+
+	return res, nil
+}
+
+// processRoomPDUs checks the PDUs for a room, passes the events that pass to
+// the PDUHandler and adds the result for each event to results.
+func (p *TransactionProcessor) processRoomPDUs(
+	ctx context.Context, origin ServerName, roomID string,
+	pdus []json.RawMessage, results map[string]PDUResult,
+) {
+	logger := util.GetLogger(ctx).WithField("room_id", roomID)
+	roomVersion, err := p.roomVersion(ctx, roomID)
+	if err != nil {
+		// We can't work out the event IDs without the room version, so the
+		// PDUs are dropped without a result.
+		logger.WithError(err).Warn("Dropping PDUs for room with unknown version")
+		return
+	}
+
+	loader := NewEventsLoader(roomVersion, p.keyRing, p.stateProvider, p.authChainProvider, true)
+	loaded, err := loader.LoadAndVerify(ctx, pdus, TopologicalOrderByPrevEvents)
+	if err != nil {
+		logger.WithError(err).Error("Failed to check PDUs")
+		for _, pdu := range pdus {
+			if event, parseErr := NewEventFromUntrustedJSON(pdu, roomVersion); parseErr == nil {
+				results[event.EventID()] = PDUResult{Error: "Failed to check event"}
+			}
+		}
+		return
+	}
+	for _, result := range loaded {
+		if result.Error != nil {
+			if result.EventID == "" {
+				logger.WithError(result.Error).Warn("Dropping PDU which couldn't be parsed")
+				continue
+			}
+			results[result.EventID] = PDUResult{Error: result.Error.Error()}
+			continue
+		}
+		if err = p.handlePDU(ctx, origin, result.Event); err != nil {
+			logger.WithError(err).WithField("event_id", result.EventID).Error("Failed to handle PDU")
+			results[result.EventID] = PDUResult{Error: "Failed to handle event"}
+			continue
+		}
+		results[result.EventID] = PDUResult{}
+	}
+}
+
+// checkTransactionLimits returns an error if the transaction has more PDUs
+// or EDUs than a transaction may have.
+func checkTransactionLimits(txn Transaction) error {
+	if len(txn.PDUs) > MaxPDUsPerTransaction {
+		return fmt.Errorf("gomatrixserverlib: transaction has %d PDUs, more than the limit of %d", len(txn.PDUs), MaxPDUsPerTransaction)
+	}
+	if len(txn.EDUs) > MaxEDUsPerTransaction {
+		return fmt.Errorf("gomatrixserverlib: transaction has %d EDUs, more than the limit of %d", len(txn.EDUs), MaxEDUsPerTransaction)
+	}
+	return nil
+}
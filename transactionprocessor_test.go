@@ -0,0 +1,230 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Events in !roomid:baba.is.you, a version 1 room.
+var testTransactionEvents = [][]byte{
+	[]byte(`{"auth_events":[],"content":{"creator":"@userid:baba.is.you"},"depth":0,"event_id":"$WCraVpPZe5TtHAqs:baba.is.you","hashes":{"sha256":"EehWNbKy+oDOMC0vIvYl1FekdDxMNuabXKUVzV7DG74"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"08aF4/bYWKrdGPFdXmZCQU6IrOE1ulpevmWBM3kiShJPAbRbZ6Awk7buWkIxlMF6kX3kb4QpbAlZfHLQgncjCw"}},"state_key":"","type":"m.room.create"}`),
+	[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"content":{"membership":"join"},"depth":1,"event_id":"$fnwGrQEpiOIUoDU2:baba.is.you","hashes":{"sha256":"DqOjdFgvFQ3V/jvQW2j3ygHL4D+t7/LaIPZ/tHTDZtI"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}]],"prev_state":[],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"qBWLb42zicQVsbh333YrcKpHfKokcUOM/ytldGlrgSdXqDEDDxvpcFlfadYnyvj3Z/GjA2XZkqKHanNEh575Bw"}},"state_key":"@userid:baba.is.you","type":"m.room.member"}`),
+	[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":2,"event_id":"$xOJZshi3NeKKJiCf:baba.is.you","hashes":{"sha256":"lu5fF5HE090AXdu/+NpJ/RjRVRk/2tWCUozUc5t7Ru4"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"5KoVSLOBesqH9vciKXDExdu95lKFDtK1I72Hq1GG/UeEsH9jx7wL3V4jGYSKDnX2aLYp/VPiBQje7DFjde+hDQ"}},"type":"m.room.message"}`),
+	[]byte(`{"auth_events":[["$WCraVpPZe5TtHAqs:baba.is.you",{"sha256":"gBxQI2xzDLMoyIjkrpCJFBXC5NnrSemepc7SninSARI"}],["$fnwGrQEpiOIUoDU2:baba.is.you",{"sha256":"gUr26K5Tt7GQlNs8BlUup92gOzAZHbT8WNEobkrEIqk"}]],"content":{"body":"Test Message"},"depth":3,"event_id":"$4Kp0G1yWZ6tNpeI7:baba.is.you","hashes":{"sha256":"B+MjcGZRh72iaGOgyNbIxgFkHDJo6NO8NQDgiKDKDBA"},"origin":"baba.is.you","origin_server_ts":0,"prev_events":[["$xOJZshi3NeKKJiCf:baba.is.you",{"sha256":"5PGENImHC863Yz9sO6IJX+bIQthZFI2RMhFZyFy+bC0"}]],"room_id":"!roomid:baba.is.you","sender":"@userid:baba.is.you","signatures":{"baba.is.you":{"ed25519:auto":"rP+Ybp17GPCqQBrTQ3yz+q6PihdaMWvNY3SngV8aDLHv8wdDlH4ULGnjsB+Az7trqYdCE3rZVo9M7Hy5tOObDg"}},"type":"m.room.message"}`),
+}
+
+type testFailingJSONVerifier struct{}
+
+func (t *testFailingJSONVerifier) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) {
+	results := make([]VerifyJSONResult, len(requests))
+	for i := range results {
+		results[i].Error = fmt.Errorf("bad signature")
+	}
+	return results, nil
+}
+
+type testErroringJSONVerifier struct{}
+
+func (t *testErroringJSONVerifier) VerifyJSONs(ctx context.Context, requests []VerifyJSONRequest) ([]VerifyJSONResult, error) {
+	return nil, fmt.Errorf("failed to fetch keys")
+}
+
+type testTransactionHandlers struct {
+	mutex  sync.Mutex
+	pdus   []string
+	edus   []string
+	reject map[string]bool
+}
+
+func (h *testTransactionHandlers) handlePDU(ctx context.Context, origin ServerName, event *HeaderedEvent) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.pdus = append(h.pdus, event.EventID())
+	if h.reject[event.EventID()] {
+		return fmt.Errorf("rejected")
+	}
+	return nil
+}
+
+func (h *testTransactionHandlers) handleEDU(ctx context.Context, origin ServerName, edu EDU, content EDUContent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	typing, ok := content.(*TypingContent)
+	if !ok {
+		h.edus = append(h.edus, fmt.Sprintf("%s %s with content %T", origin, edu.Type, content))
+		return
+	}
+	h.edus = append(h.edus, string(origin)+" "+edu.Type+" "+typing.UserID)
+}
+
+func newTestTransactionProcessor(keyRing JSONVerifier, handlers *testTransactionHandlers) *TransactionProcessor {
+	provider := &testBackfillRequester{
+		authEventsToProvide: testTransactionEvents,
+		stateIDsAtEvent: map[string][]string{
+			"$4Kp0G1yWZ6tNpeI7:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$xOJZshi3NeKKJiCf:baba.is.you": {"$fnwGrQEpiOIUoDU2:baba.is.you", "$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$fnwGrQEpiOIUoDU2:baba.is.you": {"$WCraVpPZe5TtHAqs:baba.is.you"},
+			"$WCraVpPZe5TtHAqs:baba.is.you": nil,
+		},
+	}
+	roomVersion := func(ctx context.Context, roomID string) (RoomVersion, error) {
+		if roomID != "!roomid:baba.is.you" {
+			return "", fmt.Errorf("unknown room %s", roomID)
+		}
+		return RoomVersionV1, nil
+	}
+	p := NewTransactionProcessor(keyRing, roomVersion, provider, provider.ProvideEvents, handlers.handlePDU)
+	p.RegisterEDUHandler("m.typing", handlers.handleEDU)
+	p.RegisterEDUHandler("org.example.custom", handlers.handleEDU)
+	return p
+}
+
+func TestProcessTransaction(t *testing.T) {
+	handlers := &testTransactionHandlers{
+		reject: map[string]bool{"$4Kp0G1yWZ6tNpeI7:baba.is.you": true},
+	}
+	p := newTestTransactionProcessor(&testNopJSONVerifier{}, handlers)
+	txn := Transaction{
+		TransactionID: "1",
+		Origin:        "baba.is.you",
+		PDUs: []json.RawMessage{
+			testTransactionEvents[3],
+			testTransactionEvents[2],
+			[]byte(`{"room_id":"!unknown:baba.is.you","type":"m.room.message"}`),
+			[]byte(`{"type":"m.room.message"}`),
+		},
+		EDUs: []EDU{
+			{Type: "m.typing", Content: RawJSON(`{"room_id":"!roomid:baba.is.you","user_id":"@userid:baba.is.you","typing":true}`)},
+			// Spoofs a user from another server.
+			{Type: "m.typing", Content: RawJSON(`{"room_id":"!roomid:baba.is.you","user_id":"@userid:wall.is.stop","typing":true}`)},
+			{Type: "m.unknown"},
+			{Type: "org.example.custom", Content: RawJSON(`{}`)},
+		},
+	}
+
+	res, err := p.ProcessTransaction(context.Background(), txn)
+	if err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	want := map[string]PDUResult{
+		"$xOJZshi3NeKKJiCf:baba.is.you": {},
+		// The handler's error isn't reported to the origin.
+		"$4Kp0G1yWZ6tNpeI7:baba.is.you": {Error: "Failed to handle event"},
+	}
+	if len(res.PDUs) != len(want) {
+		t.Errorf("want results %v, got %v", want, res.PDUs)
+	}
+	for eventID, result := range want {
+		if got, ok := res.PDUs[eventID]; !ok || got != result {
+			t.Errorf("event %s: want result %+v, got %+v", eventID, result, got)
+		}
+	}
+	// The events are handled in topological order.
+	wantPDUs := []string{"$xOJZshi3NeKKJiCf:baba.is.you", "$4Kp0G1yWZ6tNpeI7:baba.is.you"}
+	if fmt.Sprint(handlers.pdus) != fmt.Sprint(wantPDUs) {
+		t.Errorf("want PDUs handled %v, got %v", wantPDUs, handlers.pdus)
+	}
+	wantEDUs := []string{
+		"baba.is.you m.typing @userid:baba.is.you",
+		"baba.is.you org.example.custom with content <nil>",
+	}
+	if fmt.Sprint(handlers.edus) != fmt.Sprint(wantEDUs) {
+		t.Errorf("want EDUs handled %v, got %v", wantEDUs, handlers.edus)
+	}
+
+	// A retry gets the same response without being processed again.
+	retried, err := p.ProcessTransaction(context.Background(), txn)
+	if err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	if len(retried.PDUs) != len(res.PDUs) || len(handlers.pdus) != 2 || len(handlers.edus) != 2 {
+		t.Errorf("retried transaction was processed again")
+	}
+
+	// The same transaction ID from a different origin is processed.
+	txn.Origin = "wall.is.stop"
+	if _, err = p.ProcessTransaction(context.Background(), txn); err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	if len(handlers.pdus) != 4 {
+		t.Errorf("transaction from a different origin wasn't processed")
+	}
+}
+
+func TestProcessTransactionReportsFailedPDUs(t *testing.T) {
+	handlers := &testTransactionHandlers{}
+	p := newTestTransactionProcessor(&testFailingJSONVerifier{}, handlers)
+	res, err := p.ProcessTransaction(context.Background(), Transaction{
+		TransactionID: "1",
+		Origin:        "baba.is.you",
+		PDUs:          []json.RawMessage{testTransactionEvents[2]},
+	})
+	if err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	if result := res.PDUs["$xOJZshi3NeKKJiCf:baba.is.you"]; result.Error == "" {
+		t.Errorf("want an error for the event, got %v", res.PDUs)
+	}
+	if len(handlers.pdus) != 0 {
+		t.Errorf("event which failed checks was handled")
+	}
+}
+
+func TestProcessTransactionReportsRoomsThatCantBeChecked(t *testing.T) {
+	handlers := &testTransactionHandlers{}
+	p := newTestTransactionProcessor(&testErroringJSONVerifier{}, handlers)
+	res, err := p.ProcessTransaction(context.Background(), Transaction{
+		TransactionID: "1",
+		Origin:        "baba.is.you",
+		PDUs:          []json.RawMessage{testTransactionEvents[2], testTransactionEvents[3]},
+	})
+	if err != nil {
+		t.Fatalf("ProcessTransaction failed: %v", err)
+	}
+	want := map[string]PDUResult{
+		"$xOJZshi3NeKKJiCf:baba.is.you": {Error: "Failed to check event"},
+		"$4Kp0G1yWZ6tNpeI7:baba.is.you": {Error: "Failed to check event"},
+	}
+	if fmt.Sprint(res.PDUs) != fmt.Sprint(want) {
+		t.Errorf("want results %v, got %v", want, res.PDUs)
+	}
+	if len(handlers.pdus) != 0 {
+		t.Errorf("events which couldn't be checked were handled")
+	}
+}
+
+func TestOnSendRequest(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	handlers := &testTransactionHandlers{}
+	p := newTestTransactionProcessor(&testNopJSONVerifier{}, handlers)
+
+	send := func(txn Transaction) int {
+		req := NewFederationRequest("PUT", "local", "/_matrix/federation/v1/send/abc")
+		if err := req.SetContent(txn); err != nil {
+			t.Fatalf("SetContent failed: %v", err)
+		}
+		if err := req.Sign("baba.is.you", "ed25519:auto", privateKey); err != nil {
+			t.Fatalf("Sign failed: %v", err)
+		}
+		return p.OnSendRequest(context.Background(), &req, "abc").Code
+	}
+
+	// The origin in the body is ignored in favour of the request's origin.
+	typing := EDU{Type: "m.typing", Content: RawJSON(`{"room_id":"!roomid:baba.is.you","user_id":"@userid:baba.is.you","typing":true}`)}
+	if code := send(Transaction{Origin: "spoofed", EDUs: []EDU{typing}}); code != 200 {
+		t.Errorf("want 200, got %d", code)
+	}
+	if len(handlers.edus) != 1 || handlers.edus[0] != "baba.is.you m.typing @userid:baba.is.you" {
+		t.Errorf("unexpected EDUs handled: %v", handlers.edus)
+	}
+
+	tooMany := Transaction{PDUs: make([]json.RawMessage, MaxPDUsPerTransaction+1)}
+	if code := send(tooMany); code != 400 {
+		t.Errorf("want 400 for too many PDUs, got %d", code)
+	}
+}
@@ -0,0 +1,602 @@
+package gomatrixserverlib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxPDUsPerTransaction is the most PDUs that a transaction may contain.
+	MaxPDUsPerTransaction = 50
+	// MaxEDUsPerTransaction is the most EDUs that a transaction may contain.
+	MaxEDUsPerTransaction = 100
+)
+
+// A TransactionSender sends transactions to other servers. FederationClient
+// implements it.
+type TransactionSender interface {
+	SendTransaction(ctx context.Context, t Transaction) (RespSend, error)
+}
+
+// A QueuedTransactionItem is a PDU or an EDU waiting to be sent to a
+// destination.
+type QueuedTransactionItem struct {
+	// The position of the item in the destination's queue. Later items have
+	// higher sequence numbers.
+	Sequence int64
+	// Either PDU or EDU is set.
+	PDU json.RawMessage
+	EDU *EDU
+}
+
+// A PendingTransaction is a transaction that is being sent to a destination,
+// which will be sent again with the same transaction ID until it succeeds.
+type PendingTransaction struct {
+	Transaction Transaction
+	// The sequence numbers of the queued items in the transaction.
+	Sequences []int64
+}
+
+// A TransactionQueueStore persists the items queued for destinations so
+// that they are sent after a restart.
+type TransactionQueueStore interface {
+	// QueuedDestinations returns the destinations which have items queued or
+	// a pending transaction.
+	QueuedDestinations(ctx context.Context) ([]ServerName, error)
+	// AppendQueuedItems adds items to the end of the destination's queue.
+	AppendQueuedItems(ctx context.Context, destination ServerName, items []QueuedTransactionItem) error
+	// QueuedItems returns the items queued for the destination, including
+	// those in its pending transaction, ordered by sequence number.
+	QueuedItems(ctx context.Context, destination ServerName) ([]QueuedTransactionItem, error)
+	// PendingTransaction returns the transaction being sent to the
+	// destination, or nil if there isn't one.
+	PendingTransaction(ctx context.Context, destination ServerName) (*PendingTransaction, error)
+	// StorePendingTransaction stores the transaction being sent to the
+	// destination before it is first sent.
+	StorePendingTransaction(ctx context.Context, destination ServerName, pending PendingTransaction) error
+	// CompletePendingTransaction deletes the destination's pending
+	// transaction and the queued items in it, once it has been sent.
+	CompletePendingTransaction(ctx context.Context, destination ServerName) error
+}
+
+// A TransactionQueue sends PDUs and EDUs to other servers. Each destination
+// has its own queue, whose items are batched into transactions and sent in
+// order, one transaction at a time. A transaction that fails is sent again
+// with the same transaction ID until it succeeds, unless the destination
+// rejected it with a 400, 403 or 413, which sending it again wouldn't fix.
+// Then it is dropped and the queue moves on to the next one.
+//
+// Transaction IDs increase with each transaction sent to a destination. They
+// start from the current time in milliseconds so that they keep increasing
+// after a restart.
+type TransactionQueue struct {
+	// How long to wait before resending a transaction that failed. The wait
+	// doubles for each consecutive failure, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// If set, called with each transaction that is dropped because the
+	// destination rejected it, and the error it was rejected with.
+	OnTransactionDropped func(destination ServerName, txn Transaction, err error)
+
+	origin       ServerName
+	sender       TransactionSender
+	store        TransactionQueueStore
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	mutex        sync.Mutex
+	destinations map[ServerName]*destinationQueue
+}
+
+// NewTransactionQueue makes a TransactionQueue which sends transactions from
+// origin using the sender and keeps the queues in the store. Call Start to
+// resume sending the items that were queued before a restart.
+func NewTransactionQueue(
+	origin ServerName, sender TransactionSender, store TransactionQueueStore,
+) *TransactionQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TransactionQueue{
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Hour,
+		origin:         origin,
+		sender:         sender,
+		store:          store,
+		ctx:            ctx,
+		cancel:         cancel,
+		destinations:   map[ServerName]*destinationQueue{},
+	}
+}
+
+// Start starts sending the items that are queued in the store.
+func (q *TransactionQueue) Start(ctx context.Context) error {
+	destinations, err := q.store.QueuedDestinations(ctx)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to load queued destinations: %w", err)
+	}
+	for _, destination := range destinations {
+		d := q.destination(destination)
+		if err = d.load(ctx); err != nil {
+			return err
+		}
+		d.wake()
+	}
+	return nil
+}
+
+// Stop stops sending transactions and waits for those being sent to finish.
+// Items that haven't been sent stay in the store.
+func (q *TransactionQueue) Stop() {
+	// Cancel under the mutex so that no more senders are added to wg once
+	// we start waiting for it.
+	q.mutex.Lock()
+	q.cancel()
+	q.mutex.Unlock()
+	q.wg.Wait()
+}
+
+// SendPDU queues the PDU to be sent to each of the destinations.
+func (q *TransactionQueue) SendPDU(
+	ctx context.Context, destinations []ServerName, pdu json.RawMessage,
+) error {
+	return q.enqueue(ctx, destinations, QueuedTransactionItem{PDU: pdu})
+}
+
+// SendEDU queues the EDU to be sent to each of the destinations.
+func (q *TransactionQueue) SendEDU(
+	ctx context.Context, destinations []ServerName, edu EDU,
+) error {
+	return q.enqueue(ctx, destinations, QueuedTransactionItem{EDU: &edu})
+}
+
+// RetryDestination resends the destination's pending transaction now rather
+// than waiting for its backoff to expire. This is useful when we learn that
+// the destination is alive again, e.g. because it sent us a request.
+func (q *TransactionQueue) RetryDestination(destination ServerName) {
+	q.mutex.Lock()
+	d, ok := q.destinations[destination]
+	q.mutex.Unlock()
+	if ok {
+		d.retry()
+	}
+}
+
+func (q *TransactionQueue) enqueue(
+	ctx context.Context, destinations []ServerName, item QueuedTransactionItem,
+) error {
+	for _, destination := range destinations {
+		if destination == q.origin {
+			continue
+		}
+		if err := q.destination(destination).enqueue(ctx, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *TransactionQueue) destination(destination ServerName) *destinationQueue {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	d, ok := q.destinations[destination]
+	if !ok {
+		d = &destinationQueue{
+			queue:       q,
+			destination: destination,
+			retrying:    make(chan struct{}, 1),
+		}
+		q.destinations[destination] = d
+	}
+	return d
+}
+
+// backoff returns how long to wait after the given number of consecutive
+// failures.
+func (q *TransactionQueue) backoff(failures int) time.Duration {
+	backoff := q.InitialBackoff
+	for i := 1; i < failures && backoff < q.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > q.MaxBackoff {
+		backoff = q.MaxBackoff
+	}
+	return backoff
+}
+
+// destinationQueue is the queue for a single destination.
+type destinationQueue struct {
+	queue        *TransactionQueue
+	destination  ServerName
+	retrying     chan struct{}
+	mutex        sync.Mutex
+	loaded       bool
+	running      bool
+	queued       bool                    // items were queued during the current send
+	items        []QueuedTransactionItem // not in the pending transaction
+	pending      *PendingTransaction
+	nextSequence int64
+	lastTxnID    int64
+}
+
+// load loads the queue from the store if it hasn't been already.
+func (d *destinationQueue) load(ctx context.Context) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.loadLocked(ctx)
+}
+
+func (d *destinationQueue) loadLocked(ctx context.Context) error {
+	if d.loaded {
+		return nil
+	}
+	store := d.queue.store
+	pending, err := store.PendingTransaction(ctx, d.destination)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to load pending transaction for %s: %w", d.destination, err)
+	}
+	items, err := store.QueuedItems(ctx, d.destination)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to load queued items for %s: %w", d.destination, err)
+	}
+	inPending := map[int64]bool{}
+	if pending != nil {
+		for _, sequence := range pending.Sequences {
+			inPending[sequence] = true
+		}
+		if id, parseErr := strconv.ParseInt(string(pending.Transaction.TransactionID), 10, 64); parseErr == nil {
+			d.lastTxnID = id
+		}
+	}
+	for _, item := range items {
+		if item.Sequence >= d.nextSequence {
+			d.nextSequence = item.Sequence + 1
+		}
+		if !inPending[item.Sequence] {
+			d.items = append(d.items, item)
+		}
+	}
+	d.pending = pending
+	d.loaded = true
+	return nil
+}
+
+func (d *destinationQueue) enqueue(ctx context.Context, item QueuedTransactionItem) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.loadLocked(ctx); err != nil {
+		return err
+	}
+	item.Sequence = d.nextSequence
+	if err := d.queue.store.AppendQueuedItems(ctx, d.destination, []QueuedTransactionItem{item}); err != nil {
+		return fmt.Errorf("gomatrixserverlib: failed to queue item for %s: %w", d.destination, err)
+	}
+	d.nextSequence++
+	d.items = append(d.items, item)
+	d.queued = d.running
+	d.startLocked()
+	return nil
+}
+
+// wake starts sending if there is anything to send.
+func (d *destinationQueue) wake() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.startLocked()
+}
+
+// retry starts sending, or cuts short the backoff if already sending.
+func (d *destinationQueue) retry() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.running {
+		select {
+		case d.retrying <- struct{}{}:
+		default:
+		}
+		return
+	}
+	d.startLocked()
+}
+
+func (d *destinationQueue) startLocked() {
+	if d.running || (d.pending == nil && len(d.items) == 0) {
+		return
+	}
+	q := d.queue
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.ctx.Err() != nil {
+		return
+	}
+	d.running = true
+	q.wg.Add(1)
+	go d.run()
+}
+
+// run sends transactions until the queue is empty, the TransactionQueue is
+// stopped or the destination is blacklisted.
+func (d *destinationQueue) run() {
+	defer d.queue.wg.Done()
+	ctx := d.queue.ctx
+	logger := util.GetLogger(ctx).WithField("destination", d.destination)
+	failures := 0
+	// Whether the pending transaction has been sent (or dropped) but not yet
+	// deleted from the store. Until it is, the pending transaction is kept so
+	// that its items aren't sent again in a new transaction.
+	sent := false
+	for {
+		pending, err := d.nextTransaction(ctx)
+		if err == nil && pending == nil {
+			return
+		}
+		if err == nil && !sent {
+			_, err = d.queue.sender.SendTransaction(ctx, pending.Transaction)
+			if isRejectedTransactionError(err) {
+				logger.WithError(err).WithField("txn_id", pending.Transaction.TransactionID).Error(
+					"Destination rejected transaction, dropping it",
+				)
+				if d.queue.OnTransactionDropped != nil {
+					d.queue.OnTransactionDropped(d.destination, pending.Transaction, err)
+				}
+				err = nil
+			}
+			sent = err == nil
+		}
+		if sent {
+			if err = d.queue.store.CompletePendingTransaction(ctx, d.destination); err == nil {
+				failures = 0
+				sent = false
+				d.complete()
+				continue
+			}
+			err = fmt.Errorf("gomatrixserverlib: failed to delete sent transaction: %w", err)
+		}
+		if ctx.Err() != nil {
+			d.stop()
+			return
+		}
+
+		failures++
+		wait := d.queue.backoff(failures)
+		if unavailable, ok := err.(DestinationUnavailableError); ok {
+			if unavailable.Blacklisted {
+				if !d.stopUnlessQueued() {
+					// The enqueue didn't start us, so try again for it.
+					continue
+				}
+				// Wait for RetryDestination or more items to be queued.
+				logger.Info("Destination is blacklisted, not sending transactions")
+				return
+			}
+			wait = time.Until(unavailable.RetryAfter)
+		}
+		logger.WithError(err).WithFields(logrus.Fields{
+			"failures":   failures,
+			"backoff_ms": int(wait / time.Millisecond),
+		}).Warn("Failed to send transaction")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			d.stop()
+			return
+		case <-d.retrying:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// isRejectedTransactionError returns whether the destination responded to a
+// transaction with an error that it would respond with again if the
+// transaction was resent, because it was malformed, too large or we aren't
+// allowed to send it. Other errors, including other 4xx responses such as a
+// 401 or 404, might be fixed by the time we retry.
+func isRejectedTransactionError(err error) bool {
+	var httpErr gomatrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.Code {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusRequestEntityTooLarge:
+		return true
+	}
+	return false
+}
+
+// nextTransaction returns the pending transaction, making one out of the
+// queued items if there isn't one. Returns nil and stops the queue if there
+// is nothing to send.
+func (d *destinationQueue) nextTransaction(ctx context.Context) (*PendingTransaction, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queued = false
+	if d.pending != nil {
+		return d.pending, nil
+	}
+	if len(d.items) == 0 {
+		d.running = false
+		return nil, nil
+	}
+
+	now := time.Now()
+	txnID := now.UnixNano() / int64(time.Millisecond)
+	if txnID <= d.lastTxnID {
+		txnID = d.lastTxnID + 1
+	}
+	pending := PendingTransaction{
+		Transaction: Transaction{
+			TransactionID:  TransactionID(strconv.FormatInt(txnID, 10)),
+			Origin:         d.queue.origin,
+			Destination:    d.destination,
+			OriginServerTS: AsTimestamp(now),
+			PDUs:           []json.RawMessage{},
+		},
+	}
+	var remaining []QueuedTransactionItem
+	for _, item := range d.items {
+		switch {
+		case item.PDU != nil && len(pending.Transaction.PDUs) < MaxPDUsPerTransaction:
+			pending.Transaction.PDUs = append(pending.Transaction.PDUs, item.PDU)
+		case item.EDU != nil && len(pending.Transaction.EDUs) < MaxEDUsPerTransaction:
+			pending.Transaction.EDUs = append(pending.Transaction.EDUs, *item.EDU)
+		default:
+			remaining = append(remaining, item)
+			continue
+		}
+		pending.Sequences = append(pending.Sequences, item.Sequence)
+	}
+	if err := d.queue.store.StorePendingTransaction(ctx, d.destination, pending); err != nil {
+		return nil, fmt.Errorf("gomatrixserverlib: failed to store pending transaction: %w", err)
+	}
+	d.lastTxnID = txnID
+	d.items = remaining
+	d.pending = &pending
+	return d.pending, nil
+}
+
+// complete forgets the pending transaction once it has been sent.
+func (d *destinationQueue) complete() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.pending = nil
+}
+
+// stop marks the queue as not sending, so that it is started again when more
+// items are queued.
+func (d *destinationQueue) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.running = false
+}
+
+// stopUnlessQueued stops the queue unless items were queued since the
+// current transaction was last sent, in which case the queue carries on
+// sending since the enqueue didn't start it. Returns whether it stopped.
+func (d *destinationQueue) stopUnlessQueued() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.queued {
+		return false
+	}
+	d.running = false
+	return true
+}
+
+// MemoryTransactionQueueStore is an in-memory implementation of
+// TransactionQueueStore, mostly useful for tests. The zero value is ready to
+// use.
+type MemoryTransactionQueueStore struct {
+	mutex   sync.Mutex
+	items   map[ServerName][]QueuedTransactionItem
+	pending map[ServerName]PendingTransaction
+}
+
+// QueuedDestinations implements TransactionQueueStore
+func (s *MemoryTransactionQueueStore) QueuedDestinations(ctx context.Context) ([]ServerName, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	queued := map[ServerName]bool{}
+	for destination := range s.items {
+		queued[destination] = true
+	}
+	for destination := range s.pending {
+		queued[destination] = true
+	}
+	destinations := make([]ServerName, 0, len(queued))
+	for destination := range queued {
+		destinations = append(destinations, destination)
+	}
+	sort.Slice(destinations, func(i, j int) bool {
+		return destinations[i] < destinations[j]
+	})
+	return destinations, nil
+}
+
+// AppendQueuedItems implements TransactionQueueStore
+func (s *MemoryTransactionQueueStore) AppendQueuedItems(
+	ctx context.Context, destination ServerName, items []QueuedTransactionItem,
+) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.items == nil {
+		s.items = map[ServerName][]QueuedTransactionItem{}
+	}
+	s.items[destination] = append(s.items[destination], items...)
+	return nil
+}
+
+// QueuedItems implements TransactionQueueStore
+func (s *MemoryTransactionQueueStore) QueuedItems(
+	ctx context.Context, destination ServerName,
+) ([]QueuedTransactionItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]QueuedTransactionItem(nil), s.items[destination]...), nil
+}
+
+// PendingTransaction implements TransactionQueueStore
+func (s *MemoryTransactionQueueStore) PendingTransaction(
+	ctx context.Context, destination ServerName,
+) (*PendingTransaction, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending, ok := s.pending[destination]
+	if !ok {
+		return nil, nil
+	}
+	return &pending, nil
+}
+
+// StorePendingTransaction implements TransactionQueueStore
+func (s *MemoryTransactionQueueStore) StorePendingTransaction(
+	ctx context.Context, destination ServerName, pending PendingTransaction,
+) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pending == nil {
+		s.pending = map[ServerName]PendingTransaction{}
+	}
+	s.pending[destination] = pending
+	return nil
+}
+
+// CompletePendingTransaction implements TransactionQueueStore
+func (s *MemoryTransactionQueueStore) CompletePendingTransaction(
+	ctx context.Context, destination ServerName,
+) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pending, ok := s.pending[destination]
+	if !ok {
+		return nil
+	}
+	sent := map[int64]bool{}
+	for _, sequence := range pending.Sequences {
+		sent[sequence] = true
+	}
+	var remaining []QueuedTransactionItem
+	for _, item := range s.items[destination] {
+		if !sent[item.Sequence] {
+			remaining = append(remaining, item)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(s.items, destination)
+	} else {
+		s.items[destination] = remaining
+	}
+	delete(s.pending, destination)
+	return nil
+}
@@ -0,0 +1,307 @@
+package gomatrixserverlib_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// recordingTransactionSender records the transactions that it is asked to
+// send, failing the first failures of them with err, or with a generic error
+// if err is nil.
+type recordingTransactionSender struct {
+	mutex        sync.Mutex
+	failures     int
+	err          error
+	transactions []gomatrixserverlib.Transaction
+	sent         chan gomatrixserverlib.Transaction
+}
+
+func newRecordingTransactionSender(failures int) *recordingTransactionSender {
+	return &recordingTransactionSender{
+		failures: failures,
+		sent:     make(chan gomatrixserverlib.Transaction, 100),
+	}
+}
+
+func (s *recordingTransactionSender) SendTransaction(
+	ctx context.Context, t gomatrixserverlib.Transaction,
+) (gomatrixserverlib.RespSend, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.transactions = append(s.transactions, t)
+	if s.failures != 0 {
+		s.failures--
+		if s.err != nil {
+			return gomatrixserverlib.RespSend{}, s.err
+		}
+		return gomatrixserverlib.RespSend{}, fmt.Errorf("failed to send transaction")
+	}
+	s.sent <- t
+	return gomatrixserverlib.RespSend{}, nil
+}
+
+func (s *recordingTransactionSender) waitForSent(t *testing.T) gomatrixserverlib.Transaction {
+	select {
+	case txn := <-s.sent:
+		return txn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a transaction to be sent")
+		return gomatrixserverlib.Transaction{}
+	}
+}
+
+func testPDU(i int) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"n":%d}`, i))
+}
+
+func TestTransactionQueueBatchesItems(t *testing.T) {
+	ctx := context.Background()
+	store := &gomatrixserverlib.MemoryTransactionQueueStore{}
+	var items []gomatrixserverlib.QueuedTransactionItem
+	for i := 0; i < 120; i++ {
+		items = append(items,
+			gomatrixserverlib.QueuedTransactionItem{Sequence: int64(len(items)), PDU: testPDU(i)},
+		)
+		if i < 75 {
+			items = append(items,
+				gomatrixserverlib.QueuedTransactionItem{Sequence: int64(len(items)), EDU: &gomatrixserverlib.EDU{Type: "m.typing"}},
+				gomatrixserverlib.QueuedTransactionItem{Sequence: int64(len(items) + 1), EDU: &gomatrixserverlib.EDU{Type: "m.receipt"}},
+			)
+		}
+	}
+	if err := store.AppendQueuedItems(ctx, "remote", items); err != nil {
+		t.Fatalf("AppendQueuedItems failed: %v", err)
+	}
+
+	sender := newRecordingTransactionSender(0)
+	queue := gomatrixserverlib.NewTransactionQueue("local", sender, store)
+	if err := queue.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer queue.Stop()
+
+	wantCounts := [][2]int{{50, 100}, {50, 50}, {20, 0}}
+	var lastID string
+	pdu := 0
+	for i, want := range wantCounts {
+		txn := sender.waitForSent(t)
+		if len(txn.PDUs) != want[0] || len(txn.EDUs) != want[1] {
+			t.Errorf("transaction %d: want %d PDUs and %d EDUs, got %d and %d",
+				i, want[0], want[1], len(txn.PDUs), len(txn.EDUs))
+		}
+		if txn.Origin != "local" || txn.Destination != "remote" {
+			t.Errorf("transaction %d: wrong origin or destination: %s -> %s", i, txn.Origin, txn.Destination)
+		}
+		if lastID != "" && (len(txn.TransactionID) < len(lastID) ||
+			(len(txn.TransactionID) == len(lastID) && string(txn.TransactionID) <= lastID)) {
+			t.Errorf("transaction %d: ID %s isn't after %s", i, txn.TransactionID, lastID)
+		}
+		lastID = string(txn.TransactionID)
+		for _, p := range txn.PDUs {
+			if string(p) != string(testPDU(pdu)) {
+				t.Errorf("transaction %d: want PDU %s, got %s", i, testPDU(pdu), p)
+			}
+			pdu++
+		}
+	}
+}
+
+func TestTransactionQueueRetriesWithSameTransactionID(t *testing.T) {
+	sender := newRecordingTransactionSender(2)
+	queue := gomatrixserverlib.NewTransactionQueue("local", sender, &gomatrixserverlib.MemoryTransactionQueueStore{})
+	queue.InitialBackoff = time.Millisecond
+	defer queue.Stop()
+
+	destinations := []gomatrixserverlib.ServerName{"local", "remote"}
+	if err := queue.SendPDU(context.Background(), destinations, testPDU(1)); err != nil {
+		t.Fatalf("SendPDU failed: %v", err)
+	}
+	sent := sender.waitForSent(t)
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	if len(sender.transactions) != 3 {
+		t.Fatalf("want 3 attempts, got %d", len(sender.transactions))
+	}
+	for _, txn := range sender.transactions {
+		if txn.TransactionID != sent.TransactionID {
+			t.Errorf("want transaction ID %s, got %s", sent.TransactionID, txn.TransactionID)
+		}
+		if txn.Destination != "remote" {
+			t.Errorf("transaction sent to %s", txn.Destination)
+		}
+	}
+}
+
+func TestTransactionQueueResumesAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	store := &gomatrixserverlib.MemoryTransactionQueueStore{}
+
+	// The first queue never manages to send anything.
+	failing := newRecordingTransactionSender(-1)
+	queue := gomatrixserverlib.NewTransactionQueue("local", failing, store)
+	queue.InitialBackoff = time.Hour
+	if err := queue.SendEDU(ctx, []gomatrixserverlib.ServerName{"remote"}, gomatrixserverlib.EDU{Type: "m.typing"}); err != nil {
+		t.Fatalf("SendEDU failed: %v", err)
+	}
+	var pending *gomatrixserverlib.PendingTransaction
+	for deadline := time.Now().Add(5 * time.Second); pending == nil && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		pending, _ = store.PendingTransaction(ctx, "remote")
+	}
+	if pending == nil {
+		t.Fatalf("no pending transaction was stored")
+	}
+	queue.Stop()
+	if err := queue.SendPDU(ctx, []gomatrixserverlib.ServerName{"remote"}, testPDU(1)); err != nil {
+		t.Fatalf("SendPDU failed: %v", err)
+	}
+
+	// The second queue sends the pending transaction again and then the
+	// items queued after it.
+	sender := newRecordingTransactionSender(0)
+	queue = gomatrixserverlib.NewTransactionQueue("local", sender, store)
+	if err := queue.Start(ctx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer queue.Stop()
+	first := sender.waitForSent(t)
+	if first.TransactionID != pending.Transaction.TransactionID || len(first.EDUs) != 1 || len(first.PDUs) != 0 {
+		t.Errorf("want pending transaction %s resent, got %+v", pending.Transaction.TransactionID, first)
+	}
+	second := sender.waitForSent(t)
+	if second.TransactionID == first.TransactionID || len(second.PDUs) != 1 {
+		t.Errorf("want a new transaction with the PDU, got %+v", second)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if destinations, _ := store.QueuedDestinations(ctx); len(destinations) == 0 {
+			return
+		}
+	}
+	t.Errorf("items were left in the store")
+}
+
+func TestTransactionQueueDropsRejectedTransactions(t *testing.T) {
+	ctx := context.Background()
+	store := &gomatrixserverlib.MemoryTransactionQueueStore{}
+	sender := newRecordingTransactionSender(1)
+	sender.err = gomatrix.HTTPError{Code: 400, Message: "M_BAD_JSON"}
+	queue := gomatrixserverlib.NewTransactionQueue("local", sender, store)
+	queue.InitialBackoff = time.Hour
+	dropped := make(chan gomatrixserverlib.Transaction, 1)
+	queue.OnTransactionDropped = func(destination gomatrixserverlib.ServerName, txn gomatrixserverlib.Transaction, err error) {
+		if httpErr, ok := err.(gomatrix.HTTPError); destination != "remote" || !ok || httpErr.Code != 400 {
+			t.Errorf("wrong transaction dropped: %s, %v", destination, err)
+		}
+		dropped <- txn
+	}
+	defer queue.Stop()
+
+	if err := queue.SendPDU(ctx, []gomatrixserverlib.ServerName{"remote"}, testPDU(1)); err != nil {
+		t.Fatalf("SendPDU failed: %v", err)
+	}
+	var first gomatrixserverlib.Transaction
+	select {
+	case first = <-dropped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the transaction to be dropped")
+	}
+	if len(first.PDUs) != 1 {
+		t.Errorf("want the PDU dropped, got %+v", first)
+	}
+
+	// The queue moves on to the next transaction without backing off.
+	if err := queue.SendPDU(ctx, []gomatrixserverlib.ServerName{"remote"}, testPDU(2)); err != nil {
+		t.Fatalf("SendPDU failed: %v", err)
+	}
+	second := sender.waitForSent(t)
+	if second.TransactionID == first.TransactionID || len(second.PDUs) != 1 || string(second.PDUs[0]) != string(testPDU(2)) {
+		t.Errorf("want a new transaction with the second PDU, got %+v", second)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if destinations, _ := store.QueuedDestinations(ctx); len(destinations) == 0 {
+			return
+		}
+	}
+	t.Errorf("items were left in the store")
+}
+
+func TestTransactionQueueRetriesUnauthorizedTransactions(t *testing.T) {
+	sender := newRecordingTransactionSender(1)
+	sender.err = gomatrix.HTTPError{Code: 401, Message: "M_UNAUTHORIZED"}
+	queue := gomatrixserverlib.NewTransactionQueue("local", sender, &gomatrixserverlib.MemoryTransactionQueueStore{})
+	queue.InitialBackoff = time.Millisecond
+	queue.OnTransactionDropped = func(destination gomatrixserverlib.ServerName, txn gomatrixserverlib.Transaction, err error) {
+		t.Errorf("transaction dropped: %v", err)
+	}
+	defer queue.Stop()
+
+	if err := queue.SendPDU(context.Background(), []gomatrixserverlib.ServerName{"remote"}, testPDU(1)); err != nil {
+		t.Fatalf("SendPDU failed: %v", err)
+	}
+	sent := sender.waitForSent(t)
+
+	sender.mutex.Lock()
+	defer sender.mutex.Unlock()
+	if len(sender.transactions) != 2 || sender.transactions[0].TransactionID != sent.TransactionID {
+		t.Errorf("want the transaction resent with the same ID, got %+v", sender.transactions)
+	}
+}
+
+// failingCompleteStore fails the first failures calls to
+// CompletePendingTransaction.
+type failingCompleteStore struct {
+	gomatrixserverlib.MemoryTransactionQueueStore
+	mutex    sync.Mutex
+	failures int
+}
+
+func (s *failingCompleteStore) CompletePendingTransaction(
+	ctx context.Context, destination gomatrixserverlib.ServerName,
+) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failures != 0 {
+		s.failures--
+		return fmt.Errorf("failed to complete transaction")
+	}
+	return s.MemoryTransactionQueueStore.CompletePendingTransaction(ctx, destination)
+}
+
+func TestTransactionQueueRetriesFailedCompletion(t *testing.T) {
+	ctx := context.Background()
+	store := &failingCompleteStore{failures: 2}
+	sender := newRecordingTransactionSender(0)
+	queue := gomatrixserverlib.NewTransactionQueue("local", sender, store)
+	queue.InitialBackoff = time.Millisecond
+	defer queue.Stop()
+
+	if err := queue.SendPDU(ctx, []gomatrixserverlib.ServerName{"remote"}, testPDU(1)); err != nil {
+		t.Fatalf("SendPDU failed: %v", err)
+	}
+	first := sender.waitForSent(t)
+	if err := queue.SendPDU(ctx, []gomatrixserverlib.ServerName{"remote"}, testPDU(2)); err != nil {
+		t.Fatalf("SendPDU failed: %v", err)
+	}
+
+	// The first transaction isn't sent again, and its PDU isn't resent in
+	// the next one.
+	second := sender.waitForSent(t)
+	if second.TransactionID == first.TransactionID || len(second.PDUs) != 1 || string(second.PDUs[0]) != string(testPDU(2)) {
+		t.Errorf("want a new transaction with only the second PDU, got %+v", second)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if destinations, _ := store.QueuedDestinations(ctx); len(destinations) == 0 {
+			return
+		}
+	}
+	t.Errorf("items were left in the store")
+}